@@ -0,0 +1,294 @@
+package cloudlogzap
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// DefaultAsyncQueueCapacity defines the default number of events the asynchronous queue can hold
+	DefaultAsyncQueueCapacity = 4096
+
+	// DefaultAsyncBatchSize defines the default maximum number of events pushed in a single batch
+	DefaultAsyncBatchSize = 100
+
+	// DefaultAsyncFlushInterval defines the default interval after which a partial batch is pushed
+	DefaultAsyncFlushInterval = time.Second
+
+	// DefaultAsyncWorkers defines the default number of background workers
+	DefaultAsyncWorkers = 1
+)
+
+// AsyncOption defines the type used for configuring asynchronous delivery
+type AsyncOption func(*asyncConfig) error
+
+type asyncConfig struct {
+	queueCapacity  int
+	batchSize      int
+	flushInterval  time.Duration
+	workers        int
+	overflowPolicy OverflowPolicy
+}
+
+// AsyncOptionQueueCapacity defines how many events may be buffered before Write blocks
+func AsyncOptionQueueCapacity(capacity int) AsyncOption {
+	return func(c *asyncConfig) error {
+		if capacity < 1 {
+			return ErrInvalidQueueCapacity
+		}
+		c.queueCapacity = capacity
+		return nil
+	}
+}
+
+// AsyncOptionBatchSize defines the maximum number of events pushed to CloudLog at once
+func AsyncOptionBatchSize(size int) AsyncOption {
+	return func(c *asyncConfig) error {
+		if size < 1 {
+			return ErrInvalidBatchSize
+		}
+		c.batchSize = size
+		return nil
+	}
+}
+
+// AsyncOptionFlushInterval defines after which time a partial batch is pushed to CloudLog
+func AsyncOptionFlushInterval(interval time.Duration) AsyncOption {
+	return func(c *asyncConfig) error {
+		if interval <= 0 {
+			return ErrInvalidFlushInterval
+		}
+		c.flushInterval = interval
+		return nil
+	}
+}
+
+// AsyncOptionWorkers defines the number of background workers pushing batches to CloudLog
+func AsyncOptionWorkers(workers int) AsyncOption {
+	return func(c *asyncConfig) error {
+		if workers < 1 {
+			return ErrInvalidWorkerCount
+		}
+		c.workers = workers
+		return nil
+	}
+}
+
+// AsyncOptionOverflowPolicy defines what happens to events which do not fit into the queue.
+// By default the caller is blocked until there is room in the queue.
+func AsyncOptionOverflowPolicy(policy OverflowPolicy) AsyncOption {
+	return func(c *asyncConfig) error {
+		if policy == nil {
+			return ErrOverflowPolicyNil
+		}
+		c.overflowPolicy = policy
+		return nil
+	}
+}
+
+func newAsyncConfig(options ...AsyncOption) (config asyncConfig, err error) {
+	config = asyncConfig{
+		queueCapacity:  DefaultAsyncQueueCapacity,
+		batchSize:      DefaultAsyncBatchSize,
+		flushInterval:  DefaultAsyncFlushInterval,
+		workers:        DefaultAsyncWorkers,
+		overflowPolicy: OverflowPolicyBlock,
+	}
+
+	for _, opt := range options {
+		if optErr := opt(&config); optErr != nil {
+			err = multierror.Append(err, optErr)
+		}
+	}
+	return
+}
+
+// asyncPipeline buffers events in a bounded queue and pushes them to CloudLog in batches
+// from a set of background workers
+type asyncPipeline struct {
+	// dropped, syncing and abandoned are accessed atomically and are kept first for 64-bit alignment
+	dropped   OverflowCounters
+	syncing   int32
+	abandoned int32
+
+	push    func([]interface{}) error
+	config  asyncConfig
+	onError func(error)
+
+	queue chan queuedEvent
+	kicks []chan struct{}
+	stop  chan struct{}
+	done  sync.WaitGroup
+
+	pendingMutex sync.Mutex
+	pendingCond  *sync.Cond
+	pending      int
+}
+
+func newAsyncPipeline(push func([]interface{}) error, config asyncConfig, onError func(error)) *asyncPipeline {
+	p := &asyncPipeline{
+		push:    push,
+		config:  config,
+		onError: onError,
+		queue:   make(chan queuedEvent, config.queueCapacity),
+		kicks:   make([]chan struct{}, config.workers),
+		stop:    make(chan struct{}),
+	}
+	p.pendingCond = sync.NewCond(&p.pendingMutex)
+
+	p.done.Add(config.workers)
+	for i := range p.kicks {
+		p.kicks[i] = make(chan struct{}, 1)
+		go p.work(p.kicks[i])
+	}
+	return p
+}
+
+// queuedEvent is an event waiting in the queue together with the level of its entry
+type queuedEvent struct {
+	event interface{}
+	level zapcore.Level
+}
+
+// enqueue adds the event to the queue, consulting the overflow policy if the queue is full
+func (p *asyncPipeline) enqueue(event interface{}, level zapcore.Level) {
+	p.addPending(1)
+	item := queuedEvent{event: event, level: level}
+
+	for {
+		select {
+		case p.queue <- item:
+			return
+		default:
+		}
+
+		switch p.config.overflowPolicy.Overflow(level) {
+		case OverflowDropNewest:
+			atomic.AddUint64(&p.dropped.DroppedNewest, 1)
+			p.addPending(-1)
+			return
+		case OverflowDropBelowLevel:
+			atomic.AddUint64(&p.dropped.DroppedBelowLevel, 1)
+			p.addPending(-1)
+			return
+		case OverflowDropOldest:
+			select {
+			case <-p.queue:
+				atomic.AddUint64(&p.dropped.DroppedOldest, 1)
+				p.addPending(-1)
+			default:
+			}
+		default:
+			p.queue <- item
+			return
+		}
+	}
+}
+
+// overflowCounters returns a snapshot of the overflow counters
+func (p *asyncPipeline) overflowCounters() OverflowCounters {
+	return OverflowCounters{
+		DroppedNewest:     atomic.LoadUint64(&p.dropped.DroppedNewest),
+		DroppedOldest:     atomic.LoadUint64(&p.dropped.DroppedOldest),
+		DroppedBelowLevel: atomic.LoadUint64(&p.dropped.DroppedBelowLevel),
+	}
+}
+
+func (p *asyncPipeline) addPending(delta int) {
+	p.pendingMutex.Lock()
+	p.pending += delta
+	if p.pending == 0 {
+		p.pendingCond.Broadcast()
+	}
+	p.pendingMutex.Unlock()
+}
+
+// drain blocks until all events enqueued so far have been handed to the client
+func (p *asyncPipeline) drain() {
+	atomic.AddInt32(&p.syncing, 1)
+	defer atomic.AddInt32(&p.syncing, -1)
+
+	for _, kick := range p.kicks {
+		select {
+		case kick <- struct{}{}:
+		default:
+		}
+	}
+
+	p.pendingMutex.Lock()
+	for p.pending > 0 {
+		p.pendingCond.Wait()
+	}
+	p.pendingMutex.Unlock()
+}
+
+// shutdown drains the queue and stops all workers
+func (p *asyncPipeline) shutdown() {
+	close(p.stop)
+	p.done.Wait()
+}
+
+// abandon lets the workers fail the remaining batches with ErrCoreClosed instead of pushing them
+func (p *asyncPipeline) abandon() {
+	atomic.StoreInt32(&p.abandoned, 1)
+}
+
+func (p *asyncPipeline) work(kick <-chan struct{}) {
+	defer p.done.Done()
+
+	ticker := time.NewTicker(p.config.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]interface{}, 0, p.config.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := ErrCoreClosed
+		if atomic.LoadInt32(&p.abandoned) == 0 {
+			err = p.push(batch)
+		}
+		if err != nil && p.onError != nil {
+			p.onError(err)
+		}
+		p.addPending(-len(batch))
+		batch = make([]interface{}, 0, p.config.batchSize)
+	}
+	// collect moves all currently queued events into batches without blocking
+	collect := func() {
+		for {
+			select {
+			case item := <-p.queue:
+				batch = append(batch, item.event)
+				if len(batch) >= p.config.batchSize {
+					flush()
+				}
+			default:
+				flush()
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case item := <-p.queue:
+			batch = append(batch, item.event)
+			if len(batch) >= p.config.batchSize ||
+				(atomic.LoadInt32(&p.syncing) > 0 && len(p.queue) == 0) {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-kick:
+			collect()
+		case <-p.stop:
+			collect()
+			return
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package cloudlogzap
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+type MockBatchCloudlogClient struct {
+	mutex   sync.Mutex
+	batches [][]interface{}
+	release chan struct{}
+}
+
+func (client *MockBatchCloudlogClient) PushEvent(e interface{}) error {
+	return client.PushEvents(e)
+}
+
+func (client *MockBatchCloudlogClient) PushEvents(events ...interface{}) error {
+	if client.release != nil {
+		<-client.release
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.batches = append(client.batches, events)
+	return nil
+}
+
+func (client *MockBatchCloudlogClient) Batches() [][]interface{} {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return append([][]interface{}(nil), client.batches...)
+}
+
+func (client *MockBatchCloudlogClient) Count() (n int) {
+	for _, batch := range client.Batches() {
+		n += len(batch)
+	}
+	return
+}
+
+func newAsyncTestCore(t *testing.T, client CloudlogClient, options ...AsyncOption) *CloudLogCore {
+	core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+	require.NoError(t, err)
+	core.client = client
+	require.NoError(t, core.EnableAsync(options...))
+	return core
+}
+
+func TestNewAsyncConfig(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		config, err := newAsyncConfig()
+		require.NoError(t, err)
+		assert.EqualValues(t, DefaultAsyncQueueCapacity, config.queueCapacity)
+		assert.EqualValues(t, DefaultAsyncBatchSize, config.batchSize)
+		assert.EqualValues(t, DefaultAsyncFlushInterval, config.flushInterval)
+		assert.EqualValues(t, DefaultAsyncWorkers, config.workers)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := newAsyncConfig(
+			AsyncOptionQueueCapacity(0),
+			AsyncOptionBatchSize(0),
+			AsyncOptionFlushInterval(0),
+			AsyncOptionWorkers(0),
+		)
+		require.Error(t, err)
+		merr, ok := err.(*multierror.Error)
+		require.True(t, ok)
+		assert.EqualValues(t, []error{
+			ErrInvalidQueueCapacity,
+			ErrInvalidBatchSize,
+			ErrInvalidFlushInterval,
+			ErrInvalidWorkerCount,
+		}, merr.Errors)
+	})
+}
+
+func TestCloudLogCore_EnableAsync(t *testing.T) {
+	core := newAsyncTestCore(t, &MockBatchCloudlogClient{})
+	defer core.async.shutdown()
+	assert.EqualValues(t, ErrAsyncAlreadyEnabled, core.EnableAsync())
+}
+
+func TestCloudLogCore_WriteAsync(t *testing.T) {
+	entry := zapcore.Entry{
+		Level:   zapcore.InfoLevel,
+		Message: "test message",
+	}
+
+	t.Run("BatchSize", func(t *testing.T) {
+		client := &MockBatchCloudlogClient{}
+		core := newAsyncTestCore(t, client,
+			AsyncOptionBatchSize(3), AsyncOptionFlushInterval(time.Hour))
+		defer core.async.shutdown()
+
+		for i := 0; i < 7; i++ {
+			require.NoError(t, core.Write(entry, nil))
+		}
+		require.NoError(t, core.Sync())
+
+		batches := client.Batches()
+		require.Len(t, batches, 3)
+		assert.Len(t, batches[0], 3)
+		assert.Len(t, batches[1], 3)
+		assert.Len(t, batches[2], 1)
+	})
+
+	t.Run("FlushInterval", func(t *testing.T) {
+		client := &MockBatchCloudlogClient{}
+		core := newAsyncTestCore(t, client, AsyncOptionFlushInterval(10*time.Millisecond))
+		defer core.async.shutdown()
+
+		require.NoError(t, core.Write(entry, nil))
+		deadline := time.Now().Add(time.Second)
+		for client.Count() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		assert.EqualValues(t, 1, client.Count())
+	})
+
+	t.Run("NonBlocking", func(t *testing.T) {
+		client := &MockBatchCloudlogClient{release: make(chan struct{})}
+		core := newAsyncTestCore(t, client, AsyncOptionBatchSize(1))
+		defer core.async.shutdown()
+
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 5; i++ {
+				core.Write(entry, nil)
+			}
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Write blocked on the client")
+		}
+		assert.EqualValues(t, 0, client.Count())
+		close(client.release)
+		require.NoError(t, core.Sync())
+		assert.EqualValues(t, 5, client.Count())
+	})
+
+	t.Run("PushEventFallback", func(t *testing.T) {
+		client := &MockCloudlogClient{}
+		core := newAsyncTestCore(t, client, AsyncOptionFlushInterval(time.Hour))
+		defer core.async.shutdown()
+
+		for i := 0; i < 3; i++ {
+			require.NoError(t, core.Write(entry, nil))
+		}
+		require.NoError(t, core.Sync())
+		assert.Len(t, client.events, 3)
+	})
+
+	t.Run("ConcurrentWorkers", func(t *testing.T) {
+		client := &MockBatchCloudlogClient{}
+		core := newAsyncTestCore(t, client,
+			AsyncOptionWorkers(4),
+			AsyncOptionBatchSize(16),
+			AsyncOptionQueueCapacity(32),
+			AsyncOptionFlushInterval(time.Hour))
+		defer core.async.shutdown()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					core.Write(entry, nil)
+				}
+			}()
+		}
+		wg.Wait()
+		require.NoError(t, core.Sync())
+		assert.EqualValues(t, 800, client.Count())
+		for _, batch := range client.Batches() {
+			assert.True(t, len(batch) <= 16)
+		}
+	})
+}
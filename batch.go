@@ -0,0 +1,116 @@
+package cloudlogzap
+
+import (
+	"fmt"
+
+	"github.com/anexia-it/go-cloudlog"
+)
+
+// BatchCloudlogClient is implemented by clients which are able to push multiple events at once,
+// like cloudlog.CloudLog. The core uses PushEvents whenever it has more than one event to push.
+//
+// cloudlog.CloudLog fails the whole batch if a single event cannot be encoded, in which case the
+// events are pushed one by one so only the unencodable events fail. Transport failures of single
+// messages are reported by cloudlog.CloudLog as sarama.ProducerErrors, which do not tell which
+// events have been delivered, so the whole batch is retried or spooled and may be duplicated.
+type BatchCloudlogClient interface {
+	CloudlogClient
+	PushEvents(events ...interface{}) error
+}
+
+var _ BatchCloudlogClient = (*cloudlog.CloudLog)(nil)
+
+// NewBatchClient returns the supplied client if it implements BatchCloudlogClient. Otherwise it
+// returns an adapter which pushes the events one by one and reports the events which could not
+// be pushed as PartialPushError.
+func NewBatchClient(client CloudlogClient) BatchCloudlogClient {
+	if batchClient, ok := client.(BatchCloudlogClient); ok {
+		return batchClient
+	}
+	return batchAdapter{CloudlogClient: client}
+}
+
+type batchAdapter struct {
+	CloudlogClient
+}
+
+// PushEvents implements BatchCloudlogClient
+func (a batchAdapter) PushEvents(events ...interface{}) error {
+	var failed []EventError
+	for i, event := range events {
+		if err := a.PushEvent(event); err != nil {
+			failed = append(failed, EventError{Index: i, Event: event, Err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return &PartialPushError{Failed: failed, Total: len(events)}
+	}
+	return nil
+}
+
+// EventError describes why a single event of a batch could not be pushed
+type EventError struct {
+	// Index is the index of the event within the batch
+	Index int
+	Event interface{}
+	Err   error
+}
+
+// PartialPushError indicates that some events of a batch could not be pushed, while the
+// others have been pushed successfully
+type PartialPushError struct {
+	// Failed lists the events which could not be pushed, in batch order
+	Failed []EventError
+	// Total is the number of events in the batch
+	Total int
+}
+
+// Error implements error
+func (e *PartialPushError) Error() string {
+	if len(e.Failed) == 0 {
+		return fmt.Sprintf("0 of %d events could not be pushed", e.Total)
+	}
+	return fmt.Sprintf("%d of %d events could not be pushed, first error: %v", len(e.Failed), e.Total, e.Failed[0].Err)
+}
+
+// WrappedErrors returns the errors of all failed events
+func (e *PartialPushError) WrappedErrors() []error {
+	errs := make([]error, len(e.Failed))
+	for i, failed := range e.Failed {
+		errs[i] = failed.Err
+	}
+	return errs
+}
+
+// FailedEvents returns the events which could not be pushed, in batch order
+func (e *PartialPushError) FailedEvents() []interface{} {
+	events := make([]interface{}, len(e.Failed))
+	for i, failed := range e.Failed {
+		events[i] = failed.Event
+	}
+	return events
+}
+
+// failedEvents returns the events which have not been pushed due to the supplied error
+func failedEvents(events []interface{}, err error) []interface{} {
+	if partial, ok := err.(*PartialPushError); ok {
+		return partial.FailedEvents()
+	}
+	return events
+}
+
+// pushBatch pushes the supplied events using PushEvents if the client supports it
+// and falls back to one PushEvent call per event otherwise
+func pushBatch(client CloudlogClient, events []interface{}) error {
+	if len(events) == 1 {
+		return client.PushEvent(events[0])
+	}
+	err := NewBatchClient(client).PushEvents(events...)
+	switch err.(type) {
+	case *cloudlog.EventEncodingError, *cloudlog.MarshalError:
+		// The batch has been rejected before sending, push the events one by one so only
+		// the unencodable ones fail
+		return batchAdapter{CloudlogClient: client}.PushEvents(events...)
+	}
+	return err
+}
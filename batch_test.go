@@ -0,0 +1,226 @@
+package cloudlogzap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+// MockSelectiveCloudlogClient fails to push events for which fail returns true
+type MockSelectiveCloudlogClient struct {
+	mutex  sync.Mutex
+	fail   func(event interface{}) bool
+	pushed []interface{}
+	calls  []interface{}
+}
+
+func (client *MockSelectiveCloudlogClient) PushEvent(e interface{}) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.calls = append(client.calls, e)
+	if client.fail(e) {
+		return errMockPushFailed
+	}
+	client.pushed = append(client.pushed, e)
+	return nil
+}
+
+func (client *MockSelectiveCloudlogClient) Calls() []interface{} {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return append([]interface{}(nil), client.calls...)
+}
+
+func (client *MockSelectiveCloudlogClient) Pushed() []interface{} {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return append([]interface{}(nil), client.pushed...)
+}
+
+// MockEncodingCloudlogClient encodes all events of a batch before pushing any of them and
+// fails the whole batch if one of them cannot be encoded, like cloudlog.CloudLog does
+type MockEncodingCloudlogClient struct {
+	MockBatchCloudlogClient
+}
+
+func (client *MockEncodingCloudlogClient) PushEvent(e interface{}) error {
+	return client.PushEvents(e)
+}
+
+func (client *MockEncodingCloudlogClient) PushEvents(events ...interface{}) error {
+	encoder := cloudlog.NewAutomaticEventEncoder()
+	for _, event := range events {
+		eventMap, err := encoder.EncodeEvent(event)
+		if err != nil {
+			return err
+		}
+		if _, err = json.Marshal(eventMap); err != nil {
+			return cloudlog.NewMarshalError(eventMap, err)
+		}
+	}
+	return client.MockBatchCloudlogClient.PushEvents(events...)
+}
+
+// MockUnencodableCloudlogClient fails integer events with an encoding error and pushes all
+// other events using the wrapped client
+type MockUnencodableCloudlogClient struct {
+	CloudlogClient
+}
+
+func (client MockUnencodableCloudlogClient) PushEvent(e interface{}) error {
+	if _, ok := e.(int); ok {
+		return cloudlog.NewUnsupportedEventType(e)
+	}
+	return client.CloudlogClient.PushEvent(e)
+}
+
+func TestNewBatchClient(t *testing.T) {
+	batchClient := &MockBatchCloudlogClient{}
+	assert.True(t, NewBatchClient(batchClient) == BatchCloudlogClient(batchClient))
+
+	client := &MockSelectiveCloudlogClient{fail: func(event interface{}) bool {
+		return event == "b" || event == "d"
+	}}
+	adapter := NewBatchClient(client)
+	require.IsType(t, batchAdapter{}, adapter)
+
+	err := adapter.PushEvents("a", "b", "c", "d")
+	require.IsType(t, &PartialPushError{}, err)
+	partial := err.(*PartialPushError)
+	assert.EqualValues(t, []EventError{
+		{Index: 1, Event: "b", Err: errMockPushFailed},
+		{Index: 3, Event: "d", Err: errMockPushFailed},
+	}, partial.Failed)
+	assert.EqualValues(t, 4, partial.Total)
+	assert.EqualValues(t, []interface{}{"b", "d"}, partial.FailedEvents())
+	assert.EqualValues(t, []error{errMockPushFailed, errMockPushFailed}, partial.WrappedErrors())
+	assert.EqualValues(t, "2 of 4 events could not be pushed, first error: "+errMockPushFailed.Error(), partial.Error())
+	assert.EqualValues(t, []interface{}{"a", "c"}, client.Pushed())
+
+	assert.NoError(t, adapter.PushEvents("a", "c"))
+}
+
+func TestPushBatch_Unencodable(t *testing.T) {
+	client := &MockEncodingCloudlogClient{}
+	unmarshalable := map[string]interface{}{"message": "c", "channel": make(chan int)}
+
+	err := pushBatch(client, []interface{}{
+		map[string]interface{}{"message": "a"},
+		42,
+		unmarshalable,
+		map[string]interface{}{"message": "d"},
+	})
+	require.IsType(t, &PartialPushError{}, err)
+	partial := err.(*PartialPushError)
+	require.Len(t, partial.Failed, 2)
+	assert.EqualValues(t, 4, partial.Total)
+	assert.EqualValues(t, 1, partial.Failed[0].Index)
+	assert.IsType(t, &cloudlog.EventEncodingError{}, partial.Failed[0].Err)
+	assert.EqualValues(t, 2, partial.Failed[1].Index)
+	assert.IsType(t, &cloudlog.MarshalError{}, partial.Failed[1].Err)
+
+	// Only the unencodable events fail
+	assert.EqualValues(t, []interface{}{
+		map[string]interface{}{"message": "a"},
+		map[string]interface{}{"message": "d"},
+	}, []interface{}{client.Batches()[0][0], client.Batches()[1][0]})
+	assert.EqualValues(t, 2, client.Count())
+}
+
+func TestRetryingClient_PushEvents_Partial(t *testing.T) {
+	failures := map[interface{}]int{"b": 1, "c": -1}
+	client := &MockSelectiveCloudlogClient{fail: func(event interface{}) bool {
+		if failures[event] == 0 {
+			return false
+		}
+		failures[event]--
+		return true
+	}}
+	rc, _ := newTestRetryingClient(t, client)
+
+	err := rc.PushEvents("a", "b", "c", "d")
+	require.IsType(t, &PartialPushError{}, err)
+	assert.EqualValues(t, []EventError{{Index: 2, Event: "c", Err: errMockPushFailed}}, err.(*PartialPushError).Failed)
+	assert.EqualValues(t, 4, err.(*PartialPushError).Total)
+
+	// Only failed events are retried
+	assert.EqualValues(t, []interface{}{"a", "b", "c", "d", "b", "c", "c"}, client.Calls())
+	assert.EqualValues(t, []interface{}{"a", "d", "b"}, client.Pushed())
+}
+
+func TestRetryingClient_PushEvents_Permanent(t *testing.T) {
+	failed := false
+	client := &MockSelectiveCloudlogClient{fail: func(event interface{}) bool {
+		if event == "b" && !failed {
+			failed = true
+			return true
+		}
+		return false
+	}}
+	rc, _ := newTestRetryingClient(t, MockUnencodableCloudlogClient{client})
+
+	err := rc.PushEvents("a", 42, "b", 43)
+	require.IsType(t, &PartialPushError{}, err)
+	partial := err.(*PartialPushError)
+	require.Len(t, partial.Failed, 2)
+	assert.EqualValues(t, []int{1, 3}, []int{partial.Failed[0].Index, partial.Failed[1].Index})
+	assert.IsType(t, &cloudlog.EventEncodingError{}, partial.Failed[0].Err)
+	assert.IsType(t, &cloudlog.EventEncodingError{}, partial.Failed[1].Err)
+
+	// The unencodable events are not retried
+	assert.EqualValues(t, []interface{}{"a", "b", "b"}, client.Calls())
+	assert.EqualValues(t, []interface{}{"a", "b"}, client.Pushed())
+}
+
+func TestCloudLogCore_PartialPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlogzap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := &MockSelectiveCloudlogClient{fail: func(event interface{}) bool {
+		return event.(document).Message == "2"
+	}}
+	core := newSpoolTestCore(t, client, dir, SpoolOptionReplayInterval(time.Hour))
+	require.NoError(t, core.EnableAsync(AsyncOptionBatchSize(3), AsyncOptionFlushInterval(time.Hour)))
+	defer core.Close()
+
+	writeMessages(t, core, 1, 3)
+	require.NoError(t, core.Sync())
+
+	// Only the failed event is spooled
+	assert.Len(t, client.Pushed(), 2)
+	assert.EqualValues(t, 1, core.SpoolStats().Events)
+}
+
+func TestCloudLogCore_PartialPush_Unencodable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlogzap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client := &MockEncodingCloudlogClient{}
+	core := newSpoolTestCore(t, client, dir, SpoolOptionReplayInterval(time.Hour))
+	core.SetConverter(ConverterFunc(func(entry zapcore.Entry, ff []zapcore.Field) interface{} {
+		event := map[string]interface{}{"message": entry.Message}
+		if entry.Message == "2" {
+			event["channel"] = make(chan int)
+		}
+		return event
+	}))
+	require.NoError(t, core.EnableAsync(AsyncOptionBatchSize(3), AsyncOptionFlushInterval(time.Hour)))
+	defer core.Close()
+
+	writeMessages(t, core, 1, 3)
+	require.NoError(t, core.Sync())
+
+	// The encodable events are pushed, the unencodable one can neither be pushed nor spooled
+	assert.EqualValues(t, 2, client.Count())
+	assert.EqualValues(t, 0, core.SpoolStats().Events)
+}
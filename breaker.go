@@ -0,0 +1,294 @@
+package cloudlogzap
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// DefaultBreakerFailureThreshold defines the default number of consecutive failures
+	// after which the circuit breaker opens
+	DefaultBreakerFailureThreshold = 5
+
+	// DefaultBreakerOpenTimeout defines the default time the circuit breaker stays open
+	// before it lets probe events through
+	DefaultBreakerOpenTimeout = 30 * time.Second
+
+	// DefaultBreakerProbes defines the default number of successful probes required to
+	// close the circuit breaker again
+	DefaultBreakerProbes = 1
+)
+
+// BreakerState describes the state of a CircuitBreaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets all events through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen short-circuits all events to the fallback
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of probe events through
+	BreakerHalfOpen
+)
+
+// String returns the lower-case name of the state
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type breakerFallback int
+
+const (
+	breakerFallbackDrop breakerFallback = iota
+	breakerFallbackSpool
+	breakerFallbackCore
+)
+
+// BreakerOption defines the type used for configuring a CircuitBreaker
+type BreakerOption func(*CircuitBreaker) error
+
+// BreakerOptionFailureThreshold defines after how many consecutive failures the circuit breaker opens
+func BreakerOptionFailureThreshold(failures int) BreakerOption {
+	return func(b *CircuitBreaker) error {
+		if failures < 1 {
+			return ErrInvalidBreakerThreshold
+		}
+		b.threshold = failures
+		return nil
+	}
+}
+
+// BreakerOptionOpenTimeout defines how long the circuit breaker stays open before it half-opens
+func BreakerOptionOpenTimeout(timeout time.Duration) BreakerOption {
+	return func(b *CircuitBreaker) error {
+		if timeout <= 0 {
+			return ErrInvalidBreakerTimeout
+		}
+		b.openTimeout = timeout
+		return nil
+	}
+}
+
+// BreakerOptionProbes defines how many probe events the half-open circuit breaker lets
+// through and how many of them have to succeed for it to close again
+func BreakerOptionProbes(probes int) BreakerOption {
+	return func(b *CircuitBreaker) error {
+		if probes < 1 {
+			return ErrInvalidBreakerProbes
+		}
+		b.probes = probes
+		return nil
+	}
+}
+
+// BreakerOptionOnStateChange defines a callback which is called on every state transition
+func BreakerOptionOnStateChange(callback func(from, to BreakerState)) BreakerOption {
+	return func(b *CircuitBreaker) error {
+		b.onStateChange = callback
+		return nil
+	}
+}
+
+// BreakerOptionFallbackDrop drops short-circuited events (default)
+func BreakerOptionFallbackDrop() BreakerOption {
+	return func(b *CircuitBreaker) error {
+		b.fallback = breakerFallbackDrop
+		b.fallbackCore = nil
+		return nil
+	}
+}
+
+// BreakerOptionFallbackSpool appends short-circuited events to the core's spool,
+// which has to be enabled before the circuit breaker
+func BreakerOptionFallbackSpool() BreakerOption {
+	return func(b *CircuitBreaker) error {
+		b.fallback = breakerFallbackSpool
+		b.fallbackCore = nil
+		return nil
+	}
+}
+
+// BreakerOptionFallbackCore writes short-circuited entries to the supplied core.
+// Events which have already been queued for asynchronous delivery when the circuit
+// breaker opens are dropped.
+func BreakerOptionFallbackCore(core zapcore.Core) BreakerOption {
+	return func(b *CircuitBreaker) error {
+		if core == nil {
+			return ErrFallbackCoreNil
+		}
+		b.fallback = breakerFallbackCore
+		b.fallbackCore = core
+		return nil
+	}
+}
+
+// CircuitBreaker stops pushing events to CloudLog after consecutive failures and
+// short-circuits them to a fallback until CloudLog has recovered
+type CircuitBreaker struct {
+	// rejected and dropped are accessed atomically and kept first for 64-bit alignment
+	rejected uint64
+	dropped  uint64
+
+	threshold     int
+	openTimeout   time.Duration
+	probes        int
+	onStateChange func(from, to BreakerState)
+	fallback      breakerFallback
+	fallbackCore  zapcore.Core
+
+	mutex          sync.Mutex
+	state          BreakerState
+	failures       int
+	openedAt       time.Time
+	probesInFlight int
+	probeSuccesses int
+
+	now func() time.Time
+}
+
+// NewCircuitBreaker returns a new, closed CircuitBreaker
+func NewCircuitBreaker(options ...BreakerOption) (b *CircuitBreaker, err error) {
+	b = &CircuitBreaker{
+		threshold:   DefaultBreakerFailureThreshold,
+		openTimeout: DefaultBreakerOpenTimeout,
+		probes:      DefaultBreakerProbes,
+		now:         time.Now,
+	}
+
+	// When returning an error ensure that we return a nil value as *CircuitBreaker
+	defer func() {
+		if err != nil {
+			b = nil
+		}
+	}()
+
+	for _, opt := range options {
+		if optErr := opt(b); optErr != nil {
+			err = multierror.Append(err, optErr)
+		}
+	}
+	return
+}
+
+// State returns the current state of the circuit breaker
+func (b *CircuitBreaker) State() BreakerState {
+	b.mutex.Lock()
+	state, transitions := b.update()
+	b.mutex.Unlock()
+
+	b.notify(transitions)
+	return state
+}
+
+// Rejected returns the number of events which have been short-circuited
+func (b *CircuitBreaker) Rejected() uint64 {
+	return atomic.LoadUint64(&b.rejected)
+}
+
+// Dropped returns the number of short-circuited events which have been dropped although a
+// fallback core is configured, because they had been queued for asynchronous delivery
+func (b *CircuitBreaker) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+type breakerTransition struct {
+	from, to BreakerState
+}
+
+// update half-opens the circuit breaker once the open timeout has passed.
+// Callers must hold the mutex.
+func (b *CircuitBreaker) update() (BreakerState, []breakerTransition) {
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.openTimeout {
+		return b.state, []breakerTransition{b.transition(BreakerHalfOpen)}
+	}
+	return b.state, nil
+}
+
+// transition changes the state and resets the counters. Callers must hold the mutex.
+func (b *CircuitBreaker) transition(to BreakerState) breakerTransition {
+	t := breakerTransition{from: b.state, to: to}
+	b.state = to
+	b.failures = 0
+	b.probesInFlight = 0
+	b.probeSuccesses = 0
+	if to == BreakerOpen {
+		b.openedAt = b.now()
+	}
+	return t
+}
+
+func (b *CircuitBreaker) notify(transitions []breakerTransition) {
+	if b.onStateChange == nil {
+		return
+	}
+	for _, t := range transitions {
+		b.onStateChange(t.from, t.to)
+	}
+}
+
+// allow returns whether events may be pushed and whether the push is a probe
+func (b *CircuitBreaker) allow() (ok, probe bool) {
+	b.mutex.Lock()
+	state, transitions := b.update()
+	switch state {
+	case BreakerClosed:
+		ok = true
+	case BreakerHalfOpen:
+		if b.probesInFlight < b.probes {
+			b.probesInFlight++
+			ok, probe = true, true
+		}
+	}
+	b.mutex.Unlock()
+
+	b.notify(transitions)
+	return
+}
+
+// done records the result of a push which has been allowed
+func (b *CircuitBreaker) done(probe bool, err error) {
+	failed := err != nil && DefaultRetryClassifier(err)
+
+	b.mutex.Lock()
+	var transitions []breakerTransition
+	switch {
+	case b.state == BreakerClosed && !probe:
+		if !failed {
+			b.failures = 0
+		} else if b.failures++; b.failures >= b.threshold {
+			transitions = append(transitions, b.transition(BreakerOpen))
+		}
+	case b.state == BreakerHalfOpen && probe:
+		b.probesInFlight--
+		if failed {
+			transitions = append(transitions, b.transition(BreakerOpen))
+		} else if b.probeSuccesses++; b.probeSuccesses >= b.probes {
+			transitions = append(transitions, b.transition(BreakerClosed))
+		}
+	}
+	b.mutex.Unlock()
+
+	b.notify(transitions)
+}
+
+// reject counts the supplied number of short-circuited events
+func (b *CircuitBreaker) reject(events int) {
+	atomic.AddUint64(&b.rejected, uint64(events))
+}
+
+// drop counts the supplied number of short-circuited events which could not be handed to the fallback
+func (b *CircuitBreaker) drop(events int) {
+	atomic.AddUint64(&b.dropped, uint64(events))
+}
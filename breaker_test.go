@@ -0,0 +1,327 @@
+package cloudlogzap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type mockClock struct {
+	now time.Time
+}
+
+func (c *mockClock) Now() time.Time {
+	return c.now
+}
+
+func newTestCircuitBreaker(t *testing.T, options ...BreakerOption) (*CircuitBreaker, *mockClock, *[]string) {
+	transitions := &[]string{}
+	options = append(options, BreakerOptionOnStateChange(func(from, to BreakerState) {
+		*transitions = append(*transitions, from.String()+"->"+to.String())
+	}))
+	b, err := NewCircuitBreaker(options...)
+	require.NoError(t, err)
+	clock := &mockClock{now: time.Now()}
+	b.now = clock.Now
+	return b, clock, transitions
+}
+
+func TestNewCircuitBreaker(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		b, err := NewCircuitBreaker()
+		require.NoError(t, err)
+		assert.EqualValues(t, DefaultBreakerFailureThreshold, b.threshold)
+		assert.EqualValues(t, DefaultBreakerOpenTimeout, b.openTimeout)
+		assert.EqualValues(t, DefaultBreakerProbes, b.probes)
+		assert.EqualValues(t, BreakerClosed, b.State())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		b, err := NewCircuitBreaker(
+			BreakerOptionFailureThreshold(0),
+			BreakerOptionOpenTimeout(0),
+			BreakerOptionProbes(0),
+			BreakerOptionFallbackCore(nil),
+		)
+		require.Error(t, err)
+		assert.Nil(t, b)
+		merr, ok := err.(*multierror.Error)
+		require.True(t, ok)
+		assert.EqualValues(t, []error{
+			ErrInvalidBreakerThreshold,
+			ErrInvalidBreakerTimeout,
+			ErrInvalidBreakerProbes,
+			ErrFallbackCoreNil,
+		}, merr.Errors)
+	})
+}
+
+func TestBreakerState_String(t *testing.T) {
+	assert.EqualValues(t, "closed", BreakerClosed.String())
+	assert.EqualValues(t, "open", BreakerOpen.String())
+	assert.EqualValues(t, "half-open", BreakerHalfOpen.String())
+	assert.EqualValues(t, "unknown", BreakerState(42).String())
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("Transitions", func(t *testing.T) {
+		b, clock, transitions := newTestCircuitBreaker(t,
+			BreakerOptionFailureThreshold(2), BreakerOptionOpenTimeout(time.Minute))
+
+		ok, probe := b.allow()
+		require.True(t, ok)
+		require.False(t, probe)
+		b.done(false, errMockPushFailed)
+		assert.EqualValues(t, BreakerClosed, b.State())
+		b.done(false, errMockPushFailed)
+		assert.EqualValues(t, BreakerOpen, b.State())
+
+		ok, _ = b.allow()
+		assert.False(t, ok)
+
+		clock.now = clock.now.Add(time.Minute)
+		assert.EqualValues(t, BreakerHalfOpen, b.State())
+		ok, probe = b.allow()
+		require.True(t, ok)
+		require.True(t, probe)
+		ok, _ = b.allow()
+		assert.False(t, ok)
+
+		// A failed probe opens the circuit breaker again
+		b.done(true, errMockPushFailed)
+		assert.EqualValues(t, BreakerOpen, b.State())
+
+		clock.now = clock.now.Add(time.Minute)
+		ok, probe = b.allow()
+		require.True(t, ok)
+		require.True(t, probe)
+		b.done(true, nil)
+		assert.EqualValues(t, BreakerClosed, b.State())
+
+		assert.EqualValues(t, []string{
+			"closed->open",
+			"open->half-open",
+			"half-open->open",
+			"open->half-open",
+			"half-open->closed",
+		}, *transitions)
+	})
+
+	t.Run("SuccessResetsFailures", func(t *testing.T) {
+		b, _, _ := newTestCircuitBreaker(t, BreakerOptionFailureThreshold(2))
+
+		b.done(false, errMockPushFailed)
+		b.done(false, nil)
+		b.done(false, errMockPushFailed)
+		assert.EqualValues(t, BreakerClosed, b.State())
+	})
+
+	t.Run("PermanentErrors", func(t *testing.T) {
+		b, _, _ := newTestCircuitBreaker(t, BreakerOptionFailureThreshold(1))
+
+		b.done(false, cloudlog.NewUnsupportedEventType(42))
+		assert.EqualValues(t, BreakerClosed, b.State())
+	})
+
+	t.Run("Probes", func(t *testing.T) {
+		b, clock, _ := newTestCircuitBreaker(t,
+			BreakerOptionFailureThreshold(1), BreakerOptionProbes(2))
+
+		b.done(false, errMockPushFailed)
+		clock.now = clock.now.Add(DefaultBreakerOpenTimeout)
+		for i := 0; i < 2; i++ {
+			ok, probe := b.allow()
+			require.True(t, ok)
+			require.True(t, probe)
+		}
+		ok, _ := b.allow()
+		assert.False(t, ok)
+
+		b.done(true, nil)
+		assert.EqualValues(t, BreakerHalfOpen, b.State())
+		b.done(true, nil)
+		assert.EqualValues(t, BreakerClosed, b.State())
+	})
+
+	t.Run("StaleResults", func(t *testing.T) {
+		b, clock, _ := newTestCircuitBreaker(t, BreakerOptionFailureThreshold(1))
+
+		b.done(false, errMockPushFailed)
+		clock.now = clock.now.Add(DefaultBreakerOpenTimeout)
+		assert.EqualValues(t, BreakerHalfOpen, b.State())
+
+		// Results of pushes allowed before the circuit breaker opened are ignored
+		b.done(false, nil)
+		assert.EqualValues(t, BreakerHalfOpen, b.State())
+	})
+}
+
+func newBreakerTestCore(t *testing.T, client CloudlogClient) *CloudLogCore {
+	core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+	require.NoError(t, err)
+	core.client = client
+	return core
+}
+
+func TestCloudLogCore_EnableCircuitBreaker(t *testing.T) {
+	core := newBreakerTestCore(t, &MockCloudlogClient{})
+	assert.Nil(t, core.CircuitBreaker())
+	assert.Error(t, core.EnableCircuitBreaker(BreakerOptionProbes(0)))
+	assert.EqualValues(t, ErrSpoolNotEnabled, core.EnableCircuitBreaker(BreakerOptionFallbackSpool()))
+	require.NoError(t, core.EnableCircuitBreaker())
+	assert.NotNil(t, core.CircuitBreaker())
+	assert.EqualValues(t, ErrCircuitBreakerAlreadyEnabled, core.EnableCircuitBreaker())
+}
+
+func TestCloudLogCore_WriteCircuitBreaker(t *testing.T) {
+	entry := zapcore.Entry{Level: zapcore.InfoLevel, Message: "test message"}
+
+	t.Run("Drop", func(t *testing.T) {
+		client := &MockFailingCloudlogClient{Failures: 1 << 30}
+		core := newBreakerTestCore(t, client)
+		require.NoError(t, core.EnableCircuitBreaker(BreakerOptionFailureThreshold(2)))
+
+		assert.Error(t, core.Write(entry, nil))
+		assert.Error(t, core.Write(entry, nil))
+		assert.NoError(t, core.Write(entry, nil))
+		assert.EqualValues(t, 2, client.Calls())
+		assert.EqualValues(t, 1, core.CircuitBreaker().Rejected())
+	})
+
+	t.Run("Core", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		fallback := zapcore.NewCore(
+			zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"}),
+			zapcore.AddSync(buf),
+			zapcore.DebugLevel)
+
+		client := &MockFailingCloudlogClient{Failures: 1}
+		core := newBreakerTestCore(t, client)
+		require.NoError(t, core.EnableCircuitBreaker(
+			BreakerOptionFailureThreshold(1), BreakerOptionFallbackCore(fallback)))
+
+		child := core.With([]zapcore.Field{zap.String("request_id", "abc")})
+		assert.Error(t, child.Write(entry, nil))
+		assert.NoError(t, child.Write(entry, []zapcore.Field{zap.Int("attempt", 2)}))
+		assert.EqualValues(t, 1, client.Calls())
+		assert.EqualValues(t, `{"msg":"test message","request_id":"abc","attempt":2}`+"\n", buf.String())
+	})
+
+	t.Run("HalfOpenCore", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		fallback := zapcore.NewCore(
+			zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"}),
+			zapcore.AddSync(buf),
+			zapcore.DebugLevel)
+
+		client := &MockFailingCloudlogClient{Failures: 1}
+		core := newBreakerTestCore(t, client)
+		require.NoError(t, core.EnableCircuitBreaker(
+			BreakerOptionFailureThreshold(1), BreakerOptionFallbackCore(fallback)))
+		clock := &mockClock{now: time.Now()}
+		core.breaker.now = clock.Now
+
+		assert.Error(t, core.Write(entry, nil))
+		clock.now = clock.now.Add(DefaultBreakerOpenTimeout)
+
+		// Entries rejected while all probes are in flight are written to the fallback core
+		ok, probe := core.breaker.allow()
+		require.True(t, ok)
+		require.True(t, probe)
+		assert.NoError(t, core.Write(entry, nil))
+		assert.EqualValues(t, 1, client.Calls())
+		assert.EqualValues(t, 1, core.CircuitBreaker().Rejected())
+		assert.EqualValues(t, `{"msg":"test message"}`+"\n", buf.String())
+	})
+
+	t.Run("AsyncCore", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		fallback := zapcore.NewCore(
+			zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"}),
+			zapcore.AddSync(buf),
+			zapcore.DebugLevel)
+
+		client := &MockFailingCloudlogClient{Failures: 1}
+		core := newBreakerTestCore(t, client)
+		require.NoError(t, core.EnableCircuitBreaker(
+			BreakerOptionFailureThreshold(1), BreakerOptionFallbackCore(fallback)))
+		clock := &mockClock{now: time.Now()}
+		core.breaker.now = clock.Now
+
+		assert.Error(t, core.Write(entry, nil))
+		clock.now = clock.now.Add(DefaultBreakerOpenTimeout)
+		require.NoError(t, core.EnableAsync())
+
+		// Queued events rejected while all probes are in flight are dropped and counted
+		ok, probe := core.breaker.allow()
+		require.True(t, ok)
+		require.True(t, probe)
+		require.NoError(t, core.Write(entry, nil))
+		require.NoError(t, core.Sync())
+		assert.EqualValues(t, 1, client.Calls())
+		assert.EqualValues(t, 1, core.CircuitBreaker().Rejected())
+		assert.EqualValues(t, 1, core.CircuitBreaker().Dropped())
+		assert.Empty(t, buf.String())
+	})
+
+	t.Run("Spool", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		client := &MockFailingCloudlogClient{Failures: 1}
+		core := newSpoolTestCore(t, client, dir, SpoolOptionReplayInterval(time.Hour))
+		defer core.spool.shutdown()
+		require.NoError(t, core.EnableCircuitBreaker(
+			BreakerOptionFailureThreshold(1), BreakerOptionFallbackSpool()))
+
+		writeMessages(t, core, 1, 3)
+		assert.EqualValues(t, 1, client.Calls())
+		assert.EqualValues(t, 3, core.SpoolStats().Events)
+		assert.EqualValues(t, 2, core.CircuitBreaker().Rejected())
+	})
+
+	t.Run("Recovers", func(t *testing.T) {
+		client := &MockFailingCloudlogClient{Failures: 1}
+		core := newBreakerTestCore(t, client)
+		require.NoError(t, core.EnableCircuitBreaker(BreakerOptionFailureThreshold(1)))
+		clock := &mockClock{now: time.Now()}
+		core.breaker.now = clock.Now
+
+		assert.Error(t, core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: "1"}, nil))
+		assert.EqualValues(t, BreakerOpen, core.CircuitBreaker().State())
+		writeMessages(t, core, 2, 2)
+
+		clock.now = clock.now.Add(DefaultBreakerOpenTimeout)
+		writeMessages(t, core, 3, 4)
+		assert.EqualValues(t, BreakerClosed, core.CircuitBreaker().State())
+		assert.EqualValues(t, []string{"3", "4"}, client.Messages())
+	})
+
+	t.Run("AsyncQueued", func(t *testing.T) {
+		client := &MockFailingCloudlogClient{Failures: 1 << 30}
+		core := newBreakerTestCore(t, client)
+		require.NoError(t, core.EnableCircuitBreaker(BreakerOptionFailureThreshold(1)))
+		require.NoError(t, core.EnableAsync(AsyncOptionBatchSize(1), AsyncOptionFlushInterval(time.Hour)))
+		defer core.async.shutdown()
+
+		writeMessages(t, core, 1, 1)
+		require.NoError(t, core.Sync())
+		require.EqualValues(t, BreakerOpen, core.CircuitBreaker().State())
+
+		// Events queued while the circuit breaker is open are rejected on delivery
+		core.async.enqueue("queued", zapcore.InfoLevel)
+		require.NoError(t, core.Sync())
+		assert.EqualValues(t, 1, client.Calls())
+		assert.EqualValues(t, 1, core.CircuitBreaker().Rejected())
+	})
+}
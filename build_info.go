@@ -0,0 +1,20 @@
+//go:build go1.12
+// +build go1.12
+
+package cloudlogzap
+
+import "runtime/debug"
+
+// addBuildInfo adds the path and version of the main module
+func addBuildInfo(fields map[string]interface{}) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if info.Main.Path != "" {
+		fields["build_path"] = info.Main.Path
+	}
+	if info.Main.Version != "" {
+		fields["build_version"] = info.Main.Version
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !go1.12
+// +build !go1.12
+
+package cloudlogzap
+
+// addBuildInfo does nothing, as build info is available since Go 1.12 only
+func addBuildInfo(fields map[string]interface{}) {}
@@ -0,0 +1,240 @@
+package cloudlogzap
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// DefaultCertificateExpiryWarning defines the default window before the expiry of a certificate
+// in which a warning is logged
+const DefaultCertificateExpiryWarning = 14 * 24 * time.Hour
+
+// certificateCheckInterval is the interval in which the expiry of the certificates is checked,
+// unless the warning window is shorter
+const certificateCheckInterval = time.Hour
+
+const (
+	certificateClient = "client"
+	certificateCA     = "ca"
+)
+
+// CertificateExpiredError indicates that a configured certificate has expired
+type CertificateExpiredError struct {
+	// Certificate is either "client" or "ca"
+	Certificate string
+	NotAfter    time.Time
+}
+
+// Error implements error
+func (e *CertificateExpiredError) Error() string {
+	return fmt.Sprintf("CloudLog %s certificate expired at %v", e.Certificate, e.NotAfter)
+}
+
+// parseCertificates returns the PEM encoded certificates
+func parseCertificates(data []byte) (certs []*x509.Certificate, err error) {
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, parseErr := x509.ParseCertificate(block.Bytes)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, ErrCertificateNotFound
+	}
+	return
+}
+
+// certificateSource returns the PEM data of a certificate supplied inline or as file
+type certificateSource struct {
+	inline string
+	file   string
+}
+
+func (s certificateSource) notAfter(earliest bool) (notAfter time.Time, err error) {
+	data := []byte(s.inline)
+	if s.file != "" {
+		if data, err = ioutil.ReadFile(s.file); err != nil {
+			return
+		}
+	}
+	certs, err := parseCertificates(data)
+	if err != nil {
+		return
+	}
+
+	// The client certificate is the first one, a CA bundle expires with its first certificate
+	notAfter = certs[0].NotAfter
+	for _, cert := range certs[1:] {
+		if earliest && cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+	return
+}
+
+// certificateMonitor tracks the expiry of the configured certificates, warning through
+// the wrapped core once a certificate is about to expire
+type certificateMonitor struct {
+	client certificateSource
+	ca     certificateSource
+	window time.Duration
+	core   zapcore.Core
+	now    func() time.Time
+	// interval is the interval of the periodic check started by start
+	interval time.Duration
+
+	mutex    sync.Mutex
+	notAfter map[string]time.Time
+	warned   map[string]time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newCertificateMonitor(client, ca certificateSource, window time.Duration) *certificateMonitor {
+	interval := certificateCheckInterval
+	if window < interval {
+		interval = window
+	}
+	return &certificateMonitor{
+		client:   client,
+		ca:       ca,
+		window:   window,
+		now:      time.Now,
+		interval: interval,
+		notAfter: make(map[string]time.Time),
+		warned:   make(map[string]time.Time),
+	}
+}
+
+// load parses the certificates and returns an error for each expired certificate
+func (m *certificateMonitor) load() (expired []error, err error) {
+	notAfter := make(map[string]time.Time, 2)
+	for name, source := range map[string]certificateSource{certificateClient: m.client, certificateCA: m.ca} {
+		if source.inline == "" && source.file == "" {
+			continue
+		}
+		if notAfter[name], err = source.notAfter(name == certificateCA); err != nil {
+			return nil, fmt.Errorf("Parsing CloudLog %s certificate failed: %v", name, err)
+		}
+	}
+
+	m.mutex.Lock()
+	m.notAfter = notAfter
+	m.mutex.Unlock()
+
+	now := m.now()
+	for _, name := range []string{certificateClient, certificateCA} {
+		if t, ok := notAfter[name]; ok && !now.Before(t) {
+			expired = append(expired, &CertificateExpiredError{Certificate: name, NotAfter: t})
+		}
+	}
+	return
+}
+
+// warn logs a warning through the wrapped core for each certificate expiring within the
+// window, once per certificate
+func (m *certificateMonitor) warn() {
+	if m.core == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	for _, name := range []string{certificateClient, certificateCA} {
+		notAfter, ok := m.notAfter[name]
+		if !ok || now.Add(m.window).Before(notAfter) || m.warned[name].Equal(notAfter) {
+			continue
+		}
+		m.warned[name] = notAfter
+
+		entry := zapcore.Entry{Level: zapcore.WarnLevel, Time: now, Message: "CloudLog certificate expires soon"}
+		if !now.Before(notAfter) {
+			entry.Level = zapcore.ErrorLevel
+			entry.Message = "CloudLog certificate has expired"
+		}
+		if ce := m.core.Check(entry, nil); ce != nil {
+			ce.Write(
+				zap.String("certificate", name),
+				zap.Time("not_after", notAfter),
+				zap.Duration("remaining", notAfter.Sub(now)),
+			)
+		}
+	}
+}
+
+// refresh reparses the certificates after they may have been reloaded
+func (m *certificateMonitor) refresh() error {
+	if _, err := m.load(); err != nil {
+		return err
+	}
+	m.warn()
+	return nil
+}
+
+// start checks the expiry of the certificates periodically until shutdown is called,
+// independent of whether they are reloaded
+func (m *certificateMonitor) start() {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.run()
+}
+
+func (m *certificateMonitor) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.warn()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// shutdown stops the periodic check, if it has been started
+func (m *certificateMonitor) shutdown() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+}
+
+// expiry returns the expiry of the client and CA certificate, which is zero if unknown
+func (m *certificateMonitor) expiry() (client, ca time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.notAfter[certificateClient], m.notAfter[certificateCA]
+}
+
+// coreOptionCertificateMonitor tracks the expiry of the certificates using the supplied monitor,
+// which warns through the wrapped core
+func coreOptionCertificateMonitor(m *certificateMonitor) CoreOption {
+	return func(cc *CloudLogCore) error {
+		m.core = cc.Core
+		cc.certificates = m
+		return nil
+	}
+}
@@ -0,0 +1,225 @@
+package cloudlogzap
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+// newCertificateTestCore returns a core writing JSON entries to the returned buffer
+func newCertificateTestCore() (zapcore.Core, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	return zapcore.NewCore(zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+		MessageKey:     "msg",
+		LevelKey:       "level",
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.NanosDurationEncoder,
+	}), zapcore.AddSync(buf), zapcore.DebugLevel), buf
+}
+
+// decodeEntries returns the JSON entries written to buf
+func decodeEntries(t *testing.T, buf *bytes.Buffer) (entries []map[string]interface{}) {
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return
+}
+
+func TestParseCertificates(t *testing.T) {
+	first, key := newTestCertificate(t, time.Now().Add(2*time.Hour))
+	second, _ := newTestCertificate(t, time.Now().Add(time.Hour))
+
+	certs, err := parseCertificates(append(append(first, key...), second...))
+	require.NoError(t, err)
+	assert.Len(t, certs, 2)
+
+	_, err = parseCertificates(key)
+	assert.EqualValues(t, ErrCertificateNotFound, err)
+
+	_, err = parseCertificates([]byte("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"))
+	assert.Error(t, err)
+
+	bundle := certificateSource{inline: string(append(first, second...))}
+	notAfter, err := bundle.notAfter(false)
+	require.NoError(t, err)
+	assert.True(t, notAfter.After(time.Now().Add(time.Hour+time.Minute)))
+	notAfter, err = bundle.notAfter(true)
+	require.NoError(t, err)
+	assert.True(t, notAfter.Before(time.Now().Add(time.Hour+time.Minute)))
+}
+
+func TestCertificateMonitor(t *testing.T) {
+	now := time.Date(2018, 9, 21, 9, 0, 0, 0, time.UTC)
+	soon, _ := newTestCertificate(t, now.Add(24*time.Hour))
+	later, _ := newTestCertificate(t, now.Add(30*24*time.Hour))
+
+	m := newCertificateMonitor(certificateSource{inline: string(soon)}, certificateSource{inline: string(later)}, 7*24*time.Hour)
+	m.now = func() time.Time { return now }
+	core, buf := newCertificateTestCore()
+	m.core = core
+
+	expired, err := m.load()
+	require.NoError(t, err)
+	assert.Empty(t, expired)
+	client, ca := m.expiry()
+	assert.True(t, client.Equal(now.Add(24*time.Hour)))
+	assert.True(t, ca.Equal(now.Add(30*24*time.Hour)))
+
+	// Each certificate is warned about once
+	m.warn()
+	m.warn()
+	entries := decodeEntries(t, buf)
+	require.Len(t, entries, 1)
+	assert.EqualValues(t, "warn", entries[0]["level"])
+	assert.EqualValues(t, "CloudLog certificate expires soon", entries[0]["msg"])
+	assert.EqualValues(t, "client", entries[0]["certificate"])
+	assert.EqualValues(t, float64(24*time.Hour), entries[0]["remaining"])
+
+	buf.Reset()
+	now = now.Add(25 * 24 * time.Hour)
+	expired, err = m.load()
+	require.NoError(t, err)
+	assert.EqualValues(t, []error{&CertificateExpiredError{Certificate: "client", NotAfter: client}}, expired)
+	m.warn()
+	entries = decodeEntries(t, buf)
+	require.Len(t, entries, 1)
+	assert.EqualValues(t, "warn", entries[0]["level"])
+	assert.EqualValues(t, "ca", entries[0]["certificate"])
+
+	m.client = certificateSource{file: filepath.Join(os.TempDir(), "cloudlogzap-missing.pem")}
+	_, err = m.load()
+	assert.Contains(t, err.Error(), "Parsing CloudLog client certificate failed: open ")
+}
+
+func TestCertificateMonitor_Periodic(t *testing.T) {
+	soon, _ := newTestCertificate(t, time.Now().Add(24*time.Hour))
+	m := newCertificateMonitor(certificateSource{inline: string(soon)}, certificateSource{}, time.Hour)
+	assert.EqualValues(t, time.Hour, m.interval)
+	m = newCertificateMonitor(certificateSource{inline: string(soon)}, certificateSource{}, 7*24*time.Hour)
+	assert.EqualValues(t, certificateCheckInterval, m.interval)
+
+	core, buf := newCertificateTestCore()
+	m.core = core
+	m.interval = time.Millisecond
+	_, err := m.load()
+	require.NoError(t, err)
+
+	// The expiring certificate is warned about without reloading or an explicit check
+	m.start()
+	for warned := false; !warned; time.Sleep(time.Millisecond) {
+		m.mutex.Lock()
+		_, warned = m.warned[certificateClient]
+		m.mutex.Unlock()
+	}
+	m.shutdown()
+
+	entries := decodeEntries(t, buf)
+	require.Len(t, entries, 1)
+	assert.EqualValues(t, "CloudLog certificate expires soon", entries[0]["msg"])
+}
+
+func TestConfig_Build_CertificateExpiry(t *testing.T) {
+	expiredCert, expiredKey := newTestCertificate(t, time.Now().Add(-time.Hour))
+	validCert, _ := newTestCertificate(t, time.Now().Add(365*24*time.Hour))
+
+	t.Run("Expired", func(t *testing.T) {
+		core, err := Config{
+			Index:             "my-index",
+			CACertificate:     string(validCert),
+			ClientCertificate: string(expiredCert),
+			ClientKey:         string(expiredKey),
+		}.Build(zapcore.NewNopCore())
+		assert.Nil(t, core)
+		errs := flattenErrors(err)
+		require.Len(t, errs, 1)
+		require.IsType(t, &CertificateExpiredError{}, errs[0])
+		assert.EqualValues(t, "client", errs[0].(*CertificateExpiredError).Certificate)
+	})
+
+	t.Run("AllowExpired", func(t *testing.T) {
+		wrapped, buf := newCertificateTestCore()
+		core, err := Config{
+			Index:             "my-index",
+			CACertificate:     string(validCert),
+			ClientCertificate: string(expiredCert),
+			ClientKey:         string(expiredKey),
+			AllowExpired:      true,
+		}.Build(wrapped)
+		require.NoError(t, err)
+		defer core.Close()
+
+		entries := decodeEntries(t, buf)
+		require.Len(t, entries, 1)
+		assert.EqualValues(t, "error", entries[0]["level"])
+		assert.EqualValues(t, "CloudLog certificate has expired", entries[0]["msg"])
+
+		stats := core.Stats()
+		assert.True(t, stats.ClientCertificateNotAfter.Before(time.Now()))
+		assert.True(t, stats.CACertificateNotAfter.After(time.Now()))
+
+		recorder := httptest.NewRecorder()
+		core.StatsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		assert.Contains(t, recorder.Body.String(), `cloudlogzap_certificate_expiry_timestamp_seconds{certificate="ca"} `)
+	})
+
+	t.Run("Window", func(t *testing.T) {
+		wrapped, buf := newCertificateTestCore()
+		core, err := Config{Index: "my-index", CACertificate: string(validCert), ExpiryWarning: Duration(time.Hour)}.Build(wrapped)
+		require.NoError(t, err)
+		defer core.Close()
+		assert.Empty(t, buf.String())
+		assert.True(t, core.Stats().ClientCertificateNotAfter.IsZero())
+		assert.EqualValues(t, time.Hour, core.certificates.interval)
+
+		// Closing the core stops the periodic check
+		require.NoError(t, core.Close())
+		select {
+		case <-core.certificates.done:
+		default:
+			assert.Fail(t, "periodic check still running")
+		}
+	})
+}
+
+func TestCertificateReloader_Expiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlogzap-expiry")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificateFiles(t, dir, time.Now().Add(365*24*time.Hour))
+
+	wrapped, buf := newCertificateTestCore()
+	core, err := Config{
+		Index:                 "my-index",
+		ClientCertificateFile: certFile,
+		ClientKeyFile:         keyFile,
+		ReloadInterval:        Duration(time.Hour),
+	}.Build(wrapped)
+	require.NoError(t, err)
+	defer core.Close()
+	assert.Empty(t, buf.String())
+
+	// The rotated certificate expires within the window
+	writeTestCertificateFiles(t, dir, time.Now().Add(24*time.Hour))
+	core.reloader.check()
+	assert.EqualValues(t, 1, core.Stats().CertificateReloads)
+	assert.True(t, core.Stats().ClientCertificateNotAfter.Before(time.Now().Add(25*time.Hour)))
+	entries := decodeEntries(t, buf)
+	require.Len(t, entries, 1)
+	assert.EqualValues(t, "CloudLog certificate expires soon", entries[0]["msg"])
+}
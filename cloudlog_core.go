@@ -1,14 +1,19 @@
 package cloudlogzap
 
 import (
-	"encoding/json"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/anexia-it/go-cloudlog"
-	"go.uber.org/zap"
+	multierror "github.com/hashicorp/go-multierror"
 	"go.uber.org/zap/zapcore"
 )
 
 var _ zapcore.Core = (*CloudLogCore)(nil)
+var _ io.Closer = (*CloudLogCore)(nil)
 
 // CloudlogClient interface allows you to pass your own implementation of a cloudlog client or mock clients
 type CloudlogClient interface {
@@ -18,81 +23,443 @@ type CloudlogClient interface {
 // CloudLogCore provides a custom zapcore.Core implementation for sending log messages to CloudLog
 type CloudLogCore struct {
 	client                CloudlogClient
+	ownsClient            bool
 	cloudLogClientOptions []cloudlog.Option
 	cloudLogIndex         string
-	parent                *zap.Logger
+	errors                *errorReporter
+	stats                 *coreStats
+	fields                []zapcore.Field
+	levelEnabler          zapcore.LevelEnabler
+	nameLevels            *NameLevels
+	async                 *asyncPipeline
+	spool                 *spool
+	breaker               *CircuitBreaker
+	reloadConfig          *reloadConfig
+	reloader              *certificateReloader
+	certificates          *certificateMonitor
+	router                Router
+	indexFallback         string
+	maxIndexClients       int
+	enrichment            *enrichment
+	errorHandling         bool
+	lifecycle             *lifecycle
+	timestampPrecision    TimestampPrecision
+	converter             Converter
 
 	zapcore.Core
 }
 
-type document struct {
-	Message string                 `cloudlog:"message"`
-	Level   string                 `cloudlog:"level"`
-	Fields  map[string]interface{} `cloudlog:"fields"`
+// lifecycle tracks whether a core and all of its clones have been closed and lets Close wait
+// for in-flight writes. Unlike a read lock, a write re-entering the core while a Close is
+// pending, e.g. from an ErrorHandler logging to a logger teeing into the core, fails instead
+// of blocking.
+type lifecycle struct {
+	mutex    sync.Mutex
+	closed   bool
+	inFlight int
+	// idle is closed once the core has been closed and all in-flight writes have returned
+	idle chan struct{}
 }
 
-var convertFunc = func(entry zapcore.Entry, ff []zapcore.Field) interface{} {
-	d := document{
-		//Timestamp: time.Now().UTC().UnixNano() / int64(time.Millisecond),
-		Message: entry.Message,
-		Level:   entry.Level.String(),
+func newLifecycle() *lifecycle {
+	return &lifecycle{idle: make(chan struct{})}
+}
+
+// enter registers a write, returning false if the core has been closed
+func (l *lifecycle) enter() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return false
 	}
+	l.inFlight++
+	return true
+}
 
-	config := zapcore.EncoderConfig{
-		NameKey:        "module",
-		CallerKey:      "caller",
-		StacktraceKey:  "stacktrace",
-		LineEnding:     zapcore.DefaultLineEnding,
-		EncodeLevel:    zapcore.LowercaseLevelEncoder,
-		EncodeTime:     zapcore.EpochTimeEncoder,
-		EncodeDuration: zapcore.SecondsDurationEncoder,
-		EncodeCaller:   zapcore.ShortCallerEncoder,
+// leave unregisters a write registered by enter
+func (l *lifecycle) leave() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.inFlight--; l.inFlight == 0 && l.closed {
+		close(l.idle)
 	}
-	enc := zapcore.NewJSONEncoder(config)
-	buf, err := enc.EncodeEntry(entry, ff)
-	if err != nil {
-		return d
+}
+
+// close marks the core as closed and returns a channel which is closed once all in-flight
+// writes have returned, or false if the core has been closed already
+func (l *lifecycle) close() (<-chan struct{}, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil, false
+	}
+	l.closed = true
+	if l.inFlight == 0 {
+		close(l.idle)
 	}
+	return l.idle, true
+}
+
+// With overrides the zapcore.Core With method and returns a clone of the CloudLogCore
+// carrying the supplied fields as context for every subsequent Write
+func (cc *CloudLogCore) With(ff []zapcore.Field) zapcore.Core {
+	clone := cc.clone()
+	clone.Core = cc.Core.With(ff)
+	for _, f := range ff {
+		// Entries of NewLoggerErrorHandler's logger are not sent to CloudLog
+		if isErrorHandlerField(f) {
+			clone.errorHandling = true
+			continue
+		}
+		clone.fields = append(clone.fields, f)
+	}
+	return clone
+}
+
+// clone returns a shallow copy of the CloudLogCore which does not share its context fields
+// with the original
+func (cc *CloudLogCore) clone() *CloudLogCore {
+	clone := *cc
+	clone.fields = make([]zapcore.Field, len(cc.fields))
+	copy(clone.fields, cc.fields)
+	return &clone
+}
+
+// Enabled overrides the zapcore.Core Enabled method and decides whether entries of the
+// given level may be sent to CloudLog
+func (cc *CloudLogCore) Enabled(l zapcore.Level) bool {
+	return cc.levelEnabled(l) || (cc.nameLevels != nil && cc.nameLevels.anyEnabled(l))
+}
 
-	fields := make(map[string]interface{})
-	if err = json.Unmarshal(buf.Bytes(), &fields); err != nil {
-		return d
+// levelEnabled decides whether entries of the given level are sent to CloudLog,
+// disregarding any per logger name overrides
+func (cc *CloudLogCore) levelEnabled(l zapcore.Level) bool {
+	if cc.levelEnabler != nil {
+		return cc.levelEnabler.Enabled(l)
 	}
+	return cc.Core.Enabled(l)
+}
 
-	d.Fields = fields
-	return d
+// SetLevelEnabler sets the LevelEnabler deciding which entries are sent to CloudLog
+// independently of the wrapped core. Passing nil restores the default of using the
+// wrapped core's level.
+// SetLevelEnabler has to be called before the core is used or cloned using With.
+func (cc *CloudLogCore) SetLevelEnabler(enabler zapcore.LevelEnabler) {
+	cc.levelEnabler = enabler
 }
 
 // Check overrides the zapcore.Core Check method
 func (cc *CloudLogCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
-	return ce.AddCore(e, cc)
+	if !cc.errorHandling && cc.enabledFor(e.LoggerName, e.Level) {
+		return ce.AddCore(e, cc)
+	}
+	return ce
 }
 
 // Write overrides the zapcore.Core Write method
 func (cc *CloudLogCore) Write(e zapcore.Entry, ff []zapcore.Field) (err error) {
+	if !cc.lifecycle.enter() {
+		return ErrCoreClosed
+	}
+	defer cc.lifecycle.leave()
+	atomic.AddUint64(&cc.stats.entriesWritten, 1)
+
+	if len(cc.fields) > 0 {
+		ff = append(cc.fields[:len(cc.fields):len(cc.fields)], ff...)
+	}
+
+	if cc.breaker != nil && cc.breaker.State() == BreakerOpen {
+		return cc.shortCircuit(e, ff)
+	}
+
+	event := cc.convert(e, ff)
+	if cc.async != nil {
+		cc.async.enqueue(event, e.Level)
+		return
+	}
 
-	event := convertFunc(e, ff)
-	err = cc.client.PushEvent(event)
+	err = cc.deliver([]interface{}{event})
+	if err == errShortCircuited {
+		// The half-open circuit breaker has rejected the entry as all probes are in flight
+		return cc.breaker.fallbackCore.Write(e, ff)
+	}
 	if err != nil {
-		cc.parent.Debug("Write failed", zap.Error(err))
+		cc.reportError(err)
 	}
 	return
 }
 
-// NewCloudlogCore returns a new CloudLogCore or an error if no cloudlog.Client could be instantiated
-func NewCloudlogCore(c zapcore.Core, index string, options []cloudlog.Option) (clc *CloudLogCore, err error) {
-	var client *cloudlog.CloudLog
-	client, err = cloudlog.NewCloudLog(index, options...)
-	if err != nil {
+// shortCircuit hands an entry rejected by the open circuit breaker to its fallback
+func (cc *CloudLogCore) shortCircuit(e zapcore.Entry, ff []zapcore.Field) error {
+	cc.breaker.reject(1)
+	switch cc.breaker.fallback {
+	case breakerFallbackCore:
+		return cc.breaker.fallbackCore.Write(e, ff)
+	case breakerFallbackSpool:
+		return cc.spool.append(cc.convert(e, ff))
+	}
+	return nil
+}
+
+// deliver pushes the events to CloudLog, passing them through the spool if one is enabled
+func (cc *CloudLogCore) deliver(events []interface{}) (err error) {
+	if cc.spool != nil && (cc.spool.config.mode == SpoolModeDurable || cc.spool.pending()) {
+		return cc.spool.append(events...)
+	}
+
+	err = cc.push(events)
+	if err == errShortCircuited {
+		switch cc.breaker.fallback {
+		case breakerFallbackSpool:
+			return cc.spool.append(events...)
+		case breakerFallbackCore:
+			// Only Write knows the entries to hand to the fallback core
+			return err
+		}
+		return nil
+	}
+	if err != nil && cc.spool != nil {
+		cc.reportError(err)
+		// Events which have been pushed in spite of the error must not be spooled
+		return cc.spool.append(failedEvents(events, err)...)
+	}
+	return
+}
+
+// push pushes the events to CloudLog unless the circuit breaker rejects them
+func (cc *CloudLogCore) push(events []interface{}) (err error) {
+	if cc.breaker == nil {
+		return cc.pushClient(events)
+	}
+
+	ok, probe := cc.breaker.allow()
+	if !ok {
+		cc.breaker.reject(len(events))
+		return errShortCircuited
+	}
+	err = cc.pushClient(events)
+	cc.breaker.done(probe, err)
+	return
+}
+
+// pushClient pushes the events using the client and records the outcome in the stats
+func (cc *CloudLogCore) pushClient(events []interface{}) error {
+	start := time.Now()
+	err := pushBatch(cc.client, events)
+	cc.stats.observePush(events, err, time.Since(start))
+	return err
+}
+
+// Sync overrides the zapcore.Core Sync method and blocks until all asynchronously
+// queued events have been pushed or spooled before syncing the wrapped core
+func (cc *CloudLogCore) Sync() error {
+	return cc.SyncContext(context.Background())
+}
+
+// SyncContext is like Sync but gives up waiting for queued events to be pushed once the
+// context is done, returning the context's error
+func (cc *CloudLogCore) SyncContext(ctx context.Context) (err error) {
+	if cc.async != nil {
+		if err = waitContext(ctx, cc.async.drain); err != nil {
+			return
+		}
+	}
+	if cc.spool != nil {
+		if syncErr := cc.spool.sync(); syncErr != nil {
+			err = multierror.Append(err, syncErr)
+		}
+	}
+	if syncErr := cc.Core.Sync(); syncErr != nil {
+		err = multierror.Append(err, syncErr)
+	}
+	return
+}
+
+// Close pushes all queued events, stops all background workers and closes the client
+// if it has been created by the core and implements io.Closer. Events which have been spooled but not yet replayed are
+// kept on disk for the next process. Afterwards Write fails with ErrCoreClosed.
+// Closing a core closes all of its clones created using With as well.
+func (cc *CloudLogCore) Close() error {
+	return cc.CloseContext(context.Background())
+}
+
+// CloseContext is like Close but gives up waiting for in-flight writes and queued events to be
+// pushed once the context is done, returning the context's error. The remaining queued events
+// are then dropped with ErrCoreClosed, and the spool and client are closed in the background
+// once the pushes in flight have returned.
+func (cc *CloudLogCore) CloseContext(ctx context.Context) error {
+	idle, ok := cc.lifecycle.close()
+	if !ok {
+		return ErrCoreClosed
+	}
+
+	if cc.reloader != nil {
+		cc.reloader.shutdown()
+	}
+	if cc.certificates != nil {
+		cc.certificates.shutdown()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		<-idle
+		if cc.async != nil {
+			cc.async.shutdown()
+		}
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return cc.release()
+	case <-ctx.Done():
+	}
+
+	if cc.async != nil {
+		cc.async.abandon()
+	}
+	go func() {
+		<-stopped
+		if err := cc.release(); err != nil {
+			cc.reportError(err)
+		}
+	}()
+	return multierror.Append(nil, ctx.Err())
+}
+
+// release closes the spool and the client once nothing pushes to them anymore
+func (cc *CloudLogCore) release() (err error) {
+	if cc.spool != nil {
+		if closeErr := cc.spool.shutdown(); closeErr != nil {
+			err = multierror.Append(err, closeErr)
+		}
+	}
+	if closer, ok := cc.client.(io.Closer); ok && cc.ownsClient {
+		if closeErr := closer.Close(); closeErr != nil {
+			err = multierror.Append(err, closeErr)
+		}
+	}
+	return
+}
+
+// waitContext runs f and waits until it has returned or the context is done
+func waitContext(ctx context.Context, f func()) error {
+	if ctx.Done() == nil {
+		f()
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// EnableAsync switches the CloudLogCore to asynchronous delivery: Write enqueues events
+// into a bounded queue which is pushed to CloudLog in batches by background workers.
+// EnableAsync has to be called before the core is used or cloned using With.
+func (cc *CloudLogCore) EnableAsync(options ...AsyncOption) (err error) {
+	if cc.async != nil {
+		return ErrAsyncAlreadyEnabled
+	}
+
+	var config asyncConfig
+	if config, err = newAsyncConfig(options...); err != nil {
+		return
+	}
+
+	cc.async = newAsyncPipeline(cc.deliverQueued, config, cc.reportError)
+	return
+}
+
+// deliverQueued delivers asynchronously queued events. Events rejected by the circuit breaker
+// cannot be written to its fallback core, as their entries are not available anymore, so they
+// are dropped and reported instead.
+func (cc *CloudLogCore) deliverQueued(events []interface{}) error {
+	err := cc.deliver(events)
+	if err == errShortCircuited {
+		cc.breaker.drop(len(events))
+		return ErrShortCircuitedEventsDropped
+	}
+	return err
+}
+
+// EnableSpool enables the on-disk spool in the supplied directory. Depending on the
+// SpoolMode either failed or all events are appended to segment files, which are
+// replayed to CloudLog in order by a background replayer. Events left behind by a
+// previous process are recovered and replayed as well.
+// EnableSpool has to be called before the core is used or cloned using With.
+func (cc *CloudLogCore) EnableSpool(dir string, options ...SpoolOption) (err error) {
+	if cc.spool != nil {
+		return ErrSpoolAlreadyEnabled
+	}
+
+	var config spoolConfig
+	if config, err = newSpoolConfig(options...); err != nil {
 		return
 	}
 
-	clc = &CloudLogCore{
-		Core:                  c,
-		cloudLogIndex:         index,
-		cloudLogClientOptions: options,
-		client:                client,
+	cc.spool, err = openSpool(dir, config, cc.pushClient, cc.reportError)
+	return
+}
+
+// EnableRetry wraps the core's client in a RetryingClient, so failed pushes are retried
+// with exponential backoff before they are reported or spooled.
+// EnableRetry has to be called before the core is used or cloned using With.
+func (cc *CloudLogCore) EnableRetry(options ...RetryOption) (err error) {
+	var client *RetryingClient
+	if client, err = NewRetryingClient(cc.client, options...); err != nil {
+		return
 	}
+	cc.client = client
+	return
+}
 
+// EnableCircuitBreaker enables a circuit breaker which stops pushing events to CloudLog
+// after consecutive failures and short-circuits them to the configured fallback until
+// probe events succeed again. A spool fallback requires the spool to be enabled first.
+// EnableCircuitBreaker has to be called before the core is used or cloned using With.
+func (cc *CloudLogCore) EnableCircuitBreaker(options ...BreakerOption) (err error) {
+	if cc.breaker != nil {
+		return ErrCircuitBreakerAlreadyEnabled
+	}
+
+	var breaker *CircuitBreaker
+	if breaker, err = NewCircuitBreaker(options...); err != nil {
+		return
+	}
+	if breaker.fallback == breakerFallbackSpool && cc.spool == nil {
+		return ErrSpoolNotEnabled
+	}
+	cc.breaker = breaker
 	return
 }
+
+// CircuitBreaker returns the core's circuit breaker or nil if it has not been enabled
+func (cc *CloudLogCore) CircuitBreaker() *CircuitBreaker {
+	return cc.breaker
+}
+
+// SpoolStats returns a snapshot of the state of the spool
+func (cc *CloudLogCore) SpoolStats() SpoolStats {
+	if cc.spool == nil {
+		return SpoolStats{}
+	}
+	return cc.spool.stats()
+}
+
+// OverflowCounters returns the number of events dropped because the asynchronous queue was full
+func (cc *CloudLogCore) OverflowCounters() OverflowCounters {
+	if cc.async == nil {
+		return OverflowCounters{}
+	}
+	return cc.async.overflowCounters()
+}
@@ -1,10 +1,16 @@
 package cloudlogzap
 
 import (
+	"context"
 	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"io"
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 )
@@ -20,7 +26,7 @@ func (client *MockCloudlogClient) PushEvent(e interface{}) error {
 
 func TestNewCloudlogCore(t *testing.T) {
 	t.Run("OK", func(t *testing.T) {
-		core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex", nil)
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
 		require.NoError(t, err)
 		require.NotNil(t, core)
 		assert.EqualValues(t, "testindex", core.cloudLogIndex)
@@ -28,7 +34,7 @@ func TestNewCloudlogCore(t *testing.T) {
 	})
 
 	t.Run("Nil", func(t *testing.T) {
-		core, err := NewCloudlogCore(zapcore.NewNopCore(), "", nil)
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "")
 		require.Error(t, err)
 		assert.Nil(t, core)
 	})
@@ -36,14 +42,14 @@ func TestNewCloudlogCore(t *testing.T) {
 
 func TestNewCloudlogCore_WithOption(t *testing.T) {
 	expected := []cloudlog.Option{cloudlog.OptionBrokers(cloudlog.DefaultBrokerAddresses...)}
-	core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex", expected)
+	core, err := NewCloudlogCoreWithCloudLogOptions(zapcore.NewNopCore(), "testindex", expected)
 	require.NoError(t, err)
 	require.NotNil(t, core)
 	require.EqualValues(t, expected, core.cloudLogClientOptions)
 }
 
 func TestCloudLogCore_Check(t *testing.T) {
-	core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex", nil)
+	core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
 	require.NoError(t, err)
 	entry := zapcore.Entry{
 		Time:       time.Now(),
@@ -62,7 +68,7 @@ func TestCloudLogCore_Check(t *testing.T) {
 }
 
 func TestCloudLogCore_Write(t *testing.T) {
-	core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex", nil)
+	core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
 	require.NoError(t, err)
 	client := &MockCloudlogClient{}
 	core.client = client
@@ -99,7 +105,7 @@ func TestCloudLogCore_ConverterFunc(t *testing.T) {
 			Type:    zapcore.Int64Type,
 		},
 	}
-	result := convertFunc(entry, ff)
+	result := DefaultConverter.Convert(entry, ff)
 	d, ok := result.(document)
 	require.True(t, ok)
 	assert.EqualValues(t, "test message", d.Message)
@@ -110,3 +116,322 @@ func TestCloudLogCore_ConverterFunc(t *testing.T) {
 	}
 	assert.EqualValues(t, d.Fields["module"], entry.LoggerName)
 }
+
+func TestCloudLogCore_With(t *testing.T) {
+	core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+	require.NoError(t, err)
+	client := &MockCloudlogClient{}
+	core.client = client
+	entry := zapcore.Entry{
+		Level:      zapcore.InfoLevel,
+		LoggerName: "test",
+		Message:    "test message",
+	}
+
+	t.Run("Nested", func(t *testing.T) {
+		client.events = nil
+		parent := core.With([]zapcore.Field{zap.String("request_id", "abc")})
+		require.IsType(t, &CloudLogCore{}, parent)
+		child := parent.With([]zapcore.Field{zap.Int64("attempt", 2)})
+		require.IsType(t, &CloudLogCore{}, child)
+
+		require.NoError(t, child.Write(entry, []zapcore.Field{zap.String("key", "value")}))
+		require.Len(t, client.events, 1)
+		d, ok := client.events[0].(document)
+		require.True(t, ok)
+		assert.EqualValues(t, "abc", d.Fields["request_id"])
+		assert.EqualValues(t, 2, d.Fields["attempt"])
+		assert.EqualValues(t, "value", d.Fields["key"])
+
+		// The parent must not have picked up the child's context
+		require.NoError(t, parent.Write(entry, nil))
+		require.Len(t, client.events, 2)
+		d = client.events[1].(document)
+		assert.EqualValues(t, "abc", d.Fields["request_id"])
+		assert.NotContains(t, d.Fields, "attempt")
+
+		// Neither must the original core
+		assert.Empty(t, core.fields)
+	})
+
+	t.Run("Siblings", func(t *testing.T) {
+		client.events = nil
+		parent := core.With([]zapcore.Field{zap.String("a", "a")})
+		first := parent.With([]zapcore.Field{zap.String("b", "first")})
+		second := parent.With([]zapcore.Field{zap.String("c", "second")})
+
+		require.NoError(t, first.Write(entry, nil))
+		require.NoError(t, second.Write(entry, nil))
+		require.Len(t, client.events, 2)
+		assert.Len(t, first.(*CloudLogCore).fields, 2)
+		assert.Len(t, second.(*CloudLogCore).fields, 2)
+		d := client.events[0].(document)
+		assert.EqualValues(t, "first", d.Fields["b"])
+		assert.NotContains(t, d.Fields, "c")
+		d = client.events[1].(document)
+		assert.EqualValues(t, "second", d.Fields["c"])
+		assert.NotContains(t, d.Fields, "b")
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		client.events = nil
+		child := core.With([]zapcore.Field{zap.String("key", "outer")}).
+			With([]zapcore.Field{zap.String("key", "inner")})
+
+		require.NoError(t, child.Write(entry, nil))
+		require.Len(t, client.events, 1)
+		d := client.events[0].(document)
+		assert.EqualValues(t, "inner", d.Fields["key"])
+
+		require.NoError(t, child.Write(entry, []zapcore.Field{zap.String("key", "site")}))
+		require.Len(t, client.events, 2)
+		d = client.events[1].(document)
+		assert.EqualValues(t, "site", d.Fields["key"])
+		assert.Len(t, child.(*CloudLogCore).fields, 2)
+	})
+}
+
+func TestCloudLogCore_Enabled(t *testing.T) {
+	newCores := func(t *testing.T, wrappedLevel zapcore.Level) (zapcore.Core, *CloudLogCore, *MockCloudlogClient) {
+		wrapped := zapcore.NewCore(
+			zapcore.NewJSONEncoder(zapcore.EncoderConfig{}), zapcore.AddSync(ioutil.Discard), wrappedLevel)
+		core, err := NewCloudlogCore(wrapped, "testindex")
+		require.NoError(t, err)
+		client := &MockCloudlogClient{}
+		core.client = client
+		return wrapped, core, client
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		_, core, _ := newCores(t, zapcore.InfoLevel)
+		assert.False(t, core.Enabled(zapcore.DebugLevel))
+		assert.True(t, core.Enabled(zapcore.InfoLevel))
+
+		ce := core.Check(zapcore.Entry{Level: zapcore.DebugLevel}, nil)
+		assert.Nil(t, ce)
+		ce = core.Check(zapcore.Entry{Level: zapcore.InfoLevel}, nil)
+		assert.NotNil(t, ce)
+	})
+
+	t.Run("Stricter", func(t *testing.T) {
+		wrapped, core, client := newCores(t, zapcore.DebugLevel)
+		core.SetLevelEnabler(zapcore.WarnLevel)
+		assert.False(t, core.Enabled(zapcore.InfoLevel))
+		assert.True(t, core.Enabled(zapcore.WarnLevel))
+
+		logger := zap.New(zapcore.NewTee(wrapped, core))
+		logger.Debug("debug")
+		logger.Info("info")
+		logger.Warn("warn")
+		require.Len(t, client.events, 1)
+		assert.EqualValues(t, "warn", client.events[0].(document).Message)
+
+		// Clones keep the level enabler
+		child := core.With([]zapcore.Field{zap.String("key", "value")})
+		assert.False(t, child.Enabled(zapcore.InfoLevel))
+	})
+
+	t.Run("Looser", func(t *testing.T) {
+		wrapped, core, client := newCores(t, zapcore.WarnLevel)
+		core.SetLevelEnabler(zapcore.DebugLevel)
+		assert.True(t, core.Enabled(zapcore.DebugLevel))
+
+		logger := zap.New(zapcore.NewTee(wrapped, core))
+		logger.Debug("debug")
+		logger.Warn("warn")
+		require.Len(t, client.events, 2)
+		assert.EqualValues(t, "debug", client.events[0].(document).Message)
+		assert.EqualValues(t, "warn", client.events[1].(document).Message)
+
+		core.SetLevelEnabler(nil)
+		assert.False(t, core.Enabled(zapcore.DebugLevel))
+	})
+}
+
+type MockClosableCloudlogClient struct {
+	MockBatchCloudlogClient
+	closed bool
+	// callsAfterClose counts the pushes started after the client has been closed
+	callsAfterClose int
+}
+
+func (client *MockClosableCloudlogClient) PushEvent(e interface{}) error {
+	return client.PushEvents(e)
+}
+
+func (client *MockClosableCloudlogClient) PushEvents(events ...interface{}) error {
+	client.mutex.Lock()
+	if client.closed {
+		client.callsAfterClose++
+	}
+	client.mutex.Unlock()
+	return client.MockBatchCloudlogClient.PushEvents(events...)
+}
+
+func (client *MockClosableCloudlogClient) Close() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.closed = true
+	return nil
+}
+
+func (client *MockClosableCloudlogClient) Closed() bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.closed
+}
+
+func TestCloudLogCore_Close(t *testing.T) {
+	entry := zapcore.Entry{Level: zapcore.InfoLevel, Message: "test message"}
+
+	t.Run("Sync", func(t *testing.T) {
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+		require.NoError(t, err)
+		child := core.With([]zapcore.Field{zap.String("key", "value")})
+
+		// The cloudlog client has not established a connection yet
+		require.NoError(t, core.Close())
+		assert.EqualValues(t, ErrCoreClosed, core.Write(entry, nil))
+		assert.EqualValues(t, ErrCoreClosed, child.Write(entry, nil))
+		assert.EqualValues(t, ErrCoreClosed, core.Close())
+		assert.NoError(t, core.Sync())
+	})
+
+	t.Run("Async", func(t *testing.T) {
+		client := &MockClosableCloudlogClient{}
+		core := newAsyncTestCore(t, client, AsyncOptionFlushInterval(time.Hour))
+		var closer io.Closer = core
+
+		for i := 0; i < 3; i++ {
+			require.NoError(t, core.Write(entry, nil))
+		}
+		require.NoError(t, closer.Close())
+		assert.EqualValues(t, 3, client.Count())
+		assert.True(t, client.closed)
+		assert.EqualValues(t, ErrCoreClosed, core.Write(entry, nil))
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+		require.NoError(t, err)
+		client := &MockClosableCloudlogClient{}
+		core.client = client
+		require.NoError(t, core.EnableRetry())
+
+		require.NoError(t, core.Close())
+		assert.True(t, client.closed)
+	})
+
+	t.Run("Spool", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		client := &MockFailingCloudlogClient{Failures: 1}
+		core := newSpoolTestCore(t, client, dir, SpoolOptionReplayInterval(time.Hour))
+		writeMessages(t, core, 1, 2)
+		require.NoError(t, core.Close())
+		assert.Len(t, segmentFiles(t, dir), 1)
+	})
+
+	t.Run("Reentrant", func(t *testing.T) {
+		closed := make(chan error, 1)
+		nested := make(chan error, 1)
+		var core *CloudLogCore
+		handler := ErrorHandlerFunc(func(error) {
+			// The handler writes to the core again while Close waits for the outer Write
+			go func() {
+				closed <- core.Close()
+			}()
+			waitFor(t, func() bool {
+				core.lifecycle.mutex.Lock()
+				defer core.lifecycle.mutex.Unlock()
+				return core.lifecycle.closed
+			})
+			nested <- core.Write(entry, nil)
+		})
+		var err error
+		core, err = NewCloudlogCoreWithClient(zapcore.NewNopCore(), &MockFailingCloudlogClient{Failures: 1},
+			CoreOptionErrorHandler(handler))
+		require.NoError(t, err)
+
+		assert.EqualValues(t, errMockPushFailed, core.Write(entry, nil))
+		assert.EqualValues(t, ErrCoreClosed, <-nested)
+		select {
+		case err = <-closed:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close did not return")
+		}
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		client := &MockClosableCloudlogClient{}
+		client.release = make(chan struct{})
+		core := newAsyncTestCore(t, client, AsyncOptionBatchSize(1))
+
+		// The first event blocks the worker, the second one waits in the queue
+		require.NoError(t, core.Write(entry, nil))
+		require.NoError(t, core.Write(entry, nil))
+		waitFor(t, func() bool {
+			return len(core.async.queue) == 1
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		assert.EqualValues(t, context.DeadlineExceeded, core.CloseContext(ctx).(*multierror.Error).Errors[0])
+		// The client is not closed while the worker is pushing
+		assert.False(t, client.Closed())
+
+		// The queued event is dropped instead of being pushed to the client closed meanwhile
+		close(client.release)
+		waitFor(t, client.Closed)
+		assert.EqualValues(t, 1, client.Count())
+		assert.EqualValues(t, 0, client.callsAfterClose)
+	})
+
+	t.Run("InFlightContext", func(t *testing.T) {
+		client := &MockClosableCloudlogClient{}
+		client.release = make(chan struct{})
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+		require.NoError(t, err)
+		core.client = client
+
+		written := make(chan error, 1)
+		go func() {
+			written <- core.Write(entry, nil)
+		}()
+		waitFor(t, func() bool {
+			core.lifecycle.mutex.Lock()
+			defer core.lifecycle.mutex.Unlock()
+			return core.lifecycle.inFlight == 1
+		})
+
+		// Close gives up waiting for the synchronous push, which keeps the client open
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		assert.EqualValues(t, context.DeadlineExceeded, core.CloseContext(ctx).(*multierror.Error).Errors[0])
+		assert.False(t, client.Closed())
+
+		close(client.release)
+		assert.NoError(t, <-written)
+		waitFor(t, client.Closed)
+		assert.EqualValues(t, 1, client.Count())
+		assert.EqualValues(t, 0, client.callsAfterClose)
+	})
+}
+
+func TestCloudLogCore_SyncContext(t *testing.T) {
+	client := &MockBatchCloudlogClient{release: make(chan struct{})}
+	core := newAsyncTestCore(t, client)
+	defer core.Close()
+	require.NoError(t, core.Write(zapcore.Entry{Level: zapcore.InfoLevel}, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.EqualValues(t, context.DeadlineExceeded, core.SyncContext(ctx))
+
+	close(client.release)
+	assert.NoError(t, core.SyncContext(context.Background()))
+	assert.EqualValues(t, 1, client.Count())
+}
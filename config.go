@@ -0,0 +1,529 @@
+package cloudlogzap
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Config offers a declarative way to construct a CloudLogCore, similar to zap.Config.
+// It can be loaded from JSON or YAML and overlaid with environment variables using ApplyEnv.
+type Config struct {
+	// Index is the CloudLog index events are sent to, which may be a template, see NewCloudlogCore
+	Index string `json:"index" yaml:"index"`
+	// IndexFallback is the index entries are sent to if a placeholder of the index template
+	// cannot be expanded
+	IndexFallback string `json:"indexFallback" yaml:"indexFallback"`
+	// MaxIndexClients limits the clients for routed or templated indices kept open,
+	// DefaultMaxIndexClients by default
+	MaxIndexClients int `json:"maxIndexClients" yaml:"maxIndexClients"`
+	// Brokers are the addresses of the CloudLog brokers, cloudlog.DefaultBrokerAddresses by default
+	Brokers []string `json:"brokers" yaml:"brokers"`
+	// CACertificateFile is the path of the PEM encoded CA certificate
+	CACertificateFile string `json:"caCertificateFile" yaml:"caCertificateFile"`
+	// CACertificate is the PEM encoded CA certificate
+	CACertificate string `json:"caCertificate" yaml:"caCertificate"`
+	// ClientCertificateFile and ClientKeyFile are the paths of the PEM encoded client certificate and key
+	ClientCertificateFile string `json:"clientCertificateFile" yaml:"clientCertificateFile"`
+	ClientKeyFile         string `json:"clientKeyFile" yaml:"clientKeyFile"`
+	// ClientCertificate and ClientKey are the PEM encoded client certificate and key
+	ClientCertificate string `json:"clientCertificate" yaml:"clientCertificate"`
+	ClientKey         string `json:"clientKey" yaml:"clientKey"`
+	// ReloadInterval enables watching the certificate files in the supplied interval,
+	// see CoreOptionCertificateReload
+	ReloadInterval Duration `json:"reloadInterval" yaml:"reloadInterval"`
+	// ExpiryWarning is the window before the expiry of the client or CA certificate in which a
+	// warning is logged through the wrapped core, DefaultCertificateExpiryWarning by default.
+	// The expiry is checked hourly, or within the window if shorter, and after reloading the certificates.
+	ExpiryWarning Duration `json:"expiryWarning" yaml:"expiryWarning"`
+	// AllowExpired allows building a core with an expired client or CA certificate
+	AllowExpired bool `json:"allowExpired" yaml:"allowExpired"`
+	// SourceHost overrides the host name sent with every event
+	SourceHost string `json:"sourceHost" yaml:"sourceHost"`
+	// Level is the minimum level sent to CloudLog. If unset, the wrapped core's level applies.
+	Level zap.AtomicLevel `json:"level" yaml:"level"`
+	// Async enables asynchronous delivery if set
+	Async *AsyncConfig `json:"async" yaml:"async"`
+	// Fields are added to the fields object (fields.*) of every event sent to CloudLog, see CoreOptionFields
+	Fields map[string]interface{} `json:"fields" yaml:"fields"`
+	// StaticFields are added to the top level of every document sent to CloudLog, see CoreOptionEnrichment
+	StaticFields map[string]interface{} `json:"staticFields" yaml:"staticFields"`
+	// Collectors lists the automatically collected static fields: build, process and platform,
+	// see CollectBuildInfo, CollectProcess and CollectPlatform
+	Collectors []string `json:"collectors" yaml:"collectors"`
+	// Routes lists the rules sending entries to other indices than Index, see NewRouter
+	Routes []Route `json:"routes" yaml:"routes"`
+	// Redact lists the rules applied to entries before they are sent to CloudLog
+	Redact []RedactionRule `json:"redact" yaml:"redact"`
+}
+
+// Duration is a time.Duration which is written as string like "1m30s" in JSON and YAML
+// configurations, like the environment variables read by ApplyEnv. Integers are read as nanoseconds.
+type Duration time.Duration
+
+// String returns the duration formatted like time.Duration
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+	return d.set(value)
+}
+
+// MarshalYAML implements the Marshaler interface of gopkg.in/yaml.v2
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// UnmarshalYAML implements the Unmarshaler interface of gopkg.in/yaml.v2
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value interface{}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return d.set(value)
+}
+
+// set sets the duration from a string parsed by time.ParseDuration or an integer of nanoseconds
+func (d *Duration) set(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	case json.Number:
+		ns, err := v.Int64()
+		if err != nil {
+			return fmt.Errorf("Invalid duration %v: %v", v, err)
+		}
+		*d = Duration(ns)
+	case int:
+		*d = Duration(v)
+	case int64:
+		*d = Duration(v)
+	default:
+		return fmt.Errorf("Invalid duration %v", value)
+	}
+	return nil
+}
+
+// AsyncConfig configures asynchronous delivery. Zero values select the defaults.
+type AsyncConfig struct {
+	QueueCapacity int      `json:"queueCapacity" yaml:"queueCapacity"`
+	BatchSize     int      `json:"batchSize" yaml:"batchSize"`
+	FlushInterval Duration `json:"flushInterval" yaml:"flushInterval"`
+	Workers       int      `json:"workers" yaml:"workers"`
+	// OverflowPolicy is one of block (default), drop_newest, drop_oldest and drop_below.
+	// drop_below drops events below OverflowKeepLevel and blocks for all others.
+	OverflowPolicy    string        `json:"overflowPolicy" yaml:"overflowPolicy"`
+	OverflowKeepLevel zapcore.Level `json:"overflowKeepLevel" yaml:"overflowKeepLevel"`
+}
+
+// options returns the AsyncOptions for the configured non-zero values
+func (ac *AsyncConfig) options() (options []AsyncOption, err error) {
+	if ac.QueueCapacity != 0 {
+		options = append(options, AsyncOptionQueueCapacity(ac.QueueCapacity))
+	}
+	if ac.BatchSize != 0 {
+		options = append(options, AsyncOptionBatchSize(ac.BatchSize))
+	}
+	if ac.FlushInterval != 0 {
+		options = append(options, AsyncOptionFlushInterval(time.Duration(ac.FlushInterval)))
+	}
+	if ac.Workers != 0 {
+		options = append(options, AsyncOptionWorkers(ac.Workers))
+	}
+
+	switch ac.OverflowPolicy {
+	case "", "block":
+	case "drop_newest":
+		options = append(options, AsyncOptionOverflowPolicy(OverflowPolicyDropNewest))
+	case "drop_oldest":
+		options = append(options, AsyncOptionOverflowPolicy(OverflowPolicyDropOldest))
+	case "drop_below":
+		options = append(options, AsyncOptionOverflowPolicy(NewOverflowPolicyDropBelowLevel(ac.OverflowKeepLevel)))
+	default:
+		err = ErrInvalidOverflowPolicy
+	}
+	return
+}
+
+// cloudLogOptions returns the options for creating the cloudlog.CloudLog client
+func (cfg Config) cloudLogOptions() (options []cloudlog.Option, err error) {
+	if len(cfg.Brokers) > 0 {
+		options = append(options, cloudlog.OptionBrokers(cfg.Brokers...))
+	}
+
+	if cfg.CACertificate != "" && cfg.CACertificateFile != "" {
+		err = multierror.Append(err, ErrCACertificateConflict)
+	} else if cfg.CACertificate != "" {
+		options = append(options, cloudlog.OptionCACertificate([]byte(cfg.CACertificate)))
+	} else if cfg.CACertificateFile != "" {
+		options = append(options, cloudlog.OptionCACertificateFile(cfg.CACertificateFile))
+	}
+
+	inline := cfg.ClientCertificate != "" || cfg.ClientKey != ""
+	file := cfg.ClientCertificateFile != "" || cfg.ClientKeyFile != ""
+	switch {
+	case inline && file:
+		err = multierror.Append(err, ErrClientCertificateConflict)
+	case (cfg.ClientCertificate == "") != (cfg.ClientKey == ""),
+		(cfg.ClientCertificateFile == "") != (cfg.ClientKeyFile == ""):
+		err = multierror.Append(err, ErrClientCertificateIncomplete)
+	case inline:
+		cert, certErr := tls.X509KeyPair([]byte(cfg.ClientCertificate), []byte(cfg.ClientKey))
+		if certErr != nil {
+			err = multierror.Append(err, certErr)
+			break
+		}
+		options = append(options, cloudlog.OptionClientCertificates([]tls.Certificate{cert}))
+	case file:
+		options = append(options, cloudlog.OptionClientCertificateFile(cfg.ClientCertificateFile, cfg.ClientKeyFile))
+	}
+
+	if cfg.SourceHost != "" {
+		options = append(options, cloudlog.OptionSourceHost(cfg.SourceHost))
+	}
+	return
+}
+
+// certificateFiles returns the paths of the configured certificate files
+func (cfg Config) certificateFiles() (paths []string) {
+	for _, path := range []string{cfg.CACertificateFile, cfg.ClientCertificateFile, cfg.ClientKeyFile} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return
+}
+
+// fields returns the static fields sorted by key
+func (cfg Config) fields() []zapcore.Field {
+	keys := make([]string, 0, len(cfg.Fields))
+	for key := range cfg.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make([]zapcore.Field, 0, len(keys))
+	for _, key := range keys {
+		fields = append(fields, zap.Any(key, cfg.Fields[key]))
+	}
+	return fields
+}
+
+// collectors returns the configured Collectors, static fields taking precedence
+func (cfg Config) collectors() (collectors []Collector, err error) {
+	for _, name := range cfg.Collectors {
+		switch name {
+		case "build":
+			collectors = append(collectors, CollectBuildInfo)
+		case "process":
+			collectors = append(collectors, CollectProcess)
+		case "platform":
+			collectors = append(collectors, CollectPlatform)
+		default:
+			err = multierror.Append(err, fmt.Errorf("Unknown collector %q", name))
+		}
+	}
+	if len(cfg.StaticFields) > 0 {
+		collectors = append(collectors, CollectStatic(cfg.StaticFields))
+	}
+	return
+}
+
+// Build returns a new CloudLogCore wrapping the supplied core as configured. The supplied
+// options are applied after the configuration. All misconfigurations are reported at once.
+func (cfg Config) Build(c zapcore.Core, options ...CoreOption) (*CloudLogCore, error) {
+	var err error
+	var coreOptions []CoreOption
+
+	cloudLogOptions, optionsErr := cfg.cloudLogOptions()
+	if optionsErr != nil {
+		err = multierror.Append(err, optionsErr)
+	}
+	if len(cloudLogOptions) > 0 {
+		coreOptions = append(coreOptions, CoreOptionCloudLogOptions(cloudLogOptions...))
+	}
+	// Certificates are only parsed if they have been configured consistently
+	var monitor *certificateMonitor
+	if optionsErr == nil {
+		var monitorErr error
+		if monitor, monitorErr = cfg.certificateMonitor(); monitorErr != nil {
+			err = multierror.Append(err, monitorErr)
+		}
+	}
+	if monitor != nil {
+		coreOptions = append(coreOptions, coreOptionCertificateMonitor(monitor))
+	}
+	if cfg.ReloadInterval != 0 {
+		coreOptions = append(coreOptions, CoreOptionCertificateReload(time.Duration(cfg.ReloadInterval), cfg.certificateFiles()...))
+	}
+	if cfg.Level != (zap.AtomicLevel{}) {
+		coreOptions = append(coreOptions, CoreOptionLevelEnabler(cfg.Level))
+	}
+	if len(cfg.Fields) > 0 {
+		coreOptions = append(coreOptions, CoreOptionFields(cfg.fields()...))
+	}
+	collectors, collectorsErr := cfg.collectors()
+	if collectorsErr != nil {
+		err = multierror.Append(err, collectorsErr)
+	}
+	if len(collectors) > 0 {
+		coreOptions = append(coreOptions, CoreOptionEnrichment(collectors...))
+	}
+	if cfg.Async != nil {
+		asyncOptions, asyncErr := cfg.Async.options()
+		if asyncErr != nil {
+			err = multierror.Append(err, asyncErr)
+		}
+		coreOptions = append(coreOptions, CoreOptionAsync(asyncOptions...))
+	}
+	if cfg.IndexFallback != "" {
+		coreOptions = append(coreOptions, CoreOptionIndexFallback(cfg.IndexFallback))
+	}
+	if cfg.MaxIndexClients != 0 {
+		coreOptions = append(coreOptions, CoreOptionMaxIndexClients(cfg.MaxIndexClients))
+	}
+	if len(cfg.Routes) > 0 {
+		coreOptions = append(coreOptions, CoreOptionRoutes(cfg.Routes...))
+	}
+	coreOptions = append(coreOptions, options...)
+	// Redaction wraps the Converter possibly supplied by the options
+	if len(cfg.Redact) > 0 {
+		coreOptions = append(coreOptions, CoreOptionRedaction(cfg.Redact...))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	core, err := NewCloudlogCore(c, cfg.Index, coreOptions...)
+	if err == nil && monitor != nil {
+		monitor.warn()
+		monitor.start()
+	}
+	return core, err
+}
+
+// certificateMonitor returns the monitor of the configured certificates, failing if they
+// cannot be parsed or have expired unless allowed
+func (cfg Config) certificateMonitor() (*certificateMonitor, error) {
+	client := certificateSource{inline: cfg.ClientCertificate, file: cfg.ClientCertificateFile}
+	ca := certificateSource{inline: cfg.CACertificate, file: cfg.CACertificateFile}
+	if client == (certificateSource{}) && ca == (certificateSource{}) {
+		return nil, nil
+	}
+
+	window := time.Duration(cfg.ExpiryWarning)
+	if window == 0 {
+		window = DefaultCertificateExpiryWarning
+	}
+	monitor := newCertificateMonitor(client, ca, window)
+	expired, err := monitor.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(expired) > 0 && !cfg.AllowExpired {
+		return nil, multierror.Append(nil, expired...)
+	}
+	return monitor, nil
+}
+
+// ApplyEnv overlays the configuration with the values of the following environment variables:
+//
+//	CLOUDLOG_INDEX                     Index
+//	CLOUDLOG_INDEX_FALLBACK            IndexFallback
+//	CLOUDLOG_MAX_INDEX_CLIENTS         MaxIndexClients
+//	CLOUDLOG_BROKERS                   Brokers, comma separated
+//	CLOUDLOG_CA_FILE, CLOUDLOG_CA      CACertificateFile, CACertificate
+//	CLOUDLOG_CERT_FILE, CLOUDLOG_CERT  ClientCertificateFile, ClientCertificate
+//	CLOUDLOG_KEY_FILE, CLOUDLOG_KEY    ClientKeyFile, ClientKey
+//	CLOUDLOG_RELOAD_INTERVAL           ReloadInterval, e.g. 1m
+//	CLOUDLOG_EXPIRY_WARNING            ExpiryWarning, e.g. 168h
+//	CLOUDLOG_ALLOW_EXPIRED             AllowExpired
+//	CLOUDLOG_SOURCE_HOST               SourceHost
+//	CLOUDLOG_LEVEL                     Level
+//	CLOUDLOG_ASYNC                     true enables, false disables asynchronous delivery
+//	CLOUDLOG_ASYNC_QUEUE_CAPACITY      Async.QueueCapacity
+//	CLOUDLOG_ASYNC_BATCH_SIZE          Async.BatchSize
+//	CLOUDLOG_ASYNC_FLUSH_INTERVAL      Async.FlushInterval, e.g. 500ms
+//	CLOUDLOG_ASYNC_WORKERS             Async.Workers
+//	CLOUDLOG_ASYNC_OVERFLOW_POLICY     Async.OverflowPolicy
+//	CLOUDLOG_ASYNC_OVERFLOW_KEEP_LEVEL Async.OverflowKeepLevel
+//	CLOUDLOG_FIELDS                    Fields (fields.*) as comma separated key=value pairs, added to existing fields
+//	CLOUDLOG_STATIC_FIELDS             StaticFields (top level) as comma separated key=value pairs, added to existing fields
+//	CLOUDLOG_COLLECTORS                Collectors, comma separated
+//	CLOUDLOG_REDACT_FIELDS             Keys of fields to redact, comma separated
+//
+// Setting any CLOUDLOG_ASYNC_ variable enables asynchronous delivery unless CLOUDLOG_ASYNC is false.
+func (cfg *Config) ApplyEnv() error {
+	return cfg.applyEnv(os.LookupEnv)
+}
+
+func (cfg *Config) applyEnv(lookup func(string) (string, bool)) (err error) {
+	invalid := func(name string, cause error) {
+		err = multierror.Append(err, fmt.Errorf("Invalid %s: %v", name, cause))
+	}
+	asyncConfig := func() *AsyncConfig {
+		if cfg.Async == nil {
+			cfg.Async = &AsyncConfig{}
+		}
+		return cfg.Async
+	}
+	parseInt := func(name string, target func() *int) {
+		if value, ok := lookup(name); ok {
+			i, parseErr := strconv.Atoi(value)
+			if parseErr != nil {
+				invalid(name, parseErr)
+				return
+			}
+			*target() = i
+		}
+	}
+
+	for name, target := range map[string]*string{
+		"CLOUDLOG_INDEX":          &cfg.Index,
+		"CLOUDLOG_INDEX_FALLBACK": &cfg.IndexFallback,
+		"CLOUDLOG_CA_FILE":        &cfg.CACertificateFile,
+		"CLOUDLOG_CA":             &cfg.CACertificate,
+		"CLOUDLOG_CERT_FILE":      &cfg.ClientCertificateFile,
+		"CLOUDLOG_CERT":           &cfg.ClientCertificate,
+		"CLOUDLOG_KEY_FILE":       &cfg.ClientKeyFile,
+		"CLOUDLOG_KEY":            &cfg.ClientKey,
+		"CLOUDLOG_SOURCE_HOST":    &cfg.SourceHost,
+	} {
+		if value, ok := lookup(name); ok {
+			*target = value
+		}
+	}
+
+	if value, ok := lookup("CLOUDLOG_BROKERS"); ok {
+		cfg.Brokers = splitEnvList(value)
+	}
+
+	if value, ok := lookup("CLOUDLOG_LEVEL"); ok {
+		var level zapcore.Level
+		if levelErr := level.UnmarshalText([]byte(value)); levelErr != nil {
+			invalid("CLOUDLOG_LEVEL", levelErr)
+		} else if cfg.Level == (zap.AtomicLevel{}) {
+			cfg.Level = zap.NewAtomicLevelAt(level)
+		} else {
+			cfg.Level.SetLevel(level)
+		}
+	}
+
+	for name, target := range map[string]*Duration{
+		"CLOUDLOG_RELOAD_INTERVAL": &cfg.ReloadInterval,
+		"CLOUDLOG_EXPIRY_WARNING":  &cfg.ExpiryWarning,
+	} {
+		if value, ok := lookup(name); ok {
+			if d, parseErr := time.ParseDuration(value); parseErr != nil {
+				invalid(name, parseErr)
+			} else {
+				*target = Duration(d)
+			}
+		}
+	}
+	if value, ok := lookup("CLOUDLOG_ALLOW_EXPIRED"); ok {
+		if allow, parseErr := strconv.ParseBool(value); parseErr != nil {
+			invalid("CLOUDLOG_ALLOW_EXPIRED", parseErr)
+		} else {
+			cfg.AllowExpired = allow
+		}
+	}
+
+	parseInt("CLOUDLOG_MAX_INDEX_CLIENTS", func() *int { return &cfg.MaxIndexClients })
+	parseInt("CLOUDLOG_ASYNC_QUEUE_CAPACITY", func() *int { return &asyncConfig().QueueCapacity })
+	parseInt("CLOUDLOG_ASYNC_BATCH_SIZE", func() *int { return &asyncConfig().BatchSize })
+	parseInt("CLOUDLOG_ASYNC_WORKERS", func() *int { return &asyncConfig().Workers })
+	if value, ok := lookup("CLOUDLOG_ASYNC_FLUSH_INTERVAL"); ok {
+		if interval, parseErr := time.ParseDuration(value); parseErr != nil {
+			invalid("CLOUDLOG_ASYNC_FLUSH_INTERVAL", parseErr)
+		} else {
+			asyncConfig().FlushInterval = Duration(interval)
+		}
+	}
+	if value, ok := lookup("CLOUDLOG_ASYNC_OVERFLOW_POLICY"); ok {
+		asyncConfig().OverflowPolicy = value
+	}
+	if value, ok := lookup("CLOUDLOG_ASYNC_OVERFLOW_KEEP_LEVEL"); ok {
+		var level zapcore.Level
+		if levelErr := level.UnmarshalText([]byte(value)); levelErr != nil {
+			invalid("CLOUDLOG_ASYNC_OVERFLOW_KEEP_LEVEL", levelErr)
+		} else {
+			asyncConfig().OverflowKeepLevel = level
+		}
+	}
+	if value, ok := lookup("CLOUDLOG_ASYNC"); ok {
+		if enabled, parseErr := strconv.ParseBool(value); parseErr != nil {
+			invalid("CLOUDLOG_ASYNC", parseErr)
+		} else if enabled {
+			asyncConfig()
+		} else {
+			cfg.Async = nil
+		}
+	}
+
+	parseFields := func(name string, target *map[string]interface{}) {
+		if value, ok := lookup(name); ok {
+			for _, pair := range splitEnvList(value) {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					invalid(name, fmt.Errorf("%q is not a key=value pair", pair))
+					continue
+				}
+				if *target == nil {
+					*target = make(map[string]interface{})
+				}
+				(*target)[kv[0]] = kv[1]
+			}
+		}
+	}
+	parseFields("CLOUDLOG_FIELDS", &cfg.Fields)
+	parseFields("CLOUDLOG_STATIC_FIELDS", &cfg.StaticFields)
+	if value, ok := lookup("CLOUDLOG_COLLECTORS"); ok {
+		cfg.Collectors = splitEnvList(value)
+	}
+
+	if value, ok := lookup("CLOUDLOG_REDACT_FIELDS"); ok {
+		if keys := splitEnvList(value); len(keys) > 0 {
+			cfg.Redact = append(cfg.Redact, RedactionRule{Fields: keys})
+		}
+	}
+	return
+}
+
+// splitEnvList splits a comma separated list, omitting empty elements
+func splitEnvList(value string) (list []string) {
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+	return
+}
@@ -0,0 +1,353 @@
+package cloudlogzap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// newTestCertificate returns a PEM encoded self-signed certificate and its key
+func newTestCertificate(t *testing.T, notAfter time.Time) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cloudlogzap test"},
+		NotBefore:             notAfter.Add(-24 * time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestConfig_JSON(t *testing.T) {
+	var cfg Config
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"index": "my-index",
+		"brokers": ["broker1:443", "broker2:443"],
+		"caCertificateFile": "/etc/ca.pem",
+		"sourceHost": "web1",
+		"level": "warn",
+		"reloadInterval": "1m30s",
+		"expiryWarning": 3600000000000,
+		"async": {"batchSize": 50, "flushInterval": "500ms", "overflowPolicy": "drop_below", "overflowKeepLevel": "error"},
+		"fields": {"service": "api"},
+		"routes": [{"index": "my-index-errors", "level": "error"}],
+		"redact": [{"fields": ["password"]}]
+	}`), &cfg))
+
+	assert.EqualValues(t, "my-index", cfg.Index)
+	assert.EqualValues(t, []string{"broker1:443", "broker2:443"}, cfg.Brokers)
+	assert.EqualValues(t, "/etc/ca.pem", cfg.CACertificateFile)
+	assert.EqualValues(t, "web1", cfg.SourceHost)
+	assert.EqualValues(t, 90*time.Second, cfg.ReloadInterval)
+	assert.EqualValues(t, time.Hour, cfg.ExpiryWarning)
+	assert.EqualValues(t, zapcore.WarnLevel, cfg.Level.Level())
+	assert.EqualValues(t, &AsyncConfig{
+		BatchSize:         50,
+		FlushInterval:     Duration(500 * time.Millisecond),
+		OverflowPolicy:    "drop_below",
+		OverflowKeepLevel: zapcore.ErrorLevel,
+	}, cfg.Async)
+	assert.EqualValues(t, map[string]interface{}{"service": "api"}, cfg.Fields)
+	errorLevel := zapcore.ErrorLevel
+	assert.EqualValues(t, []Route{{Index: "my-index-errors", Level: &errorLevel}}, cfg.Routes)
+	assert.EqualValues(t, []RedactionRule{{Fields: []string{"password"}}}, cfg.Redact)
+}
+
+func TestConfig_YAML(t *testing.T) {
+	var cfg Config
+	require.NoError(t, yaml.Unmarshal([]byte(`
+index: my-index
+brokers: [broker1:443, broker2:443]
+caCertificateFile: /etc/ca.pem
+sourceHost: web1
+level: warn
+async:
+  batchSize: 50
+  flushInterval: 500ms
+  overflowPolicy: drop_below
+  overflowKeepLevel: error
+fields:
+  service: api
+redact:
+  - fields: [password]
+`), &cfg))
+
+	assert.EqualValues(t, "my-index", cfg.Index)
+	assert.EqualValues(t, []string{"broker1:443", "broker2:443"}, cfg.Brokers)
+	assert.EqualValues(t, "/etc/ca.pem", cfg.CACertificateFile)
+	assert.EqualValues(t, "web1", cfg.SourceHost)
+	assert.EqualValues(t, zapcore.WarnLevel, cfg.Level.Level())
+	assert.EqualValues(t, &AsyncConfig{
+		BatchSize:         50,
+		FlushInterval:     Duration(500 * time.Millisecond),
+		OverflowPolicy:    "drop_below",
+		OverflowKeepLevel: zapcore.ErrorLevel,
+	}, cfg.Async)
+	assert.EqualValues(t, map[string]interface{}{"service": "api"}, cfg.Fields)
+	assert.EqualValues(t, []RedactionRule{{Fields: []string{"password"}}}, cfg.Redact)
+
+	// Durations and levels are written as strings, which are read back to the same Config
+	data, err := yaml.Marshal(cfg)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "level: warn\n")
+	assert.Contains(t, string(data), "  flushInterval: 500ms\n")
+	assert.Contains(t, string(data), "  overflowKeepLevel: error\n")
+
+	var decoded Config
+	require.NoError(t, yaml.Unmarshal(data, &decoded))
+	assert.EqualValues(t, cfg.Async, decoded.Async)
+	assert.EqualValues(t, cfg.Level.Level(), decoded.Level.Level())
+	roundTripped, err := yaml.Marshal(decoded)
+	require.NoError(t, err)
+	assert.EqualValues(t, string(data), string(roundTripped))
+}
+
+func TestDuration(t *testing.T) {
+	t.Run("JSON", func(t *testing.T) {
+		var d Duration
+		require.NoError(t, json.Unmarshal([]byte(`"1m30s"`), &d))
+		assert.EqualValues(t, 90*time.Second, d)
+		require.NoError(t, json.Unmarshal([]byte(`500000000`), &d))
+		assert.EqualValues(t, 500*time.Millisecond, d)
+
+		data, err := json.Marshal(Duration(90 * time.Second))
+		require.NoError(t, err)
+		assert.EqualValues(t, `"1m30s"`, string(data))
+
+		assert.Error(t, json.Unmarshal([]byte(`"soon"`), &d))
+		assert.Error(t, json.Unmarshal([]byte(`1.5`), &d))
+		assert.Error(t, json.Unmarshal([]byte(`true`), &d))
+	})
+
+	t.Run("YAML", func(t *testing.T) {
+		decode := func(value interface{}) func(interface{}) error {
+			return func(target interface{}) error {
+				*(target.(*interface{})) = value
+				return nil
+			}
+		}
+
+		var d Duration
+		require.NoError(t, d.UnmarshalYAML(decode("250ms")))
+		assert.EqualValues(t, 250*time.Millisecond, d)
+		require.NoError(t, d.UnmarshalYAML(decode(1000)))
+		assert.EqualValues(t, time.Microsecond, d)
+		assert.Error(t, d.UnmarshalYAML(decode(1.5)))
+
+		value, err := Duration(time.Minute).MarshalYAML()
+		require.NoError(t, err)
+		assert.EqualValues(t, "1m0s", value)
+	})
+}
+
+func TestConfig_Build(t *testing.T) {
+	entry := zapcore.Entry{Level: zapcore.WarnLevel, Message: "test message"}
+
+	t.Run("OK", func(t *testing.T) {
+		certPEM, keyPEM := newTestCertificate(t, time.Now().Add(time.Hour))
+		cfg := Config{
+			Index:             "my-index",
+			Brokers:           []string{"broker1:443"},
+			CACertificate:     string(certPEM),
+			ClientCertificate: string(certPEM),
+			ClientKey:         string(keyPEM),
+			SourceHost:        "web1",
+			Level:             zap.NewAtomicLevelAt(zapcore.WarnLevel),
+			Async:             &AsyncConfig{FlushInterval: Duration(time.Millisecond)},
+			Fields:            map[string]interface{}{"service": "api", "region": "eu"},
+			Redact:            []RedactionRule{{Fields: []string{"password"}}},
+		}
+
+		core, err := cfg.Build(zapcore.NewNopCore())
+		require.NoError(t, err)
+		assert.Len(t, core.cloudLogClientOptions, 4)
+		assert.IsType(t, &cloudlog.CloudLog{}, core.client)
+		assert.NotNil(t, core.async)
+		assert.False(t, core.Enabled(zapcore.InfoLevel))
+
+		client := &MockBatchCloudlogClient{}
+		core.client = client
+		require.NoError(t, core.Write(entry, []zapcore.Field{zap.String("password", "secret")}))
+		require.NoError(t, core.Sync())
+		require.EqualValues(t, 1, client.Count())
+		assert.EqualValues(t, map[string]interface{}{
+			"region":   "eu",
+			"service":  "api",
+			"password": DefaultRedactionReplacement,
+		}, client.Batches()[0][0].(document).Fields)
+		require.NoError(t, core.Close())
+	})
+
+	t.Run("Options", func(t *testing.T) {
+		client := &MockCloudlogClient{}
+		core, err := Config{Redact: []RedactionRule{{Pattern: "secret"}}}.Build(zapcore.NewNopCore(),
+			CoreOptionClient(client),
+			CoreOptionConverter(ConverterFunc(func(entry zapcore.Entry, ff []zapcore.Field) interface{} {
+				return entry.Message
+			})),
+		)
+		require.NoError(t, err)
+		assert.Nil(t, core.levelEnabler)
+
+		// Redaction wraps the supplied Converter
+		require.NoError(t, core.Write(zapcore.Entry{Message: "a secret"}, nil))
+		assert.EqualValues(t, []interface{}{"a [REDACTED]"}, client.events)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		core, err := Config{
+			CACertificate:         "inline",
+			CACertificateFile:     "/etc/ca.pem",
+			ClientCertificateFile: "/etc/cert.pem",
+			Async:                 &AsyncConfig{OverflowPolicy: "drop_all"},
+		}.Build(zapcore.NewNopCore())
+		assert.Nil(t, core)
+		assert.EqualValues(t, []error{
+			ErrCACertificateConflict,
+			ErrClientCertificateIncomplete,
+			ErrInvalidOverflowPolicy,
+		}, flattenErrors(err))
+
+		core, err = Config{
+			ClientCertificate:     "inline",
+			ClientCertificateFile: "/etc/cert.pem",
+			ClientKeyFile:         "/etc/key.pem",
+		}.Build(zapcore.NewNopCore())
+		assert.Nil(t, core)
+		assert.EqualValues(t, []error{ErrClientCertificateConflict}, flattenErrors(err))
+
+		core, err = Config{Index: "my-index", ClientCertificate: "inline", ClientKey: "inline"}.Build(zapcore.NewNopCore())
+		assert.Nil(t, core)
+		require.Len(t, flattenErrors(err), 1)
+		assert.Contains(t, err.Error(), "failed to find any PEM data")
+
+		core, err = Config{Index: "my-index", ReloadInterval: Duration(time.Minute)}.Build(zapcore.NewNopCore())
+		assert.Nil(t, core)
+		assert.EqualValues(t, []error{ErrCertificateReloadPathsMissing}, flattenErrors(err))
+
+		core, err = Config{Redact: []RedactionRule{{}}}.Build(zapcore.NewNopCore())
+		assert.Nil(t, core)
+		assert.EqualValues(t, []error{ErrInvalidRedactionRule, cloudlog.ErrIndexNotDefined}, flattenErrors(err))
+
+		core, err = Config{Index: "my-index", Collectors: []string{"build", "host"}}.Build(zapcore.NewNopCore())
+		assert.Nil(t, core)
+		require.Len(t, flattenErrors(err), 1)
+		assert.Contains(t, err.Error(), `Unknown collector "host"`)
+	})
+}
+
+func TestConfig_ApplyEnv(t *testing.T) {
+	lookup := func(env map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			value, ok := env[name]
+			return value, ok
+		}
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		cfg := Config{
+			Index:  "file-index",
+			Fields: map[string]interface{}{"service": "api"},
+			Level:  zap.NewAtomicLevelAt(zapcore.InfoLevel),
+		}
+		require.NoError(t, cfg.applyEnv(lookup(map[string]string{
+			"CLOUDLOG_INDEX_FALLBACK":            "env-fallback",
+			"CLOUDLOG_MAX_INDEX_CLIENTS":         "8",
+			"CLOUDLOG_INDEX":                     "env-index",
+			"CLOUDLOG_BROKERS":                   "broker1:443, broker2:443,",
+			"CLOUDLOG_CA_FILE":                   "/etc/ca.pem",
+			"CLOUDLOG_CERT_FILE":                 "/etc/cert.pem",
+			"CLOUDLOG_KEY_FILE":                  "/etc/key.pem",
+			"CLOUDLOG_SOURCE_HOST":               "web1",
+			"CLOUDLOG_RELOAD_INTERVAL":           "5m",
+			"CLOUDLOG_LEVEL":                     "error",
+			"CLOUDLOG_ASYNC_QUEUE_CAPACITY":      "1000",
+			"CLOUDLOG_ASYNC_BATCH_SIZE":          "10",
+			"CLOUDLOG_ASYNC_FLUSH_INTERVAL":      "250ms",
+			"CLOUDLOG_ASYNC_WORKERS":             "2",
+			"CLOUDLOG_ASYNC_OVERFLOW_POLICY":     "drop_below",
+			"CLOUDLOG_ASYNC_OVERFLOW_KEEP_LEVEL": "warn",
+			"CLOUDLOG_FIELDS":                    "region=eu,stage=prod=1",
+			"CLOUDLOG_STATIC_FIELDS":             "version=1.2.0",
+			"CLOUDLOG_COLLECTORS":                "process, platform",
+			"CLOUDLOG_REDACT_FIELDS":             "password,token",
+		})))
+
+		assert.EqualValues(t, "env-index", cfg.Index)
+		assert.EqualValues(t, "env-fallback", cfg.IndexFallback)
+		assert.EqualValues(t, 8, cfg.MaxIndexClients)
+		assert.EqualValues(t, []string{"broker1:443", "broker2:443"}, cfg.Brokers)
+		assert.EqualValues(t, "/etc/ca.pem", cfg.CACertificateFile)
+		assert.EqualValues(t, "/etc/cert.pem", cfg.ClientCertificateFile)
+		assert.EqualValues(t, "/etc/key.pem", cfg.ClientKeyFile)
+		assert.EqualValues(t, "web1", cfg.SourceHost)
+		assert.EqualValues(t, 5*time.Minute, cfg.ReloadInterval)
+		assert.EqualValues(t, zapcore.ErrorLevel, cfg.Level.Level())
+		assert.EqualValues(t, &AsyncConfig{
+			QueueCapacity:     1000,
+			BatchSize:         10,
+			FlushInterval:     Duration(250 * time.Millisecond),
+			Workers:           2,
+			OverflowPolicy:    "drop_below",
+			OverflowKeepLevel: zapcore.WarnLevel,
+		}, cfg.Async)
+		assert.EqualValues(t, map[string]interface{}{"service": "api", "region": "eu", "stage": "prod=1"}, cfg.Fields)
+		assert.EqualValues(t, map[string]interface{}{"version": "1.2.0"}, cfg.StaticFields)
+		assert.EqualValues(t, []string{"process", "platform"}, cfg.Collectors)
+		assert.EqualValues(t, []RedactionRule{{Fields: []string{"password", "token"}}}, cfg.Redact)
+	})
+
+	t.Run("Async", func(t *testing.T) {
+		var cfg Config
+		require.NoError(t, cfg.applyEnv(lookup(map[string]string{"CLOUDLOG_ASYNC": "true", "CLOUDLOG_LEVEL": "debug"})))
+		assert.EqualValues(t, &AsyncConfig{}, cfg.Async)
+		assert.EqualValues(t, zapcore.DebugLevel, cfg.Level.Level())
+
+		require.NoError(t, cfg.applyEnv(lookup(map[string]string{"CLOUDLOG_ASYNC": "false", "CLOUDLOG_ASYNC_WORKERS": "2"})))
+		assert.Nil(t, cfg.Async)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		var cfg Config
+		err := cfg.applyEnv(lookup(map[string]string{
+			"CLOUDLOG_LEVEL":                "loud",
+			"CLOUDLOG_ASYNC_BATCH_SIZE":     "many",
+			"CLOUDLOG_ASYNC_FLUSH_INTERVAL": "soon",
+			"CLOUDLOG_ASYNC":                "maybe",
+			"CLOUDLOG_FIELDS":               "region",
+		}))
+		errs := flattenErrors(err)
+		require.Len(t, errs, 5)
+		for i, name := range []string{
+			"CLOUDLOG_LEVEL",
+			"CLOUDLOG_ASYNC_BATCH_SIZE",
+			"CLOUDLOG_ASYNC_FLUSH_INTERVAL",
+			"CLOUDLOG_ASYNC",
+			"CLOUDLOG_FIELDS",
+		} {
+			assert.Contains(t, errs[i].Error(), "Invalid "+name+":")
+		}
+	})
+}
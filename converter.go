@@ -0,0 +1,71 @@
+package cloudlogzap
+
+import (
+	"go.uber.org/zap/zapcore"
+)
+
+// Converter converts a zap entry and its fields to the event sent to CloudLog.
+// Events may be structs using `cloudlog` tags, map[string]interface{} values or
+// implementations of cloudlog.Event.
+type Converter interface {
+	Convert(entry zapcore.Entry, fields []zapcore.Field) interface{}
+}
+
+// ConverterFunc is an adapter allowing the use of ordinary functions as Converter
+type ConverterFunc func(entry zapcore.Entry, fields []zapcore.Field) interface{}
+
+// Convert calls f(entry, fields)
+func (f ConverterFunc) Convert(entry zapcore.Entry, fields []zapcore.Field) interface{} {
+	return f(entry, fields)
+}
+
+// DefaultConverter converts entries to documents consisting of the entry's millisecond
+// timestamp, message, level and fields as encoded by EncodeFields
+var DefaultConverter Converter = NewDocumentConverter(TimestampMillisecond)
+
+// NewDocumentConverter returns a Converter using the layout of DefaultConverter and the supplied
+// timestamp precision
+func NewDocumentConverter(precision TimestampPrecision) Converter {
+	return documentConverter{precision: precision}
+}
+
+type document struct {
+	Timestamp      int64                  `cloudlog:"timestamp,omitempty"`
+	TimestampNanos int64                  `cloudlog:"timestamp_nanos,omitempty"`
+	Message        string                 `cloudlog:"message"`
+	Level          string                 `cloudlog:"level"`
+	Fields         map[string]interface{} `cloudlog:"fields"`
+}
+
+type documentConverter struct {
+	precision TimestampPrecision
+}
+
+// Convert implements Converter
+func (c documentConverter) Convert(entry zapcore.Entry, ff []zapcore.Field) interface{} {
+	d := document{
+		Message: entry.Message,
+		Level:   entry.Level.String(),
+		Fields:  EncodeFields(entry, ff),
+	}
+	d.Timestamp, d.TimestampNanos = splitTimestamp(entry.Time, c.precision)
+	return d
+}
+
+// SetConverter replaces the default document layout by the supplied Converter.
+// A nil Converter restores the default.
+// SetConverter has to be called before the core is used or cloned using With.
+func (cc *CloudLogCore) SetConverter(converter Converter) {
+	cc.converter = converter
+}
+
+// convert converts the entry and its fields to the event sent to CloudLog
+func (cc *CloudLogCore) convert(e zapcore.Entry, ff []zapcore.Field) interface{} {
+	var event interface{}
+	if cc.converter != nil {
+		event = cc.converter.Convert(e, ff)
+	} else {
+		event = documentConverter{precision: cc.timestampPrecision}.Convert(e, ff)
+	}
+	return cc.route(cc.enrich(event), e, ff)
+}
@@ -0,0 +1,81 @@
+package cloudlogzap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type testEvent struct {
+	message string
+}
+
+func (e testEvent) Encode() map[string]interface{} {
+	return map[string]interface{}{"msg": e.message}
+}
+
+type testStructEvent struct {
+	Msg     string `cloudlog:"msg"`
+	Service string `cloudlog:"service"`
+}
+
+func TestCloudLogCore_SetConverter(t *testing.T) {
+	core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+	require.NoError(t, err)
+	client := &MockCloudlogClient{}
+	core.client = client
+	encoder := cloudlog.NewAutomaticEventEncoder()
+	entry := zapcore.Entry{Level: zapcore.InfoLevel, Message: "test message"}
+
+	for name, converter := range map[string]Converter{
+		"Map": ConverterFunc(func(entry zapcore.Entry, ff []zapcore.Field) interface{} {
+			return map[string]interface{}{"msg": entry.Message}
+		}),
+		"Event": ConverterFunc(func(entry zapcore.Entry, ff []zapcore.Field) interface{} {
+			return testEvent{message: entry.Message}
+		}),
+		"Struct": ConverterFunc(func(entry zapcore.Entry, ff []zapcore.Field) interface{} {
+			return testStructEvent{Msg: entry.Message, Service: EncodeFields(entry, ff)["service"].(string)}
+		}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			client.events = nil
+			core.SetConverter(converter)
+			child := core.With([]zapcore.Field{zap.String("service", "api")})
+
+			require.NoError(t, child.Write(entry, nil))
+			require.Len(t, client.events, 1)
+			eventMap, err := encoder.EncodeEvent(client.events[0])
+			require.NoError(t, err)
+			assert.EqualValues(t, "test message", eventMap["msg"])
+			if name == "Struct" {
+				assert.EqualValues(t, "api", eventMap["service"])
+			}
+		})
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		client.events = nil
+		core.SetConverter(nil)
+		require.NoError(t, core.Write(entry, nil))
+		require.Len(t, client.events, 1)
+		assert.IsType(t, document{}, client.events[0])
+	})
+}
+
+func TestNewDocumentConverter(t *testing.T) {
+	entry := zapcore.Entry{Message: "test message", Time: time.Unix(0, 1500000)}
+
+	d := NewDocumentConverter(TimestampNanosecond).Convert(entry, nil).(document)
+	assert.EqualValues(t, 1, d.Timestamp)
+	assert.EqualValues(t, 500000, d.TimestampNanos)
+
+	d = DefaultConverter.Convert(entry, nil).(document)
+	assert.EqualValues(t, 1, d.Timestamp)
+	assert.EqualValues(t, 0, d.TimestampNanos)
+}
@@ -0,0 +1,262 @@
+package cloudlogzap
+
+import (
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// CoreOption defines the type used for configuring a CloudLogCore
+type CoreOption func(*CloudLogCore) error
+
+// CoreOptionCloudLogOptions defines the options used for creating the cloudlog.CloudLog client
+func CoreOptionCloudLogOptions(options ...cloudlog.Option) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if cc.cloudLogClientOptions == nil {
+			cc.cloudLogClientOptions = options
+		} else {
+			cc.cloudLogClientOptions = append(cc.cloudLogClientOptions[:len(cc.cloudLogClientOptions):len(cc.cloudLogClientOptions)], options...)
+		}
+		return nil
+	}
+}
+
+// CoreOptionClient defines an existing client events are pushed to instead of creating a
+// cloudlog.CloudLog client. The client may be shared by several cores and is not closed
+// when the core is closed.
+func CoreOptionClient(client CloudlogClient) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if client == nil {
+			return ErrClientNil
+		}
+		cc.client = client
+		return nil
+	}
+}
+
+// CoreOptionConverter defines the Converter used for converting entries to CloudLog events
+func CoreOptionConverter(converter Converter) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if converter == nil {
+			return ErrConverterNil
+		}
+		cc.SetConverter(converter)
+		return nil
+	}
+}
+
+// CoreOptionTimestampPrecision defines the timestamp precision of the default Converter
+func CoreOptionTimestampPrecision(precision TimestampPrecision) CoreOption {
+	return func(cc *CloudLogCore) error {
+		cc.SetTimestampPrecision(precision)
+		return nil
+	}
+}
+
+// CoreOptionLevelEnabler defines the levels sent to CloudLog independently of the wrapped core
+func CoreOptionLevelEnabler(enabler zapcore.LevelEnabler) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if enabler == nil {
+			return ErrLevelEnablerNil
+		}
+		cc.SetLevelEnabler(enabler)
+		return nil
+	}
+}
+
+// CoreOptionNameLevels defines per logger name overrides of the levels sent to CloudLog
+func CoreOptionNameLevels(levels *NameLevels) CoreOption {
+	return func(cc *CloudLogCore) error {
+		cc.SetNameLevels(levels)
+		return nil
+	}
+}
+
+// CoreOptionErrorHandler defines the ErrorHandler notified about errors which occur while
+// sending entries to CloudLog. By default errors are not reported.
+func CoreOptionErrorHandler(handler ErrorHandler) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if handler == nil {
+			return ErrErrorHandlerNil
+		}
+		cc.errors.handler = handler
+		return nil
+	}
+}
+
+// CoreOptionErrorOutput reports errors to the supplied WriteSyncer, see NewWriteSyncerErrorHandler
+func CoreOptionErrorOutput(ws zapcore.WriteSyncer) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if ws == nil {
+			return ErrErrorHandlerNil
+		}
+		return CoreOptionErrorHandler(NewWriteSyncerErrorHandler(ws))(cc)
+	}
+}
+
+// CoreOptionErrorLogger reports errors to the supplied logger, see NewLoggerErrorHandler
+func CoreOptionErrorLogger(logger *zap.Logger) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if logger == nil {
+			return ErrErrorLoggerNil
+		}
+		return CoreOptionErrorHandler(NewLoggerErrorHandler(logger))(cc)
+	}
+}
+
+// CoreOptionErrorReportInterval defines the interval within which identical errors are reported
+// only once. Zero disables the rate limiting.
+func CoreOptionErrorReportInterval(interval time.Duration) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if interval < 0 {
+			return ErrInvalidErrorReportInterval
+		}
+		cc.errors.interval = interval
+		return nil
+	}
+}
+
+// CoreOptionFields defines static fields which are added to every event sent to CloudLog,
+// but not to the entries written to the wrapped core. Like fields passed to With they are
+// encoded by the Converter, by default into the document's fields object (fields.*).
+// Use CoreOptionEnrichment for fields on the top level of the document.
+func CoreOptionFields(fields ...zapcore.Field) CoreOption {
+	return func(cc *CloudLogCore) error {
+		cc.fields = append(cc.fields, fields...)
+		return nil
+	}
+}
+
+// CoreOptionAsync enables asynchronous delivery using the supplied options, see EnableAsync
+func CoreOptionAsync(options ...AsyncOption) CoreOption {
+	return func(cc *CloudLogCore) error {
+		return cc.EnableAsync(options...)
+	}
+}
+
+// CoreOptionStatsBytesSent enables counting the bytes sent to CloudLog, which requires encoding
+// every pushed event once more
+func CoreOptionStatsBytesSent() CoreOption {
+	return func(cc *CloudLogCore) error {
+		cc.stats.countBytes = true
+		return nil
+	}
+}
+
+// NewCloudlogCore returns a new CloudLogCore wrapping the supplied core and sending entries
+// to the supplied CloudLog index. The index is ignored if a client is supplied using
+// CoreOptionClient. All misconfigurations are reported at once as an error.
+//
+// The index may be a template like svc-{tenant}-{yyyy.MM.dd}, which is expanded per entry from
+// the entry's time, the logger name ({logger}) and its fields. Entries for which a placeholder
+// cannot be expanded are sent to the index supplied by CoreOptionIndexFallback.
+func NewCloudlogCore(c zapcore.Core, index string, options ...CoreOption) (clc *CloudLogCore, err error) {
+	clc = &CloudLogCore{
+		Core:            c,
+		cloudLogIndex:   index,
+		lifecycle:       newLifecycle(),
+		errors:          newErrorReporter(),
+		stats:           newCoreStats(),
+		maxIndexClients: DefaultMaxIndexClients,
+	}
+
+	// When returning an error ensure that we return a nil value as *CloudLogCore
+	// and that no background workers are left behind
+	defer func() {
+		if err != nil {
+			if clc.async != nil {
+				clc.async.shutdown()
+			}
+			clc = nil
+		}
+	}()
+
+	if c == nil {
+		err = multierror.Append(err, ErrCoreNil)
+	}
+	for _, opt := range options {
+		if opt == nil {
+			continue
+		}
+		if optErr := opt(clc); optErr != nil {
+			err = multierror.Append(err, optErr)
+		}
+	}
+
+	if isIndexTemplate(index) {
+		template, templateErr := parseIndexTemplate(index, clc.indexFallback)
+		if templateErr == nil && clc.indexFallback == "" {
+			templateErr = ErrIndexFallbackMissing
+		}
+		if templateErr != nil {
+			err = multierror.Append(err, templateErr)
+			return
+		}
+		clc.router = chainRouters(clc.router, template)
+		// The fallback index is served by the default client
+		index = clc.indexFallback
+		clc.cloudLogIndex = index
+	}
+
+	if clc.client != nil {
+		if len(clc.cloudLogClientOptions) > 0 {
+			err = multierror.Append(err, ErrClientOptionsConflict)
+		}
+		if clc.reloadConfig != nil {
+			err = multierror.Append(err, ErrCertificateReloadConflict)
+		}
+		if clc.router != nil {
+			err = multierror.Append(err, ErrRoutingConflict)
+		}
+		return
+	}
+
+	// Every client gets its own copy of the options, as the reloader and the routing client
+	// create clients concurrently
+	newCloudLog := func(index string) (*cloudlog.CloudLog, error) {
+		return cloudlog.NewCloudLog(index, append([]cloudlog.Option(nil), clc.cloudLogClientOptions...)...)
+	}
+	create := func() (CloudlogClient, error) {
+		client, err := newCloudLog(index)
+		if err != nil || clc.router == nil {
+			return client, err
+		}
+		return newRoutingClient(client, func(index string) (CloudlogClient, error) {
+			return newCloudLog(index)
+		}, clc.maxIndexClients), nil
+	}
+	client, clientErr := create()
+	if clientErr != nil {
+		err = multierror.Append(err, clientErr)
+		return
+	}
+	clc.client = client
+	clc.ownsClient = true
+
+	if err == nil && clc.reloadConfig != nil {
+		reloading := &reloadingClient{client: client}
+		clc.client = reloading
+		clc.reloader = newCertificateReloader(reloading, *clc.reloadConfig, create, clc.reportError)
+		clc.reloader.certificates = clc.certificates
+		go clc.reloader.run()
+	}
+	return
+}
+
+// NewCloudlogCoreWithClient returns a new CloudLogCore wrapping the supplied core and pushing
+// entries to the supplied client, see CoreOptionClient
+func NewCloudlogCoreWithClient(c zapcore.Core, client CloudlogClient, options ...CoreOption) (*CloudLogCore, error) {
+	return NewCloudlogCore(c, "", append([]CoreOption{CoreOptionClient(client)}, options...)...)
+}
+
+// NewCloudlogCoreWithCloudLogOptions returns a new CloudLogCore using a cloudlog.CloudLog client
+// created with the supplied options. It retains the signature NewCloudlogCore had before
+// CoreOptions were introduced.
+//
+// Deprecated: use NewCloudlogCore with CoreOptionCloudLogOptions instead.
+func NewCloudlogCoreWithCloudLogOptions(c zapcore.Core, index string, options []cloudlog.Option) (*CloudLogCore, error) {
+	return NewCloudlogCore(c, index, CoreOptionCloudLogOptions(options...))
+}
@@ -0,0 +1,126 @@
+package cloudlogzap
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestNewCloudlogCore_Options(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		var buf bytes.Buffer
+		wrapped := zapcore.NewCore(
+			zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"}), zapcore.AddSync(&buf), zapcore.DebugLevel)
+		converter := ConverterFunc(func(entry zapcore.Entry, ff []zapcore.Field) interface{} {
+			return EncodeFields(entry, ff)
+		})
+
+		core, err := NewCloudlogCore(wrapped, "testindex",
+			CoreOptionCloudLogOptions(cloudlog.OptionBrokers("broker1:9092")),
+			CoreOptionCloudLogOptions(cloudlog.OptionBrokers("broker2:9092")),
+			CoreOptionConverter(converter),
+			CoreOptionLevelEnabler(zapcore.WarnLevel),
+			CoreOptionErrorLogger(zap.NewNop()),
+			CoreOptionFields(zap.String("service", "api")),
+			CoreOptionAsync(AsyncOptionFlushInterval(time.Millisecond)),
+		)
+		require.NoError(t, err)
+		require.NotNil(t, core)
+		defer core.Close()
+
+		assert.Len(t, core.cloudLogClientOptions, 2)
+		assert.NotNil(t, core.client)
+		assert.NotNil(t, core.async)
+		assert.NotNil(t, core.errors.handler)
+		assert.False(t, core.Enabled(zapcore.InfoLevel))
+
+		client := &MockBatchCloudlogClient{}
+		core.client = client
+		logger := zap.New(zapcore.NewTee(wrapped, core))
+		logger.Warn("test message")
+		require.NoError(t, core.Sync())
+
+		// Static fields are sent to CloudLog only
+		require.EqualValues(t, 1, client.Count())
+		assert.EqualValues(t, map[string]interface{}{"service": "api"}, client.Batches()[0][0])
+		assert.NotContains(t, buf.String(), "service")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		core, err := NewCloudlogCore(nil, "",
+			CoreOptionConverter(nil),
+			CoreOptionLevelEnabler(nil),
+			CoreOptionErrorLogger(nil),
+			CoreOptionAsync(AsyncOptionWorkers(0)),
+		)
+		assert.Nil(t, core)
+		require.IsType(t, &multierror.Error{}, err)
+		assert.EqualValues(t, []error{
+			ErrCoreNil,
+			ErrConverterNil,
+			ErrLevelEnablerNil,
+			ErrErrorLoggerNil,
+			ErrInvalidWorkerCount,
+			cloudlog.ErrIndexNotDefined,
+		}, flattenErrors(err))
+	})
+
+	t.Run("InvalidAfterAsync", func(t *testing.T) {
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "",
+			CoreOptionAsync(),
+		)
+		assert.Nil(t, core)
+		assert.EqualValues(t, []error{cloudlog.ErrIndexNotDefined}, flattenErrors(err))
+	})
+}
+
+// flattenErrors returns the errors aggregated by nested multierror.Errors
+func flattenErrors(err error) (errs []error) {
+	if merr, ok := err.(*multierror.Error); ok {
+		for _, wrapped := range merr.Errors {
+			errs = append(errs, flattenErrors(wrapped)...)
+		}
+		return
+	}
+	return []error{err}
+}
+
+func TestNewCloudlogCoreWithClient(t *testing.T) {
+	entry := zapcore.Entry{Level: zapcore.InfoLevel, Message: "test message"}
+
+	t.Run("Shared", func(t *testing.T) {
+		client := &MockClosableCloudlogClient{}
+		first, err := NewCloudlogCoreWithClient(zapcore.NewNopCore(), client)
+		require.NoError(t, err)
+		second, err := NewCloudlogCore(zapcore.NewNopCore(), "", CoreOptionClient(client), CoreOptionAsync())
+		require.NoError(t, err)
+
+		require.NoError(t, first.Write(entry, nil))
+		require.NoError(t, second.Write(entry, nil))
+		require.NoError(t, second.Sync())
+		assert.EqualValues(t, 2, client.Count())
+
+		// Supplied clients are owned by the caller
+		require.NoError(t, first.Close())
+		require.NoError(t, second.Close())
+		assert.False(t, client.closed)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		core, err := NewCloudlogCoreWithClient(zapcore.NewNopCore(), nil)
+		assert.Nil(t, core)
+		assert.EqualValues(t, []error{ErrClientNil, cloudlog.ErrIndexNotDefined}, flattenErrors(err))
+
+		core, err = NewCloudlogCoreWithClient(zapcore.NewNopCore(), &MockCloudlogClient{},
+			CoreOptionCloudLogOptions(cloudlog.OptionBrokers("broker:9092")))
+		assert.Nil(t, core)
+		assert.EqualValues(t, []error{ErrClientOptionsConflict}, flattenErrors(err))
+	})
+}
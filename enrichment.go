@@ -0,0 +1,93 @@
+package cloudlogzap
+
+import (
+	"os"
+	"runtime"
+
+	"github.com/anexia-it/go-cloudlog"
+)
+
+// Collector returns static fields attached to the top level of every document sent to CloudLog.
+// Collectors are called once when the core is created.
+type Collector func() map[string]interface{}
+
+// CollectStatic returns a Collector returning the supplied fields, like service, version,
+// environment or region
+func CollectStatic(fields map[string]interface{}) Collector {
+	return func() map[string]interface{} {
+		return fields
+	}
+}
+
+// CollectBuildInfo collects the Go version as go_version and, if built with module support,
+// the path and version of the main module as build_path and build_version
+func CollectBuildInfo() map[string]interface{} {
+	fields := map[string]interface{}{"go_version": runtime.Version()}
+	addBuildInfo(fields)
+	return fields
+}
+
+// CollectProcess collects the process ID as pid
+func CollectProcess() map[string]interface{} {
+	return map[string]interface{}{"pid": os.Getpid()}
+}
+
+// CollectPlatform collects the operating system and architecture as goos and goarch
+func CollectPlatform() map[string]interface{} {
+	return map[string]interface{}{
+		"goos":   runtime.GOOS,
+		"goarch": runtime.GOARCH,
+	}
+}
+
+// enrichment holds the static fields attached to every document
+type enrichment struct {
+	fields  map[string]interface{}
+	encoder cloudlog.EventEncoder
+}
+
+// CoreOptionEnrichment attaches the fields returned by the supplied collectors to the top level of
+// every document sent to CloudLog, but not to the entries written to the wrapped core. Fields of
+// later collectors take precedence, the document's own fields are never overwritten.
+// Use CoreOptionFields for fields encoded like the entry's fields into fields.*.
+func CoreOptionEnrichment(collectors ...Collector) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if cc.enrichment == nil {
+			cc.enrichment = &enrichment{
+				fields:  make(map[string]interface{}),
+				encoder: cloudlog.NewAutomaticEventEncoder(),
+			}
+		}
+		for _, collector := range collectors {
+			if collector == nil {
+				return ErrCollectorNil
+			}
+			for key, value := range collector() {
+				cc.enrichment.fields[key] = value
+			}
+		}
+		return nil
+	}
+}
+
+// enrich returns the event encoded as map carrying the static fields. Events which cannot be
+// encoded are returned as they are, so pushing them reports the error.
+func (cc *CloudLogCore) enrich(event interface{}) interface{} {
+	if cc.enrichment == nil || len(cc.enrichment.fields) == 0 {
+		return event
+	}
+	eventMap, err := cc.enrichment.encoder.EncodeEvent(event)
+	if err != nil {
+		return event
+	}
+
+	// The encoded map may be owned by the Converter
+	enriched := make(map[string]interface{}, len(eventMap)+len(cc.enrichment.fields))
+	for key, value := range cc.enrichment.fields {
+		enriched[key] = value
+	}
+	for key, value := range eventMap {
+		enriched[key] = value
+	}
+	return enriched
+}
@@ -0,0 +1,92 @@
+package cloudlogzap
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestCollectors(t *testing.T) {
+	assert.EqualValues(t, map[string]interface{}{"service": "api"}, CollectStatic(map[string]interface{}{"service": "api"})())
+	assert.EqualValues(t, map[string]interface{}{"pid": os.Getpid()}, CollectProcess())
+	assert.EqualValues(t, map[string]interface{}{"goos": runtime.GOOS, "goarch": runtime.GOARCH}, CollectPlatform())
+	assert.EqualValues(t, runtime.Version(), CollectBuildInfo()["go_version"])
+}
+
+func TestCoreOptionEnrichment(t *testing.T) {
+	entry := zapcore.Entry{Level: zapcore.InfoLevel, Message: "test message"}
+
+	t.Run("OK", func(t *testing.T) {
+		wrapped, buf := newCertificateTestCore()
+		client := &MockCloudlogClient{}
+		core, err := NewCloudlogCoreWithClient(wrapped, client,
+			CoreOptionEnrichment(
+				CollectStatic(map[string]interface{}{"service": "api", "region": "eu"}),
+				CollectStatic(map[string]interface{}{"region": "us", "message": "overridden"}),
+				CollectProcess,
+			),
+		)
+		require.NoError(t, err)
+
+		logger := zap.New(zapcore.NewTee(wrapped, core))
+		logger.Info("test message", zap.String("user", "alice"))
+		require.Len(t, client.events, 1)
+		event := client.events[0].(map[string]interface{})
+
+		// Later collectors take precedence, the document's keys are kept
+		assert.EqualValues(t, "api", event["service"])
+		assert.EqualValues(t, "us", event["region"])
+		assert.EqualValues(t, os.Getpid(), event["pid"])
+		assert.EqualValues(t, "test message", event["message"])
+		assert.EqualValues(t, map[string]interface{}{"user": "alice"}, event["fields"])
+
+		// The wrapped core does not receive the static fields
+		entries := decodeEntries(t, buf)
+		require.Len(t, entries, 1)
+		assert.NotContains(t, entries[0], "service")
+		assert.NotContains(t, entries[0], "pid")
+	})
+
+	t.Run("Converter", func(t *testing.T) {
+		converted := map[string]interface{}{"message": "test message"}
+		client := &MockCloudlogClient{}
+		core, err := NewCloudlogCoreWithClient(zapcore.NewNopCore(), client,
+			CoreOptionConverter(ConverterFunc(func(zapcore.Entry, []zapcore.Field) interface{} {
+				return converted
+			})),
+			CoreOptionEnrichment(CollectStatic(map[string]interface{}{"service": "api"})),
+		)
+		require.NoError(t, err)
+
+		require.NoError(t, core.Write(entry, nil))
+		assert.EqualValues(t, []interface{}{map[string]interface{}{"message": "test message", "service": "api"}}, client.events)
+		// Maps returned by the Converter are not modified
+		assert.EqualValues(t, map[string]interface{}{"message": "test message"}, converted)
+	})
+
+	t.Run("Routed", func(t *testing.T) {
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "myapp",
+			CoreOptionRoutes(Route{Index: "audit", Name: "audit"}),
+			CoreOptionEnrichment(CollectStatic(map[string]interface{}{"service": "api"})),
+		)
+		require.NoError(t, err)
+		defer core.Close()
+
+		// Routed events carry the static fields as well
+		event := core.convert(zapcore.Entry{LoggerName: "audit", Message: "test message"}, nil)
+		require.IsType(t, routedEvent{}, event)
+		assert.EqualValues(t, "audit", event.(routedEvent).index)
+		assert.EqualValues(t, "api", event.(routedEvent).event.(map[string]interface{})["service"])
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex", CoreOptionEnrichment(CollectProcess, nil))
+		assert.Nil(t, core)
+		assert.EqualValues(t, []error{ErrCollectorNil}, flattenErrors(err))
+	})
+}
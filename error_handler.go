@@ -0,0 +1,205 @@
+package cloudlogzap
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// DefaultErrorReportInterval defines the default interval within which identical errors are reported only once
+const DefaultErrorReportInterval = 10 * time.Second
+
+// maxTrackedErrors limits the number of distinct errors remembered for rate limiting
+const maxTrackedErrors = 128
+
+// maxPendingErrors limits the number of errors waiting for the handler
+const maxPendingErrors = 128
+
+// errorHandlerKey is the key of the field marking the entries logged by NewLoggerErrorHandler
+const errorHandlerKey = "_cloudlogzap_error_handler"
+
+// errorHandlerField marks the logger of NewLoggerErrorHandler, so CloudLogCores do not send its
+// entries to CloudLog. Other cores skip the field.
+var errorHandlerField = zapcore.Field{Key: errorHandlerKey, Type: zapcore.SkipType}
+
+// isErrorHandlerField returns true if the field is errorHandlerField
+func isErrorHandlerField(f zapcore.Field) bool {
+	return f.Type == zapcore.SkipType && f.Key == errorHandlerKey
+}
+
+// ErrorHandler is notified about errors which occur while sending entries to CloudLog,
+// like failed pushes or spool errors
+type ErrorHandler interface {
+	HandleError(err error)
+}
+
+// ErrorHandlerFunc is an adapter allowing the use of ordinary functions as ErrorHandler
+type ErrorHandlerFunc func(err error)
+
+// HandleError calls f(err)
+func (f ErrorHandlerFunc) HandleError(err error) {
+	f(err)
+}
+
+// NewWriteSyncerErrorHandler returns an ErrorHandler writing errors to the supplied WriteSyncer
+// in the style of zap's ErrorOutput
+func NewWriteSyncerErrorHandler(ws zapcore.WriteSyncer) ErrorHandler {
+	return ErrorHandlerFunc(func(err error) {
+		fmt.Fprintf(ws, "%v CloudLog error: %v\n", time.Now(), err)
+		ws.Sync()
+	})
+}
+
+// NewLoggerErrorHandler returns an ErrorHandler logging errors to the supplied logger. If the
+// logger tees into a CloudLogCore, the errors are not sent to CloudLog by that core.
+func NewLoggerErrorHandler(logger *zap.Logger) ErrorHandler {
+	logger = logger.With(errorHandlerField)
+	return ErrorHandlerFunc(func(err error) {
+		logger.Error("CloudLog error", zap.Error(err))
+	})
+}
+
+// RepeatedError is reported instead of an error which has occurred again after identical
+// errors have been suppressed by the rate limiting
+type RepeatedError struct {
+	Err error
+	// Suppressed is the number of identical errors which have not been reported
+	Suppressed int
+}
+
+// Error implements error
+func (e *RepeatedError) Error() string {
+	return fmt.Sprintf("%v (%d identical errors suppressed)", e.Err, e.Suppressed)
+}
+
+// errorReporter passes errors to the ErrorHandler one at a time, rate limiting identical errors.
+// Errors reported while the handler is running are queued and passed to the handler by the
+// goroutine running it, so a handler writing to the core does not recurse. It is shared by all
+// clones of a core.
+type errorReporter struct {
+	dropped uint64
+
+	handler  ErrorHandler
+	interval time.Duration
+
+	mutex     sync.Mutex
+	reported  map[string]*reportedError
+	pending   []error
+	reporting bool
+	now       func() time.Time
+}
+
+type reportedError struct {
+	at         time.Time
+	suppressed int
+}
+
+func newErrorReporter() *errorReporter {
+	return &errorReporter{
+		interval: DefaultErrorReportInterval,
+		reported: make(map[string]*reportedError),
+		now:      time.Now,
+	}
+}
+
+func (r *errorReporter) report(err error) {
+	if r.handler == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	if err = r.limit(err); err == nil {
+		r.mutex.Unlock()
+		return
+	}
+	if len(r.pending) >= maxPendingErrors {
+		r.mutex.Unlock()
+		atomic.AddUint64(&r.dropped, 1)
+		return
+	}
+	r.pending = append(r.pending, err)
+	if r.reporting {
+		// The goroutine running the handler passes the error on
+		r.mutex.Unlock()
+		return
+	}
+	r.reporting = true
+	r.mutex.Unlock()
+
+	r.drain()
+}
+
+// drain passes the pending errors to the handler until none are left
+func (r *errorReporter) drain() {
+	drained := false
+	defer func() {
+		// Let the next error be reported if the handler panics
+		if !drained {
+			r.mutex.Lock()
+			r.reporting = false
+			r.mutex.Unlock()
+		}
+	}()
+
+	for {
+		r.mutex.Lock()
+		if len(r.pending) == 0 {
+			r.reporting = false
+			r.mutex.Unlock()
+			drained = true
+			return
+		}
+		err := r.pending[0]
+		r.pending = r.pending[1:]
+		r.mutex.Unlock()
+
+		r.handler.HandleError(err)
+	}
+}
+
+// limit returns nil if an identical error has been reported within the interval, otherwise
+// the error to report. Callers must hold the mutex.
+func (r *errorReporter) limit(err error) error {
+	if r.interval <= 0 {
+		return err
+	}
+
+	now := r.now()
+	key := err.Error()
+	previous, ok := r.reported[key]
+	if ok && now.Sub(previous.at) < r.interval {
+		previous.suppressed++
+		atomic.AddUint64(&r.dropped, 1)
+		return nil
+	}
+
+	if len(r.reported) >= maxTrackedErrors {
+		for k, e := range r.reported {
+			if now.Sub(e.at) >= r.interval {
+				delete(r.reported, k)
+			}
+		}
+	}
+	if ok || len(r.reported) < maxTrackedErrors {
+		r.reported[key] = &reportedError{at: now}
+	}
+
+	if ok && previous.suppressed > 0 {
+		return &RepeatedError{Err: err, Suppressed: previous.suppressed}
+	}
+	return err
+}
+
+// droppedErrors returns the number of errors which have not been passed to the handler
+func (r *errorReporter) droppedErrors() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+// reportError passes the error to the core's ErrorHandler
+func (cc *CloudLogCore) reportError(err error) {
+	cc.errors.report(err)
+}
@@ -0,0 +1,205 @@
+package cloudlogzap
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func newTestErrorReporter() (*errorReporter, *mockClock, *[]error) {
+	reported := &[]error{}
+	clock := &mockClock{now: time.Now()}
+	r := newErrorReporter()
+	r.now = clock.Now
+	r.handler = ErrorHandlerFunc(func(err error) {
+		*reported = append(*reported, err)
+	})
+	return r, clock, reported
+}
+
+func TestErrorReporter(t *testing.T) {
+	t.Run("RateLimit", func(t *testing.T) {
+		r, clock, reported := newTestErrorReporter()
+		other := errors.New("other")
+
+		r.report(errMockPushFailed)
+		r.report(errMockPushFailed)
+		r.report(other)
+		clock.now = clock.now.Add(DefaultErrorReportInterval / 2)
+		r.report(errMockPushFailed)
+		assert.EqualValues(t, []error{errMockPushFailed, other}, *reported)
+		assert.EqualValues(t, 2, r.droppedErrors())
+
+		clock.now = clock.now.Add(DefaultErrorReportInterval)
+		r.report(errMockPushFailed)
+		r.report(other)
+		require.Len(t, *reported, 4)
+		assert.EqualValues(t, &RepeatedError{Err: errMockPushFailed, Suppressed: 2}, (*reported)[2])
+		assert.EqualValues(t, "push failed (2 identical errors suppressed)", (*reported)[2].Error())
+		assert.EqualValues(t, other, (*reported)[3])
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		r, _, reported := newTestErrorReporter()
+		r.interval = 0
+		for i := 0; i < 3; i++ {
+			r.report(errMockPushFailed)
+		}
+		assert.Len(t, *reported, 3)
+		assert.Empty(t, r.reported)
+	})
+
+	t.Run("Tracked", func(t *testing.T) {
+		r, _, reported := newTestErrorReporter()
+		for i := 0; i < 2*maxTrackedErrors; i++ {
+			r.report(errors.New(string(rune('a' + i))))
+		}
+		assert.Len(t, *reported, 2*maxTrackedErrors)
+		assert.Len(t, r.reported, maxTrackedErrors)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		var mutex sync.Mutex
+		var handled []string
+		release := make(chan struct{})
+		r := newErrorReporter()
+		r.interval = 0
+		r.handler = ErrorHandlerFunc(func(err error) {
+			<-release
+			mutex.Lock()
+			defer mutex.Unlock()
+			handled = append(handled, err.Error())
+		})
+
+		// Errors reported while the handler is running are queued instead of dropped
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				r.report(errors.New(strconv.Itoa(i)))
+			}(i)
+		}
+		waitFor(t, func() bool {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			return len(r.pending) == 4
+		})
+		close(release)
+		wg.Wait()
+
+		assert.Len(t, handled, 5)
+		assert.EqualValues(t, 0, r.droppedErrors())
+		assert.False(t, r.reporting)
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		r, _, _ := newTestErrorReporter()
+		r.handler = ErrorHandlerFunc(func(err error) {
+			panic(err)
+		})
+		assert.Panics(t, func() {
+			r.report(errMockPushFailed)
+		})
+		assert.False(t, r.reporting)
+	})
+
+	t.Run("NoHandler", func(t *testing.T) {
+		core, err := NewCloudlogCoreWithClient(zapcore.NewNopCore(), &MockFailingCloudlogClient{Failures: 1})
+		require.NoError(t, err)
+		assert.EqualValues(t, errMockPushFailed, core.Write(zapcore.Entry{Message: "test message"}, nil))
+	})
+}
+
+func TestCloudLogCore_ErrorHandler(t *testing.T) {
+	entry := zapcore.Entry{Level: zapcore.InfoLevel, Message: "test message"}
+
+	t.Run("Recursion", func(t *testing.T) {
+		wrapped := zapcore.NewCore(
+			zapcore.NewJSONEncoder(zapcore.EncoderConfig{}), zapcore.AddSync(ioutil.Discard), zapcore.DebugLevel)
+		core, err := NewCloudlogCoreWithClient(wrapped, &MockFailingCloudlogClient{Failures: 10})
+		require.NoError(t, err)
+
+		// The handler logs to a logger which tees into the failing core
+		var handled int
+		logger := zap.New(zapcore.NewTee(zapcore.NewNopCore(), core), zap.ErrorOutput(zapcore.AddSync(&bytes.Buffer{})))
+		core.errors.handler = ErrorHandlerFunc(func(err error) {
+			handled++
+			logger.Error("CloudLog error", zap.Error(err))
+		})
+
+		assert.Error(t, core.Write(entry, nil))
+		assert.EqualValues(t, 1, handled)
+		assert.EqualValues(t, 1, core.errors.droppedErrors())
+	})
+
+	t.Run("LoggerTee", func(t *testing.T) {
+		var buf bytes.Buffer
+		wrapped := zapcore.NewCore(
+			zapcore.NewJSONEncoder(zapcore.EncoderConfig{}), zapcore.AddSync(ioutil.Discard), zapcore.DebugLevel)
+		client := &MockFailingCloudlogClient{Failures: 10}
+		core, err := NewCloudlogCoreWithClient(wrapped, client, CoreOptionErrorReportInterval(0))
+		require.NoError(t, err)
+
+		// The error logger tees into the failing core, which does not send its entries to CloudLog
+		console := zapcore.NewCore(
+			zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"}), zapcore.AddSync(&buf), zapcore.DebugLevel)
+		logger := zap.New(zapcore.NewTee(console, core))
+		require.NoError(t, CoreOptionErrorLogger(logger)(core))
+
+		assert.Error(t, core.Write(entry, nil))
+		assert.EqualValues(t, 1, client.Calls())
+		assert.EqualValues(t, 0, core.errors.droppedErrors())
+		assert.EqualValues(t, `{"msg":"CloudLog error","error":"push failed"}`+"\n", buf.String())
+
+		// Other entries of the logger are still sent to CloudLog
+		logger.Info("test message")
+		assert.EqualValues(t, 2, client.Calls())
+	})
+
+	t.Run("ErrorOutput", func(t *testing.T) {
+		var buf bytes.Buffer
+		core, err := NewCloudlogCoreWithClient(zapcore.NewNopCore(), &MockFailingCloudlogClient{Failures: 1},
+			CoreOptionErrorOutput(zapcore.AddSync(&buf)))
+		require.NoError(t, err)
+
+		assert.Error(t, core.Write(entry, nil))
+		assert.Contains(t, buf.String(), "CloudLog error: push failed\n")
+	})
+
+	t.Run("Logger", func(t *testing.T) {
+		var buf bytes.Buffer
+		errorLogger := zap.New(zapcore.NewCore(
+			zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"}), zapcore.AddSync(&buf), zapcore.DebugLevel))
+		core, err := NewCloudlogCoreWithClient(zapcore.NewNopCore(), &MockFailingCloudlogClient{Failures: 1},
+			CoreOptionErrorLogger(errorLogger))
+		require.NoError(t, err)
+
+		assert.Error(t, core.Write(entry, nil))
+		assert.EqualValues(t, `{"msg":"CloudLog error","error":"push failed"}`+"\n", buf.String())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := NewCloudlogCoreWithClient(zapcore.NewNopCore(), &MockCloudlogClient{},
+			CoreOptionErrorHandler(nil),
+			CoreOptionErrorOutput(nil),
+			CoreOptionErrorLogger(nil),
+			CoreOptionErrorReportInterval(-time.Second),
+		)
+		assert.EqualValues(t, []error{
+			ErrErrorHandlerNil,
+			ErrErrorHandlerNil,
+			ErrErrorLoggerNil,
+			ErrInvalidErrorReportInterval,
+		}, flattenErrors(err))
+	})
+}
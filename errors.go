@@ -0,0 +1,161 @@
+package cloudlogzap
+
+import "errors"
+
+var (
+	// ErrCoreClosed indicates that the CloudLogCore has been closed
+	ErrCoreClosed = errors.New("CloudLog core is closed")
+
+	// ErrInvalidQueueCapacity indicates that the supplied queue capacity is less than one
+	ErrInvalidQueueCapacity = errors.New("Queue capacity must be at least 1")
+
+	// ErrInvalidBatchSize indicates that the supplied batch size is less than one
+	ErrInvalidBatchSize = errors.New("Batch size must be at least 1")
+
+	// ErrInvalidFlushInterval indicates that the supplied flush interval is not positive
+	ErrInvalidFlushInterval = errors.New("Flush interval must be positive")
+
+	// ErrInvalidWorkerCount indicates that the supplied worker count is less than one
+	ErrInvalidWorkerCount = errors.New("Worker count must be at least 1")
+
+	// ErrOverflowPolicyNil indicates that a nil overflow policy has been supplied
+	ErrOverflowPolicyNil = errors.New("Overflow policy must not be nil")
+
+	// ErrAsyncAlreadyEnabled indicates that asynchronous delivery has already been enabled
+	ErrAsyncAlreadyEnabled = errors.New("Asynchronous delivery is already enabled")
+
+	// ErrInvalidSpoolMode indicates that the supplied spool mode is unknown
+	ErrInvalidSpoolMode = errors.New("Spool mode is invalid")
+
+	// ErrInvalidSpoolSize indicates that the supplied spool size limit is less than one byte
+	ErrInvalidSpoolSize = errors.New("Spool size must be at least 1 byte")
+
+	// ErrInvalidSpoolMaxAge indicates that the supplied maximum spool age is negative
+	ErrInvalidSpoolMaxAge = errors.New("Spool maximum age must not be negative")
+
+	// ErrInvalidSpoolReplayInterval indicates that the supplied replay interval is not positive
+	ErrInvalidSpoolReplayInterval = errors.New("Spool replay interval must be positive")
+
+	// ErrClientNil indicates that a nil CloudlogClient has been supplied
+	ErrClientNil = errors.New("Client must not be nil")
+
+	// ErrInvalidRetryAttempts indicates that the supplied number of attempts is less than one
+	ErrInvalidRetryAttempts = errors.New("Retry attempts must be at least 1")
+
+	// ErrInvalidRetryBackoff indicates that the supplied backoff is negative or its maximum
+	// is less than its initial value
+	ErrInvalidRetryBackoff = errors.New("Retry backoff is invalid")
+
+	// ErrInvalidRetryJitter indicates that the supplied jitter is not between 0 and 1
+	ErrInvalidRetryJitter = errors.New("Retry jitter must be between 0 and 1")
+
+	// ErrRetryClassifierNil indicates that a nil RetryClassifier has been supplied
+	ErrRetryClassifierNil = errors.New("Retry classifier must not be nil")
+
+	// ErrInvalidRetryDeadline indicates that the supplied retry deadline is not positive
+	ErrInvalidRetryDeadline = errors.New("Retry deadline must be positive")
+
+	// ErrRetryDeadlineExceeded indicates that a push has not completed within the retry deadline
+	ErrRetryDeadlineExceeded = errors.New("Push has not completed within the retry deadline")
+
+	// ErrSpoolAlreadyEnabled indicates that the spool has already been enabled
+	ErrSpoolAlreadyEnabled = errors.New("Spool is already enabled")
+
+	// ErrSpoolNotEnabled indicates that the spool is required but has not been enabled
+	ErrSpoolNotEnabled = errors.New("Spool is not enabled")
+
+	// ErrInvalidBreakerThreshold indicates that the supplied failure threshold is less than one
+	ErrInvalidBreakerThreshold = errors.New("Circuit breaker failure threshold must be at least 1")
+
+	// ErrInvalidBreakerTimeout indicates that the supplied open timeout is not positive
+	ErrInvalidBreakerTimeout = errors.New("Circuit breaker open timeout must be positive")
+
+	// ErrInvalidBreakerProbes indicates that the supplied number of probes is less than one
+	ErrInvalidBreakerProbes = errors.New("Circuit breaker probes must be at least 1")
+
+	// ErrFallbackCoreNil indicates that a nil fallback core has been supplied
+	ErrFallbackCoreNil = errors.New("Fallback core must not be nil")
+
+	// ErrShortCircuitedEventsDropped indicates that queued events rejected by the circuit breaker have
+	// been dropped instead of being written to its fallback core
+	ErrShortCircuitedEventsDropped = errors.New("Queued events rejected by the circuit breaker have been dropped")
+
+	// ErrCircuitBreakerAlreadyEnabled indicates that the circuit breaker has already been enabled
+	ErrCircuitBreakerAlreadyEnabled = errors.New("Circuit breaker is already enabled")
+
+	// ErrCoreNil indicates that a nil core has been supplied
+	ErrCoreNil = errors.New("Core must not be nil")
+
+	// ErrConverterNil indicates that a nil converter has been supplied
+	ErrConverterNil = errors.New("Converter must not be nil")
+
+	// ErrLevelEnablerNil indicates that a nil level enabler has been supplied
+	ErrLevelEnablerNil = errors.New("Level enabler must not be nil")
+
+	// ErrClientOptionsConflict indicates that CloudLog client options have been supplied
+	// together with an existing client
+	ErrClientOptionsConflict = errors.New("CloudLog options cannot be applied to an existing client")
+
+	// ErrErrorLoggerNil indicates that a nil error logger has been supplied
+	ErrErrorLoggerNil = errors.New("Error logger must not be nil")
+
+	// ErrErrorHandlerNil indicates that a nil error handler or output has been supplied
+	ErrErrorHandlerNil = errors.New("Error handler must not be nil")
+
+	// ErrExpvarExists indicates that an expvar variable of the supplied name has already been published
+	ErrExpvarExists = errors.New("Expvar variable already exists")
+
+	// ErrInvalidErrorReportInterval indicates that the supplied error report interval is negative
+	ErrInvalidErrorReportInterval = errors.New("Error report interval must not be negative")
+
+	// ErrInvalidRedactionRule indicates that a redaction rule defines neither fields nor a pattern
+	ErrInvalidRedactionRule = errors.New("Redaction rule must define fields or a pattern")
+
+	// ErrCACertificateConflict indicates that the CA certificate has been supplied inline and as file
+	ErrCACertificateConflict = errors.New("CA certificate must be supplied either inline or as file")
+
+	// ErrClientCertificateConflict indicates that the client certificate has been supplied inline and as file
+	ErrClientCertificateConflict = errors.New("Client certificate must be supplied either inline or as file")
+
+	// ErrClientCertificateIncomplete indicates that a client certificate has been supplied without key or vice versa
+	ErrClientCertificateIncomplete = errors.New("Client certificate and key must be supplied together")
+
+	// ErrInvalidOverflowPolicy indicates that the supplied overflow policy name is unknown
+	ErrInvalidOverflowPolicy = errors.New("Overflow policy is invalid")
+
+	// ErrInvalidCertificateReloadInterval indicates that the supplied certificate reload interval is not positive
+	ErrInvalidCertificateReloadInterval = errors.New("Certificate reload interval must be positive")
+
+	// ErrCertificateReloadPathsMissing indicates that no files to watch for certificate reloading have been supplied
+	ErrCertificateReloadPathsMissing = errors.New("Certificate reload requires at least one file")
+
+	// ErrCertificateReloadConflict indicates that certificate reloading has been enabled together with an existing client
+	ErrCertificateReloadConflict = errors.New("Certificate reload cannot be applied to an existing client")
+
+	// ErrCertificateNotFound indicates that the supplied PEM data does not contain a certificate
+	ErrCertificateNotFound = errors.New("No PEM encoded certificate found")
+
+	// ErrRouterNil indicates that a nil Router has been supplied
+	ErrRouterNil = errors.New("Router must not be nil")
+
+	// ErrRouteIndexMissing indicates that a route does not define an index
+	ErrRouteIndexMissing = errors.New("Route must define an index")
+
+	// ErrRoutingConflict indicates that routing has been enabled together with an existing client
+	ErrRoutingConflict = errors.New("Routing cannot be applied to an existing client")
+
+	// ErrIndexFallbackMissing indicates that an index template has been supplied without fallback index
+	ErrIndexFallbackMissing = errors.New("Index template requires a fallback index")
+
+	// ErrInvalidIndexFallback indicates that the supplied fallback index is a template
+	ErrInvalidIndexFallback = errors.New("Fallback index must not be a template")
+
+	// ErrInvalidMaxIndexClients indicates that the supplied maximum number of index clients is less than one
+	ErrInvalidMaxIndexClients = errors.New("Maximum number of index clients must be at least 1")
+
+	// ErrCollectorNil indicates that a nil Collector has been supplied
+	ErrCollectorNil = errors.New("Collector must not be nil")
+)
+
+// errShortCircuited indicates that events have been rejected by the open circuit breaker
+var errShortCircuited = errors.New("Circuit breaker is open")
@@ -0,0 +1,316 @@
+package cloudlogzap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var _ zapcore.ObjectEncoder = (*fieldEncoder)(nil)
+var _ zapcore.ArrayEncoder = (*sliceEncoder)(nil)
+
+// EncodeFields returns the fields of the default document for the supplied entry and fields,
+// including the logger name, caller and stacktrace of the entry. It may be used by custom
+// Converters. Integers keep their type, so they are not subject to float64 precision. Durations
+// are encoded as seconds and times as seconds since the epoch, like zapcore.SecondsDurationEncoder
+// and zapcore.EpochTimeEncoder do.
+func EncodeFields(entry zapcore.Entry, ff []zapcore.Field) map[string]interface{} {
+	enc := newFieldEncoder(len(ff) + 3)
+
+	if entry.LoggerName != "" {
+		enc.fields["module"] = entry.LoggerName
+	}
+	if entry.Caller.Defined {
+		enc.fields["caller"] = entry.Caller.TrimmedPath()
+	}
+	for i := range ff {
+		ff[i].AddTo(enc)
+	}
+	if entry.Stack != "" {
+		enc.fields["stacktrace"] = entry.Stack
+	}
+	return enc.fields
+}
+
+// fieldEncoder is a zapcore.ObjectEncoder writing typed values straight into a map
+type fieldEncoder struct {
+	fields map[string]interface{}
+	// cur is the namespace currently written to
+	cur map[string]interface{}
+}
+
+func newFieldEncoder(size int) *fieldEncoder {
+	fields := make(map[string]interface{}, size)
+	return &fieldEncoder{fields: fields, cur: fields}
+}
+
+// AddArray implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddArray(key string, marshaler zapcore.ArrayMarshaler) error {
+	arr := newSliceEncoder()
+	err := marshaler.MarshalLogArray(arr)
+	enc.cur[key] = arr.elems
+	return err
+}
+
+// AddObject implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddObject(key string, marshaler zapcore.ObjectMarshaler) error {
+	obj := newFieldEncoder(0)
+	enc.cur[key] = obj.fields
+	return marshaler.MarshalLogObject(obj)
+}
+
+// AddBinary implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddBinary(key string, value []byte) {
+	enc.cur[key] = base64.StdEncoding.EncodeToString(value)
+}
+
+// AddByteString implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddByteString(key string, value []byte) { enc.cur[key] = string(value) }
+
+// AddBool implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddBool(key string, value bool) { enc.cur[key] = value }
+
+// AddComplex128 implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddComplex128(key string, value complex128) {
+	enc.cur[key] = encodeComplex(value)
+}
+
+// AddComplex64 implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddComplex64(key string, value complex64) {
+	enc.cur[key] = encodeComplex(complex128(value))
+}
+
+// AddDuration implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddDuration(key string, value time.Duration) {
+	enc.cur[key] = encodeDuration(value)
+}
+
+// AddFloat64 implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddFloat64(key string, value float64) { enc.cur[key] = encodeFloat(value) }
+
+// AddFloat32 implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddFloat32(key string, value float32) {
+	enc.cur[key] = encodeFloat(float64(value))
+}
+
+// AddInt implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddInt(key string, value int) { enc.cur[key] = value }
+
+// AddInt64 implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddInt64(key string, value int64) { enc.cur[key] = value }
+
+// AddInt32 implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddInt32(key string, value int32) { enc.cur[key] = value }
+
+// AddInt16 implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddInt16(key string, value int16) { enc.cur[key] = value }
+
+// AddInt8 implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddInt8(key string, value int8) { enc.cur[key] = value }
+
+// AddString implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddString(key, value string) { enc.cur[key] = value }
+
+// AddTime implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddTime(key string, value time.Time) { enc.cur[key] = encodeTime(value) }
+
+// AddUint implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddUint(key string, value uint) { enc.cur[key] = value }
+
+// AddUint64 implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddUint64(key string, value uint64) { enc.cur[key] = value }
+
+// AddUint32 implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddUint32(key string, value uint32) { enc.cur[key] = value }
+
+// AddUint16 implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddUint16(key string, value uint16) { enc.cur[key] = value }
+
+// AddUint8 implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddUint8(key string, value uint8) { enc.cur[key] = value }
+
+// AddUintptr implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddUintptr(key string, value uintptr) { enc.cur[key] = uint64(value) }
+
+// AddReflected implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) AddReflected(key string, value interface{}) error {
+	v, err := encodeReflected(value)
+	if err != nil {
+		return err
+	}
+	enc.cur[key] = v
+	return nil
+}
+
+// OpenNamespace implements zapcore.ObjectEncoder
+func (enc *fieldEncoder) OpenNamespace(key string) {
+	ns := make(map[string]interface{})
+	enc.cur[key] = ns
+	enc.cur = ns
+}
+
+// sliceEncoder is a zapcore.ArrayEncoder writing typed values straight into a slice
+type sliceEncoder struct {
+	elems []interface{}
+}
+
+func newSliceEncoder() *sliceEncoder {
+	return &sliceEncoder{elems: make([]interface{}, 0)}
+}
+
+// AppendArray implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendArray(marshaler zapcore.ArrayMarshaler) error {
+	nested := newSliceEncoder()
+	err := marshaler.MarshalLogArray(nested)
+	arr.elems = append(arr.elems, nested.elems)
+	return err
+}
+
+// AppendObject implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendObject(marshaler zapcore.ObjectMarshaler) error {
+	obj := newFieldEncoder(0)
+	arr.elems = append(arr.elems, obj.fields)
+	return marshaler.MarshalLogObject(obj)
+}
+
+// AppendReflected implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendReflected(value interface{}) error {
+	v, err := encodeReflected(value)
+	if err != nil {
+		return err
+	}
+	arr.elems = append(arr.elems, v)
+	return nil
+}
+
+// AppendByteString implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendByteString(value []byte) {
+	arr.elems = append(arr.elems, string(value))
+}
+
+// AppendComplex128 implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendComplex128(value complex128) {
+	arr.elems = append(arr.elems, encodeComplex(value))
+}
+
+// AppendComplex64 implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendComplex64(value complex64) {
+	arr.elems = append(arr.elems, encodeComplex(complex128(value)))
+}
+
+// AppendFloat64 implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendFloat64(value float64) {
+	arr.elems = append(arr.elems, encodeFloat(value))
+}
+
+// AppendFloat32 implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendFloat32(value float32) {
+	arr.elems = append(arr.elems, encodeFloat(float64(value)))
+}
+
+// AppendBool implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendBool(value bool) { arr.elems = append(arr.elems, value) }
+
+// AppendDuration implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendDuration(value time.Duration) {
+	arr.elems = append(arr.elems, encodeDuration(value))
+}
+
+// AppendInt implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendInt(value int) { arr.elems = append(arr.elems, value) }
+
+// AppendInt64 implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendInt64(value int64) { arr.elems = append(arr.elems, value) }
+
+// AppendInt32 implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendInt32(value int32) { arr.elems = append(arr.elems, value) }
+
+// AppendInt16 implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendInt16(value int16) { arr.elems = append(arr.elems, value) }
+
+// AppendInt8 implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendInt8(value int8) { arr.elems = append(arr.elems, value) }
+
+// AppendString implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendString(value string) { arr.elems = append(arr.elems, value) }
+
+// AppendTime implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendTime(value time.Time) {
+	arr.elems = append(arr.elems, encodeTime(value))
+}
+
+// AppendUint implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendUint(value uint) { arr.elems = append(arr.elems, value) }
+
+// AppendUint64 implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendUint64(value uint64) { arr.elems = append(arr.elems, value) }
+
+// AppendUint32 implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendUint32(value uint32) { arr.elems = append(arr.elems, value) }
+
+// AppendUint16 implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendUint16(value uint16) { arr.elems = append(arr.elems, value) }
+
+// AppendUint8 implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendUint8(value uint8) { arr.elems = append(arr.elems, value) }
+
+// AppendUintptr implements zapcore.ArrayEncoder
+func (arr *sliceEncoder) AppendUintptr(value uintptr) {
+	arr.elems = append(arr.elems, uint64(value))
+}
+
+// encodeFloat encodes NaN and infinite values, which are not supported by JSON,
+// as strings like zap's JSON encoder does
+func encodeFloat(value float64) interface{} {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return value
+}
+
+// encodeDuration encodes durations as floating-point seconds like zapcore.SecondsDurationEncoder.
+// The CloudLog client cannot encode time.Duration values within nested maps and slices.
+func encodeDuration(value time.Duration) float64 {
+	return float64(value) / float64(time.Second)
+}
+
+// encodeTime encodes times as floating-point seconds since the epoch like zapcore.EpochTimeEncoder.
+// The CloudLog client cannot encode time.Time values within nested maps and slices.
+func encodeTime(value time.Time) float64 {
+	return float64(value.UnixNano()) / float64(time.Second)
+}
+
+// encodeComplex encodes complex values, which are not supported by JSON,
+// as strings like zap's JSON encoder does
+func encodeComplex(value complex128) string {
+	r, i := real(value), imag(value)
+	return strconv.FormatFloat(r, 'f', -1, 64) + "+" + strconv.FormatFloat(i, 'f', -1, 64) + "i"
+}
+
+// encodeReflected converts arbitrary values using their JSON representation, so json
+// struct tags and json.Marshaler implementations are honoured. Numbers are kept as
+// json.Number to avoid the float64 round-trip.
+func encodeReflected(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
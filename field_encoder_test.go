@@ -0,0 +1,213 @@
+package cloudlogzap
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type testUser struct {
+	Name  string `json:"name"`
+	Email string `json:"-"`
+	ID    int64  `json:"id"`
+}
+
+func (u testUser) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("name", u.Name)
+	enc.AddInt64("id", u.ID)
+	return nil
+}
+
+type testUsers []testUser
+
+func (u testUsers) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, user := range u {
+		if err := enc.AppendObject(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestEncodeFields(t *testing.T) {
+	ts := time.Date(2018, 9, 21, 9, 0, 0, 123456789, time.UTC)
+	entry := zapcore.Entry{
+		LoggerName: "test",
+		Caller:     zapcore.NewEntryCaller(0, "/src/github.com/anexia-it/go-cloudlogzap/field_encoder.go", 42, true),
+		Stack:      "goroutine 1",
+	}
+
+	fields := EncodeFields(entry, []zapcore.Field{
+		zap.Int64("int64", math.MaxInt64),
+		zap.Uint64("uint64", math.MaxUint64),
+		zap.Int8("int8", -8),
+		zap.Uintptr("uintptr", 0xdead),
+		zap.Float64("float", 1.5),
+		zap.Float64("nan", math.NaN()),
+		zap.Float32("inf", float32(math.Inf(-1))),
+		zap.Complex128("complex", complex(1, -2)),
+		zap.Bool("bool", true),
+		zap.String("string", "value"),
+		zap.ByteString("bytestring", []byte("bytes")),
+		zap.Binary("binary", []byte{0xff, 0x00}),
+		zap.Duration("duration", 1500*time.Millisecond),
+		zap.Time("time", ts),
+		zap.Error(errors.New("failed")),
+		zap.Object("user", testUser{Name: "alice", ID: 1 << 60}),
+		zap.Array("users", testUsers{{Name: "bob", ID: 2}}),
+		zap.Int64s("ints", []int64{math.MinInt64, 0}),
+		zap.Durations("durations", []time.Duration{time.Second}),
+		zap.Reflect("reflected", testUser{Name: "carol", Email: "secret", ID: 1<<53 + 1}),
+		zap.Namespace("ns"),
+		zap.String("nested", "value"),
+	})
+
+	assert.EqualValues(t, map[string]interface{}{
+		"module":     "test",
+		"caller":     "go-cloudlogzap/field_encoder.go:42",
+		"stacktrace": "goroutine 1",
+		"int64":      int64(math.MaxInt64),
+		"uint64":     uint64(math.MaxUint64),
+		"int8":       int8(-8),
+		"uintptr":    uint64(0xdead),
+		"float":      1.5,
+		"nan":        "NaN",
+		"inf":        "-Inf",
+		"complex":    "1+-2i",
+		"bool":       true,
+		"string":     "value",
+		"bytestring": "bytes",
+		"binary":     "/wA=",
+		"duration":   1.5,
+		"time":       float64(ts.UnixNano()) / float64(time.Second),
+		"error":      "failed",
+		"user":       map[string]interface{}{"name": "alice", "id": int64(1 << 60)},
+		"users":      []interface{}{map[string]interface{}{"name": "bob", "id": int64(2)}},
+		"ints":       []interface{}{int64(math.MinInt64), int64(0)},
+		"durations":  []interface{}{1.0},
+		"reflected":  map[string]interface{}{"name": "carol", "id": json.Number("9007199254740993")},
+		"ns":         map[string]interface{}{"nested": "value"},
+	}, fields)
+}
+
+func TestEncodeFields_CloudLogEncoding(t *testing.T) {
+	d := DefaultConverter.Convert(zapcore.Entry{Message: "test message"}, []zapcore.Field{
+		zap.Int64("int64", math.MaxInt64),
+		zap.Uint64("uint64", math.MaxUint64),
+		zap.Float64("nan", math.NaN()),
+		zap.Complex64("complex", complex(1, 2)),
+		zap.Reflect("reflected", testUser{ID: 1<<53 + 1}),
+	})
+
+	eventMap, err := cloudlog.NewAutomaticEventEncoder().EncodeEvent(d)
+	require.NoError(t, err)
+	data, err := json.Marshal(eventMap)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(data), `"int64":9223372036854775807`)
+	assert.Contains(t, string(data), `"uint64":18446744073709551615`)
+	assert.Contains(t, string(data), `"nan":"NaN"`)
+	assert.Contains(t, string(data), `"complex":"1+2i"`)
+	assert.Contains(t, string(data), `"id":9007199254740993`)
+
+	// Durations and times are encoded like the former JSON round-trip did, also when nested
+	ts := time.Unix(1537520400, 500000000)
+	d = DefaultConverter.Convert(zapcore.Entry{Message: "test message"}, []zapcore.Field{
+		zap.Duration("duration", 1500*time.Millisecond),
+		zap.Time("time", ts),
+		zap.Durations("durations", []time.Duration{time.Second}),
+		zap.Times("times", []time.Time{ts}),
+		zap.Object("object", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+			enc.AddTime("time", ts)
+			enc.AddDuration("duration", time.Second)
+			return nil
+		})),
+		zap.Namespace("ns"),
+		zap.Time("time", ts),
+	})
+
+	eventMap, err = cloudlog.NewAutomaticEventEncoder().EncodeEvent(d)
+	require.NoError(t, err)
+	data, err = json.Marshal(eventMap)
+	require.NoError(t, err)
+
+	roundTrip, err := json.Marshal(convertJSONRoundTrip(zapcore.Entry{}, []zapcore.Field{
+		zap.Duration("duration", 1500*time.Millisecond),
+		zap.Time("time", ts),
+		zap.Durations("durations", []time.Duration{time.Second}),
+		zap.Times("times", []time.Time{ts}),
+	}))
+	require.NoError(t, err)
+	assert.Contains(t, string(roundTrip), `"duration":1.5`)
+	assert.Contains(t, string(roundTrip), `"time":1537520400.5`)
+	assert.Contains(t, string(data), `"duration":1.5`)
+	assert.Contains(t, string(data), `"durations":[1]`)
+	assert.Contains(t, string(data), `"times":[1537520400.5]`)
+	assert.Contains(t, string(data), `"object":{"duration":1,"time":1537520400.5}`)
+	assert.Contains(t, string(data), `"ns":{"time":1537520400.5}`)
+}
+
+var benchmarkFields = []zapcore.Field{
+	zap.String("request_id", "7f3b0c2e-6d3e-4b8b-9a1c-0e1a2b3c4d5e"),
+	zap.Int64("user_id", 123456789012),
+	zap.Duration("latency", 42*time.Millisecond),
+	zap.Time("started", time.Unix(1537520400, 0)),
+	zap.Bool("cached", true),
+	zap.Object("user", testUser{Name: "alice", ID: 1}),
+	zap.Strings("tags", []string{"a", "b", "c"}),
+	zap.Error(errors.New("failed")),
+}
+
+var benchmarkEntry = zapcore.Entry{
+	Level:      zapcore.InfoLevel,
+	LoggerName: "http.access",
+	Message:    "request served",
+	Time:       time.Unix(1537520400, 0),
+}
+
+// convertJSONRoundTrip is the conversion used before EncodeFields, kept for comparison
+func convertJSONRoundTrip(entry zapcore.Entry, ff []zapcore.Field) map[string]interface{} {
+	enc := zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+		NameKey:        "module",
+		CallerKey:      "caller",
+		StacktraceKey:  "stacktrace",
+		LineEnding:     zapcore.DefaultLineEnding,
+		EncodeLevel:    zapcore.LowercaseLevelEncoder,
+		EncodeTime:     zapcore.EpochTimeEncoder,
+		EncodeDuration: zapcore.SecondsDurationEncoder,
+		EncodeCaller:   zapcore.ShortCallerEncoder,
+	})
+	buf, err := enc.EncodeEntry(entry, ff)
+	if err != nil {
+		return nil
+	}
+	defer buf.Free()
+
+	fields := make(map[string]interface{})
+	if err = json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		return nil
+	}
+	return fields
+}
+
+func BenchmarkEncodeFields(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EncodeFields(benchmarkEntry, benchmarkFields)
+	}
+}
+
+func BenchmarkEncodeFields_JSONRoundTrip(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		convertJSONRoundTrip(benchmarkEntry, benchmarkFields)
+	}
+}
@@ -0,0 +1,200 @@
+package cloudlogzap
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// DefaultMaxIndexClients defines the default number of clients for routed or templated indices
+// which are kept open
+const DefaultMaxIndexClients = 32
+
+// loggerPlaceholder is the index template placeholder expanded to the logger name
+const loggerPlaceholder = "logger"
+
+// dateTokens maps the tokens of date placeholders to the layout of the time package
+var dateTokens = []struct {
+	token  string
+	layout string
+}{
+	{"yyyy", "2006"},
+	{"yy", "06"},
+	{"MM", "01"},
+	{"dd", "02"},
+	{"HH", "15"},
+}
+
+// indexTemplatePart is either a literal or a placeholder of an index template
+type indexTemplatePart struct {
+	literal string
+	// dateLayout is set for date placeholders
+	dateLayout string
+	// key is set for logger name and field placeholders
+	key string
+}
+
+// indexTemplate is a Router expanding the index of every entry from a template like
+// svc-{tenant}-{yyyy.MM.dd}
+type indexTemplate struct {
+	parts    []indexTemplatePart
+	fallback string
+}
+
+// isIndexTemplate returns whether the index contains placeholders
+func isIndexTemplate(index string) bool {
+	return strings.ContainsAny(index, "{}")
+}
+
+// parseIndexTemplate parses an index template. Placeholders consisting of the tokens yyyy,
+// yy, MM, dd and HH and the separators ".", "-" and "_" are expanded to the entry's time in
+// UTC, {logger} to the logger name and all others to the value of the field of that key.
+func parseIndexTemplate(template, fallback string) (*indexTemplate, error) {
+	t := &indexTemplate{fallback: fallback}
+	for rest := template; rest != ""; {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.parts = append(t.parts, indexTemplatePart{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("Invalid index template %q: unexpected }", template)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, indexTemplatePart{literal: rest[:open]})
+		}
+
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] == '{' {
+			return nil, fmt.Errorf("Invalid index template %q: unclosed {", template)
+		}
+		key := rest[open+1 : open+1+end]
+		if key == "" {
+			return nil, fmt.Errorf("Invalid index template %q: empty placeholder", template)
+		}
+		if layout, ok := dateLayout(key); ok {
+			t.parts = append(t.parts, indexTemplatePart{dateLayout: layout})
+		} else {
+			t.parts = append(t.parts, indexTemplatePart{key: key})
+		}
+		rest = rest[open+1+end+1:]
+	}
+	return t, nil
+}
+
+// dateLayout returns the time layout of a date placeholder
+func dateLayout(placeholder string) (string, bool) {
+	var layout []string
+	for rest := placeholder; rest != ""; {
+		if strings.IndexByte(".-_", rest[0]) >= 0 {
+			layout = append(layout, rest[:1])
+			rest = rest[1:]
+			continue
+		}
+		matched := false
+		for _, t := range dateTokens {
+			if strings.HasPrefix(rest, t.token) {
+				layout = append(layout, t.layout)
+				rest = rest[len(t.token):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "", false
+		}
+	}
+	return strings.Join(layout, ""), true
+}
+
+// Route implements Router, returning the fallback index if a placeholder cannot be expanded
+func (t *indexTemplate) Route(entry zapcore.Entry, fields []zapcore.Field) string {
+	var index bytes.Buffer
+	for _, part := range t.parts {
+		var value string
+		switch {
+		case part.literal != "":
+			index.WriteString(part.literal)
+			continue
+		case part.dateLayout != "":
+			if entry.Time.IsZero() {
+				return t.fallback
+			}
+			value = entry.Time.UTC().Format(part.dateLayout)
+		case part.key == loggerPlaceholder:
+			value = entry.LoggerName
+		default:
+			value = fieldValue(fields, part.key)
+		}
+
+		if value = sanitizeIndex(value); value == "" {
+			return t.fallback
+		}
+		index.WriteString(value)
+	}
+	return index.String()
+}
+
+// fieldValue returns the value of the last field of the key formatted using fmt.Sprint,
+// or an empty string if there is none
+func fieldValue(fields []zapcore.Field, key string) string {
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].Key == key {
+			return fmt.Sprint(EncodeFields(zapcore.Entry{}, fields[i:i+1])[key])
+		}
+	}
+	return ""
+}
+
+// sanitizeIndex lowercases the value and replaces all characters which are not allowed in
+// index names by "-"
+func sanitizeIndex(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, value)
+}
+
+// CoreOptionIndexFallback defines the index entries are sent to if a placeholder of the
+// index template cannot be expanded. It is required if the index is a template.
+func CoreOptionIndexFallback(index string) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if isIndexTemplate(index) {
+			return ErrInvalidIndexFallback
+		}
+		cc.indexFallback = index
+		return nil
+	}
+}
+
+// CoreOptionMaxIndexClients defines how many clients for routed or templated indices are kept
+// open, DefaultMaxIndexClients by default. The least recently used clients are closed first.
+func CoreOptionMaxIndexClients(max int) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if max < 1 {
+			return ErrInvalidMaxIndexClients
+		}
+		cc.maxIndexClients = max
+		return nil
+	}
+}
+
+// chainRouters returns a Router trying the supplied routers in order
+func chainRouters(first, second Router) Router {
+	if first == nil {
+		return second
+	}
+	return RouterFunc(func(entry zapcore.Entry, fields []zapcore.Field) string {
+		if index := first.Route(entry, fields); index != "" {
+			return index
+		}
+		return second.Route(entry, fields)
+	})
+}
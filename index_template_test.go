@@ -0,0 +1,200 @@
+package cloudlogzap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type MockBlockingCloudlogClient struct {
+	MockClosableCloudlogClient
+	started chan struct{}
+}
+
+func (client *MockBlockingCloudlogClient) PushEvent(e interface{}) error {
+	client.started <- struct{}{}
+	return client.MockClosableCloudlogClient.PushEvent(e)
+}
+
+func TestParseIndexTemplate(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		template, err := parseIndexTemplate("svc-{tenant}-{yyyy.MM.dd}", "svc-unknown")
+		require.NoError(t, err)
+		assert.EqualValues(t, []indexTemplatePart{
+			{literal: "svc-"},
+			{key: "tenant"},
+			{literal: "-"},
+			{dateLayout: "2006.01.02"},
+		}, template.parts)
+
+		template, err = parseIndexTemplate("{logger}_{yy-MM-dd_HH}", "")
+		require.NoError(t, err)
+		assert.EqualValues(t, []indexTemplatePart{
+			{key: "logger"},
+			{literal: "_"},
+			{dateLayout: "06-01-02_15"},
+		}, template.parts)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for template, expected := range map[string]string{
+			"svc-{tenant":  `Invalid index template "svc-{tenant": unclosed {`,
+			"svc-{a{b}}":   `Invalid index template "svc-{a{b}}": unclosed {`,
+			"svc-}":        `Invalid index template "svc-}": unexpected }`,
+			"svc-{}":       `Invalid index template "svc-{}": empty placeholder`,
+			"svc-{a}}-{b}": `Invalid index template "svc-{a}}-{b}": unexpected }`,
+		} {
+			_, err := parseIndexTemplate(template, "")
+			require.Error(t, err, template)
+			assert.EqualValues(t, expected, err.Error())
+		}
+	})
+}
+
+func TestIndexTemplate_Route(t *testing.T) {
+	template, err := parseIndexTemplate("svc-{tenant}-{yyyy.MM.dd}", "svc-unknown")
+	require.NoError(t, err)
+	now := time.Date(2018, 9, 21, 23, 30, 0, 0, time.FixedZone("CEST", -2*60*60))
+
+	for expected, fields := range map[string][]zapcore.Field{
+		"svc-acme-2018.09.22":      {zap.String("tenant", "acme")},
+		"svc-acme-corp-2018.09.22": {zap.String("tenant", "ACME Corp")},
+		"svc-42-2018.09.22":        {zap.Int("tenant", 42)},
+		"svc-b-2018.09.22":         {zap.String("tenant", "a"), zap.String("tenant", "b")},
+		"svc-unknown":              {zap.String("tenant", "")},
+	} {
+		assert.EqualValues(t, expected, template.Route(zapcore.Entry{Time: now}, fields))
+	}
+	assert.EqualValues(t, "svc-unknown", template.Route(zapcore.Entry{Time: now}, nil))
+	assert.EqualValues(t, "svc-unknown", template.Route(zapcore.Entry{}, []zapcore.Field{zap.String("tenant", "acme")}))
+
+	template, err = parseIndexTemplate("{logger}-logs", "fallback")
+	require.NoError(t, err)
+	assert.EqualValues(t, "api.payments-logs", template.Route(zapcore.Entry{LoggerName: "api.payments"}, nil))
+	assert.EqualValues(t, "fallback", template.Route(zapcore.Entry{}, nil))
+}
+
+func TestRoutingClient_MaxClients(t *testing.T) {
+	t.Run("Evict", func(t *testing.T) {
+		rc, clients := newTestRoutingClient()
+		rc.maxClients = 2
+
+		for _, index := range []string{"a", "b", "a", "c"} {
+			require.NoError(t, rc.PushEvent(routedEvent{index: index, event: index}))
+		}
+		assert.Len(t, rc.clients, 2)
+		assert.False(t, clients["a"].closed)
+		assert.True(t, clients["b"].closed)
+		assert.False(t, clients["c"].closed)
+
+		// Evicted clients are recreated when used again
+		evicted := clients["b"]
+		require.NoError(t, rc.PushEvent(routedEvent{index: "b", event: "b"}))
+		assert.NotEqual(t, evicted, clients["b"])
+		assert.True(t, clients["a"].closed)
+	})
+
+	t.Run("InFlight", func(t *testing.T) {
+		rc, _ := newTestRoutingClient()
+		rc.maxClients = 1
+		slow := &MockBlockingCloudlogClient{started: make(chan struct{})}
+		slow.release = make(chan struct{})
+		rc.clients["slow"] = rc.lru.PushFront(newReadyIndexClient("slow", slow))
+
+		pushed := make(chan error)
+		go func() {
+			pushed <- rc.PushEvent(routedEvent{index: "slow", event: "slow"})
+		}()
+		<-slow.started
+
+		evicted := make(chan error)
+		go func() {
+			evicted <- rc.PushEvent(routedEvent{index: "other", event: "other"})
+		}()
+		select {
+		case <-evicted:
+			t.Fatal("client closed while a push is in flight")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		close(slow.release)
+		require.NoError(t, <-pushed)
+		require.NoError(t, <-evicted)
+		assert.True(t, slow.closed)
+		assert.EqualValues(t, 1, slow.Count())
+	})
+}
+
+func TestNewCloudlogCore_IndexTemplate(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		wrapped, _ := newCertificateTestCore()
+		core, err := NewCloudlogCore(wrapped, "svc-{tenant}-{yyyy.MM.dd}",
+			CoreOptionIndexFallback("svc-unknown"),
+			CoreOptionMaxIndexClients(4),
+		)
+		require.NoError(t, err)
+		assert.EqualValues(t, "svc-unknown", core.cloudLogIndex)
+		require.IsType(t, &routingClient{}, core.client)
+		assert.EqualValues(t, 4, core.client.(*routingClient).maxClients)
+
+		rc, clients := newTestRoutingClient()
+		core.client.(*routingClient).client = rc.client
+		core.client.(*routingClient).create = rc.create
+
+		logger := zap.New(core)
+		logger.With(zap.String("tenant", "acme")).Info("context field")
+		logger.Info("entry field", zap.String("tenant", "acme"))
+		logger.Info("missing")
+
+		today := time.Now().UTC().Format("2006.01.02")
+		require.Contains(t, clients, "svc-acme-"+today)
+		assert.EqualValues(t, 2, clients["svc-acme-"+today].Count())
+		assert.EqualValues(t, 1, clients[""].Count())
+		require.NoError(t, core.Close())
+	})
+
+	t.Run("Routes", func(t *testing.T) {
+		errorLevel := zapcore.ErrorLevel
+		wrapped, _ := newCertificateTestCore()
+		core, err := NewCloudlogCore(wrapped, "svc-{logger}",
+			CoreOptionIndexFallback("svc"),
+			CoreOptionRoutes(Route{Index: "svc-errors", Level: &errorLevel}),
+		)
+		require.NoError(t, err)
+		rc, clients := newTestRoutingClient()
+		core.client.(*routingClient).client = rc.client
+		core.client.(*routingClient).create = rc.create
+
+		logger := zap.New(core).Named("api")
+		logger.Error("error")
+		logger.Info("info")
+		assert.EqualValues(t, 1, clients["svc-errors"].Count())
+		assert.EqualValues(t, 1, clients["svc-api"].Count())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "svc-{tenant}")
+		assert.Nil(t, core)
+		assert.EqualValues(t, []error{ErrIndexFallbackMissing}, flattenErrors(err))
+
+		core, err = NewCloudlogCore(zapcore.NewNopCore(), "svc-{tenant",
+			CoreOptionIndexFallback("svc-{unknown}"),
+			CoreOptionMaxIndexClients(0),
+		)
+		assert.Nil(t, core)
+		errs := flattenErrors(err)
+		require.Len(t, errs, 3)
+		assert.EqualValues(t, ErrInvalidIndexFallback, errs[0])
+		assert.EqualValues(t, ErrInvalidMaxIndexClients, errs[1])
+		assert.Contains(t, errs[2].Error(), "unclosed {")
+
+		core, err = NewCloudlogCoreWithClient(zapcore.NewNopCore(), &MockCloudlogClient{},
+			CoreOptionIndexFallback("svc"))
+		require.NoError(t, err)
+		assert.NotNil(t, core)
+	})
+}
@@ -0,0 +1,168 @@
+package cloudlogzap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LevelHandler is a JSON endpoint in the style of zap.AtomicLevel.ServeHTTP which reports
+// on or changes a zap.AtomicLevel, optionally reverting the change after a TTL.
+//
+// GET requests return a JSON description of the current level. PUT requests change
+// the level and expect a payload like:
+//
+//	{"level":"debug","ttl":"15m"}
+//
+// The ttl is optional and parsed using time.ParseDuration. Once it has expired the level
+// is reverted to the level that was set before the first temporary change. A PUT request
+// without ttl makes the new level permanent.
+type LevelHandler struct {
+	level zap.AtomicLevel
+
+	mutex       sync.Mutex
+	timer       *time.Timer
+	revertLevel zapcore.Level
+	revertAt    time.Time
+}
+
+var _ http.Handler = (*LevelHandler)(nil)
+
+// NewLevelHandler returns a new LevelHandler for the supplied level
+func NewLevelHandler(level zap.AtomicLevel) *LevelHandler {
+	return &LevelHandler{
+		level: level,
+	}
+}
+
+type levelPayload struct {
+	Level    *zapcore.Level `json:"level"`
+	TTL      string         `json:"ttl,omitempty"`
+	RevertTo *zapcore.Level `json:"revert_to,omitempty"`
+	RevertAt *time.Time     `json:"revert_at,omitempty"`
+}
+
+// ServeHTTP implements http.Handler
+func (h *LevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	type errorResponse struct {
+		Error string `json:"error"`
+	}
+
+	enc := json.NewEncoder(w)
+
+	switch r.Method {
+
+	case http.MethodGet:
+		enc.Encode(h.payload())
+
+	case http.MethodPut:
+		var req levelPayload
+		var ttl time.Duration
+
+		if errmess := func() string {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				return fmt.Sprintf("Request body must be well-formed JSON: %v", err)
+			}
+			if req.Level == nil {
+				return "Must specify a logging level."
+			}
+			if req.TTL != "" {
+				var err error
+				if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+					return "TTL must be a positive duration."
+				}
+			}
+			return ""
+		}(); errmess != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(errorResponse{Error: errmess})
+			return
+		}
+
+		h.SetLevel(*req.Level, ttl)
+		enc.Encode(h.payload())
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		enc.Encode(errorResponse{
+			Error: "Only GET and PUT are supported.",
+		})
+	}
+}
+
+// SetLevel changes the level. A positive ttl reverts the change once it has expired.
+func (h *LevelHandler) SetLevel(level zapcore.Level, ttl time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	} else if ttl > 0 {
+		h.revertLevel = h.level.Level()
+	}
+	h.level.SetLevel(level)
+
+	if ttl <= 0 {
+		return
+	}
+
+	h.revertAt = time.Now().Add(ttl)
+	var timer *time.Timer
+	timer = time.AfterFunc(ttl, func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		// The timer might have been replaced in the meantime
+		if h.timer == timer {
+			h.level.SetLevel(h.revertLevel)
+			h.timer = nil
+		}
+	})
+	h.timer = timer
+}
+
+func (h *LevelHandler) payload() levelPayload {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	current := h.level.Level()
+	p := levelPayload{Level: &current}
+	if h.timer != nil {
+		revertTo, revertAt := h.revertLevel, h.revertAt
+		p.RevertTo = &revertTo
+		p.RevertAt = &revertAt
+	}
+	return p
+}
+
+// AtomicLevel returns the zap.AtomicLevel deciding which entries are sent to CloudLog.
+// If the core's level enabler is not a zap.AtomicLevel, it is replaced by an AtomicLevel
+// set to the lowest level that is currently enabled.
+// AtomicLevel has to be called before the core is used or cloned using With.
+func (cc *CloudLogCore) AtomicLevel() zap.AtomicLevel {
+	if level, ok := cc.levelEnabler.(zap.AtomicLevel); ok {
+		return level
+	}
+
+	lowest := zapcore.FatalLevel + 1
+	for l := zapcore.DebugLevel; l <= zapcore.FatalLevel; l++ {
+		if cc.levelEnabled(l) {
+			lowest = l
+			break
+		}
+	}
+	level := zap.NewAtomicLevelAt(lowest)
+	cc.levelEnabler = level
+	return level
+}
+
+// LevelHandler returns a LevelHandler for the core's AtomicLevel, which changes the
+// level of entries sent to CloudLog independently of the wrapped core's level
+func (cc *CloudLogCore) LevelHandler() *LevelHandler {
+	return NewLevelHandler(cc.AtomicLevel())
+}
@@ -0,0 +1,127 @@
+package cloudlogzap
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func serveLevel(t *testing.T, h http.Handler, method, body string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, "/", strings.NewReader(body)))
+	var response map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return w.Code, response
+}
+
+func TestLevelHandler_ServeHTTP(t *testing.T) {
+	t.Run("Get", func(t *testing.T) {
+		h := NewLevelHandler(zap.NewAtomicLevelAt(zapcore.WarnLevel))
+		code, response := serveLevel(t, h, http.MethodGet, "")
+		assert.EqualValues(t, http.StatusOK, code)
+		assert.EqualValues(t, map[string]interface{}{"level": "warn"}, response)
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		level := zap.NewAtomicLevelAt(zapcore.WarnLevel)
+		h := NewLevelHandler(level)
+		code, response := serveLevel(t, h, http.MethodPut, `{"level":"debug"}`)
+		assert.EqualValues(t, http.StatusOK, code)
+		assert.EqualValues(t, map[string]interface{}{"level": "debug"}, response)
+		assert.EqualValues(t, zapcore.DebugLevel, level.Level())
+	})
+
+	t.Run("PutTTL", func(t *testing.T) {
+		level := zap.NewAtomicLevelAt(zapcore.WarnLevel)
+		h := NewLevelHandler(level)
+		code, response := serveLevel(t, h, http.MethodPut, `{"level":"debug","ttl":"50ms"}`)
+		assert.EqualValues(t, http.StatusOK, code)
+		assert.EqualValues(t, "debug", response["level"])
+		assert.EqualValues(t, "warn", response["revert_to"])
+		assert.Contains(t, response, "revert_at")
+		assert.EqualValues(t, zapcore.DebugLevel, level.Level())
+
+		// A second temporary change keeps the original level to revert to
+		_, response = serveLevel(t, h, http.MethodPut, `{"level":"info","ttl":"50ms"}`)
+		assert.EqualValues(t, "warn", response["revert_to"])
+
+		waitFor(t, func() bool { return level.Level() == zapcore.WarnLevel })
+		_, response = serveLevel(t, h, http.MethodGet, "")
+		assert.EqualValues(t, map[string]interface{}{"level": "warn"}, response)
+	})
+
+	t.Run("PutPermanent", func(t *testing.T) {
+		level := zap.NewAtomicLevelAt(zapcore.WarnLevel)
+		h := NewLevelHandler(level)
+		serveLevel(t, h, http.MethodPut, `{"level":"debug","ttl":"20ms"}`)
+		serveLevel(t, h, http.MethodPut, `{"level":"info"}`)
+
+		time.Sleep(50 * time.Millisecond)
+		assert.EqualValues(t, zapcore.InfoLevel, level.Level())
+	})
+
+	t.Run("BadRequest", func(t *testing.T) {
+		h := NewLevelHandler(zap.NewAtomicLevel())
+		for _, body := range []string{`{`, `{}`, `{"level":"debug","ttl":"soon"}`, `{"level":"debug","ttl":"-1s"}`} {
+			code, response := serveLevel(t, h, http.MethodPut, body)
+			assert.EqualValues(t, http.StatusBadRequest, code, body)
+			assert.Contains(t, response, "error")
+		}
+	})
+
+	t.Run("MethodNotAllowed", func(t *testing.T) {
+		h := NewLevelHandler(zap.NewAtomicLevel())
+		code, _ := serveLevel(t, h, http.MethodPost, "")
+		assert.EqualValues(t, http.StatusMethodNotAllowed, code)
+	})
+}
+
+func TestCloudLogCore_AtomicLevel(t *testing.T) {
+	t.Run("Created", func(t *testing.T) {
+		wrapped := zapcore.NewCore(zapcore.NewJSONEncoder(zapcore.EncoderConfig{}), zapcore.AddSync(nil), zapcore.InfoLevel)
+		core, err := NewCloudlogCore(wrapped, "testindex")
+		require.NoError(t, err)
+
+		level := core.AtomicLevel()
+		assert.EqualValues(t, zapcore.InfoLevel, level.Level())
+		level.SetLevel(zapcore.ErrorLevel)
+		assert.False(t, core.Enabled(zapcore.WarnLevel))
+		assert.True(t, wrapped.Enabled(zapcore.WarnLevel))
+
+		assert.EqualValues(t, level, core.AtomicLevel())
+	})
+
+	t.Run("Supplied", func(t *testing.T) {
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+		require.NoError(t, err)
+		level := zap.NewAtomicLevelAt(zapcore.DebugLevel)
+		core.SetLevelEnabler(level)
+		assert.EqualValues(t, level, core.AtomicLevel())
+	})
+
+	t.Run("NothingEnabled", func(t *testing.T) {
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+		require.NoError(t, err)
+		level := core.AtomicLevel()
+		assert.False(t, level.Enabled(zapcore.FatalLevel))
+	})
+
+	t.Run("Handler", func(t *testing.T) {
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+		require.NoError(t, err)
+		core.SetLevelEnabler(zap.NewAtomicLevelAt(zapcore.ErrorLevel))
+
+		serveLevel(t, core.LevelHandler(), http.MethodPut, `{"level":"debug"}`)
+		assert.True(t, core.Enabled(zapcore.DebugLevel))
+		child := core.With(nil)
+		assert.True(t, child.Enabled(zapcore.DebugLevel))
+	})
+}
@@ -0,0 +1,196 @@
+package cloudlogzap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// NameLevels overrides the minimum level of entries sent to CloudLog per logger name prefix.
+// A prefix matches a logger name if it is equal to the name or to one of its leading
+// dot-separated segments, so "http" matches "http" and "http.access" but not "https".
+// If multiple prefixes match, the longest one wins. The empty prefix defines the default
+// for logger names not matching any other prefix; without it those entries are decided
+// by the core's level enabler.
+//
+// NameLevels is safe for concurrent use and may be updated while the core is in use.
+type NameLevels struct {
+	// mutex serializes updates, readers only use the atomic value
+	mutex sync.Mutex
+	rules atomic.Value
+}
+
+type nameLevelRule struct {
+	prefix string
+	level  zapcore.Level
+}
+
+// nameLevelRules is sorted by descending prefix length
+type nameLevelRules []nameLevelRule
+
+// NewNameLevels returns a new NameLevels using the supplied prefix to level mapping
+func NewNameLevels(levels map[string]zapcore.Level) *NameLevels {
+	n := &NameLevels{}
+	n.Replace(levels)
+	return n
+}
+
+// ParseNameLevels parses a comma-separated list of prefix=level pairs like
+// "db=warn,http.access=info". An entry consisting of only a level defines the default.
+func ParseNameLevels(spec string) (*NameLevels, error) {
+	levels := make(map[string]zapcore.Level)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var prefix, text string
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			prefix, text = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+			if prefix == "" {
+				return nil, fmt.Errorf("Logger name prefix missing in %q", entry)
+			}
+		} else {
+			text = entry
+		}
+
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(text)); err != nil {
+			return nil, fmt.Errorf("Invalid level in %q: %v", entry, err)
+		}
+		if _, ok := levels[prefix]; ok {
+			return nil, fmt.Errorf("Duplicate logger name prefix in %q", entry)
+		}
+		levels[prefix] = level
+	}
+	return NewNameLevels(levels), nil
+}
+
+// Replace replaces all prefixes with the supplied mapping
+func (n *NameLevels) Replace(levels map[string]zapcore.Level) {
+	rules := make(nameLevelRules, 0, len(levels))
+	for prefix, level := range levels {
+		rules = append(rules, nameLevelRule{prefix: prefix, level: level})
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.store(rules)
+}
+
+// Set sets the minimum level for the supplied prefix
+func (n *NameLevels) Set(prefix string, level zapcore.Level) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	rules := append(nameLevelRules(nil), n.load()...)
+	for i := range rules {
+		if rules[i].prefix == prefix {
+			rules[i].level = level
+			n.store(rules)
+			return
+		}
+	}
+	n.store(append(rules, nameLevelRule{prefix: prefix, level: level}))
+}
+
+// Unset removes the supplied prefix
+func (n *NameLevels) Unset(prefix string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	rules := make(nameLevelRules, 0, len(n.load()))
+	for _, rule := range n.load() {
+		if rule.prefix != prefix {
+			rules = append(rules, rule)
+		}
+	}
+	n.store(rules)
+}
+
+// Levels returns a copy of the current prefix to level mapping
+func (n *NameLevels) Levels() map[string]zapcore.Level {
+	rules := n.load()
+	levels := make(map[string]zapcore.Level, len(rules))
+	for _, rule := range rules {
+		levels[rule.prefix] = rule.level
+	}
+	return levels
+}
+
+// String returns the mapping in the format understood by ParseNameLevels
+func (n *NameLevels) String() string {
+	rules := n.load()
+	entries := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		if rule.prefix == "" {
+			entries = append(entries, rule.level.String())
+		} else {
+			entries = append(entries, rule.prefix+"="+rule.level.String())
+		}
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// Level returns the minimum level for the supplied logger name and whether any prefix matched
+func (n *NameLevels) Level(name string) (zapcore.Level, bool) {
+	for _, rule := range n.load() {
+		if matchesNamePrefix(name, rule.prefix) {
+			return rule.level, true
+		}
+	}
+	return zapcore.DebugLevel, false
+}
+
+// anyEnabled returns whether the level is enabled for any prefix
+func (n *NameLevels) anyEnabled(level zapcore.Level) bool {
+	for _, rule := range n.load() {
+		if rule.level.Enabled(level) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesNamePrefix(name, prefix string) bool {
+	if prefix == "" || name == prefix {
+		return true
+	}
+	return strings.HasPrefix(name, prefix) && name[len(prefix)] == '.'
+}
+
+func (n *NameLevels) load() nameLevelRules {
+	rules, _ := n.rules.Load().(nameLevelRules)
+	return rules
+}
+
+// store sorts and publishes the rules. Callers must hold the mutex.
+func (n *NameLevels) store(rules nameLevelRules) {
+	sort.Slice(rules, func(i, j int) bool {
+		return len(rules[i].prefix) > len(rules[j].prefix)
+	})
+	n.rules.Store(rules)
+}
+
+// SetNameLevels configures per logger name overrides of the level of entries sent to CloudLog.
+// Entries whose logger name does not match any prefix are decided by the core's level enabler.
+// SetNameLevels has to be called before the core is used or cloned using With.
+func (cc *CloudLogCore) SetNameLevels(levels *NameLevels) {
+	cc.nameLevels = levels
+}
+
+// enabledFor decides whether an entry of the supplied logger name and level is sent to CloudLog
+func (cc *CloudLogCore) enabledFor(name string, level zapcore.Level) bool {
+	if cc.nameLevels != nil {
+		if minLevel, ok := cc.nameLevels.Level(name); ok {
+			return minLevel.Enabled(level)
+		}
+	}
+	return cc.levelEnabled(level)
+}
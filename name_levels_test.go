@@ -0,0 +1,128 @@
+package cloudlogzap
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestParseNameLevels(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		n, err := ParseNameLevels(" db=warn, http.access=info ,error,")
+		require.NoError(t, err)
+		assert.EqualValues(t, map[string]zapcore.Level{
+			"db":          zapcore.WarnLevel,
+			"http.access": zapcore.InfoLevel,
+			"":            zapcore.ErrorLevel,
+		}, n.Levels())
+		assert.EqualValues(t, "db=warn,error,http.access=info", n.String())
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		n, err := ParseNameLevels("")
+		require.NoError(t, err)
+		assert.Empty(t, n.Levels())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, spec := range []string{"=warn", "db=loud", "db=warn,db=info", "error,warn"} {
+			n, err := ParseNameLevels(spec)
+			assert.Error(t, err, spec)
+			assert.Nil(t, n)
+		}
+	})
+}
+
+func TestNameLevels_Level(t *testing.T) {
+	n := NewNameLevels(map[string]zapcore.Level{
+		"db":          zapcore.WarnLevel,
+		"http.access": zapcore.InfoLevel,
+		"":            zapcore.ErrorLevel,
+	})
+
+	for name, expected := range map[string]zapcore.Level{
+		"db":             zapcore.WarnLevel,
+		"db.pool":        zapcore.WarnLevel,
+		"dbx":            zapcore.ErrorLevel,
+		"http":           zapcore.ErrorLevel,
+		"http.access":    zapcore.InfoLevel,
+		"http.access.v2": zapcore.InfoLevel,
+		"":               zapcore.ErrorLevel,
+	} {
+		level, ok := n.Level(name)
+		assert.True(t, ok, name)
+		assert.EqualValues(t, expected, level, name)
+	}
+
+	n.Unset("")
+	_, ok := n.Level("http")
+	assert.False(t, ok)
+
+	n.Set("http", zapcore.DebugLevel)
+	level, _ := n.Level("http.client")
+	assert.EqualValues(t, zapcore.DebugLevel, level)
+	n.Set("http", zapcore.WarnLevel)
+	level, _ = n.Level("http.client")
+	assert.EqualValues(t, zapcore.WarnLevel, level)
+
+	n.Replace(nil)
+	assert.Empty(t, n.Levels())
+}
+
+func TestCloudLogCore_SetNameLevels(t *testing.T) {
+	wrapped := zapcore.NewCore(
+		zapcore.NewJSONEncoder(zapcore.EncoderConfig{}), zapcore.AddSync(ioutil.Discard), zapcore.DebugLevel)
+	core, err := NewCloudlogCore(wrapped, "testindex")
+	require.NoError(t, err)
+	client := &MockCloudlogClient{}
+	core.client = client
+
+	t.Run("Default", func(t *testing.T) {
+		client.events = nil
+		n, err := ParseNameLevels("db=warn,http.access=info,error")
+		require.NoError(t, err)
+		core.SetNameLevels(n)
+		logger := zap.New(zapcore.NewTee(wrapped, core))
+
+		logger.Named("db").Info("db info")
+		logger.Named("db").Warn("db warn")
+		logger.Named("http").Named("access").Info("access info")
+		logger.Named("http").Warn("http warn")
+		logger.Error("root error")
+
+		messages := make([]string, 0, len(client.events))
+		for _, event := range client.events {
+			messages = append(messages, event.(document).Message)
+		}
+		assert.EqualValues(t, []string{"db warn", "access info", "root error"}, messages)
+
+		// Updates apply to existing loggers
+		client.events = nil
+		n.Set("db", zapcore.DebugLevel)
+		logger.Named("db").Debug("db debug")
+		assert.Len(t, client.events, 1)
+	})
+
+	t.Run("FallbackToLevelEnabler", func(t *testing.T) {
+		client.events = nil
+		core.SetLevelEnabler(zapcore.ErrorLevel)
+		core.SetNameLevels(NewNameLevels(map[string]zapcore.Level{"db": zapcore.DebugLevel}))
+		assert.True(t, core.Enabled(zapcore.DebugLevel))
+
+		logger := zap.New(zapcore.NewTee(wrapped, core)).Sugar()
+		logger.Named("db").Debug("db debug")
+		logger.Named("http").Warn("http warn")
+		logger.Named("http").Error("http error")
+
+		require.Len(t, client.events, 2)
+		assert.EqualValues(t, "db debug", client.events[0].(document).Message)
+		assert.EqualValues(t, "http error", client.events[1].(document).Message)
+
+		core.SetNameLevels(nil)
+		assert.False(t, core.Enabled(zapcore.DebugLevel))
+	})
+}
@@ -0,0 +1,72 @@
+package cloudlogzap
+
+import (
+	"go.uber.org/zap/zapcore"
+)
+
+// OverflowAction defines what happens to an event which cannot be enqueued because the
+// asynchronous queue is full
+type OverflowAction int
+
+const (
+	// OverflowBlock blocks the caller until the event can be enqueued
+	OverflowBlock OverflowAction = iota
+	// OverflowDropNewest drops the event that is about to be enqueued
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest queued event to make room for the new one
+	OverflowDropOldest
+	// OverflowDropBelowLevel drops the event that is about to be enqueued because its level
+	// is below the level which is always kept
+	OverflowDropBelowLevel
+)
+
+// OverflowPolicy decides what happens when an event cannot be enqueued because the
+// asynchronous queue is full
+type OverflowPolicy interface {
+	// Overflow returns the action to take for an event of the given level
+	Overflow(level zapcore.Level) OverflowAction
+}
+
+// OverflowPolicyFunc allows a plain function to be used as an OverflowPolicy
+type OverflowPolicyFunc func(level zapcore.Level) OverflowAction
+
+// Overflow calls f(level)
+func (f OverflowPolicyFunc) Overflow(level zapcore.Level) OverflowAction {
+	return f(level)
+}
+
+// staticOverflowPolicy returns the same action regardless of the level
+type staticOverflowPolicy OverflowAction
+
+func (p staticOverflowPolicy) Overflow(zapcore.Level) OverflowAction {
+	return OverflowAction(p)
+}
+
+var (
+	// OverflowPolicyBlock blocks the caller until there is room in the queue
+	OverflowPolicyBlock OverflowPolicy = staticOverflowPolicy(OverflowBlock)
+
+	// OverflowPolicyDropNewest drops events which do not fit into the queue
+	OverflowPolicyDropNewest OverflowPolicy = staticOverflowPolicy(OverflowDropNewest)
+
+	// OverflowPolicyDropOldest drops the oldest queued events to make room for new ones
+	OverflowPolicyDropOldest OverflowPolicy = staticOverflowPolicy(OverflowDropOldest)
+)
+
+// NewOverflowPolicyDropBelowLevel returns an OverflowPolicy which drops events below the
+// supplied level and blocks the caller for events at or above it
+func NewOverflowPolicyDropBelowLevel(keep zapcore.Level) OverflowPolicy {
+	return OverflowPolicyFunc(func(level zapcore.Level) OverflowAction {
+		if level < keep {
+			return OverflowDropBelowLevel
+		}
+		return OverflowBlock
+	})
+}
+
+// OverflowCounters contains the number of events dropped by each kind of overflow action
+type OverflowCounters struct {
+	DroppedNewest     uint64
+	DroppedOldest     uint64
+	DroppedBelowLevel uint64
+}
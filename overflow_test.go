@@ -0,0 +1,139 @@
+package cloudlogzap
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+// newOverflowTestCore returns a core whose single worker is blocked pushing the first event
+// and whose queue of capacity two is full
+func newOverflowTestCore(t *testing.T, policy OverflowPolicy) (*CloudLogCore, *MockBatchCloudlogClient) {
+	client := &MockBatchCloudlogClient{release: make(chan struct{})}
+	core := newAsyncTestCore(t, client,
+		AsyncOptionQueueCapacity(2),
+		AsyncOptionBatchSize(1),
+		AsyncOptionOverflowPolicy(policy))
+
+	require.NoError(t, core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: "0"}, nil))
+	deadline := time.Now().Add(time.Second)
+	for len(core.async.queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	require.Len(t, core.async.queue, 0)
+
+	for i := 1; i <= 2; i++ {
+		require.NoError(t, core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: strconv.Itoa(i)}, nil))
+	}
+	return core, client
+}
+
+func deliveredMessages(client *MockBatchCloudlogClient) (messages []string) {
+	for _, batch := range client.Batches() {
+		for _, event := range batch {
+			messages = append(messages, event.(document).Message)
+		}
+	}
+	return
+}
+
+func TestAsyncOptionOverflowPolicy(t *testing.T) {
+	_, err := newAsyncConfig(AsyncOptionOverflowPolicy(nil))
+	require.Error(t, err)
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	t.Run("DropNewest", func(t *testing.T) {
+		core, client := newOverflowTestCore(t, OverflowPolicyDropNewest)
+		defer core.async.shutdown()
+
+		for i := 3; i <= 5; i++ {
+			require.NoError(t, core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: strconv.Itoa(i)}, nil))
+		}
+		assert.EqualValues(t, OverflowCounters{DroppedNewest: 3}, core.OverflowCounters())
+
+		close(client.release)
+		require.NoError(t, core.Sync())
+		assert.EqualValues(t, []string{"0", "1", "2"}, deliveredMessages(client))
+	})
+
+	t.Run("DropOldest", func(t *testing.T) {
+		core, client := newOverflowTestCore(t, OverflowPolicyDropOldest)
+		defer core.async.shutdown()
+
+		for i := 3; i <= 5; i++ {
+			require.NoError(t, core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: strconv.Itoa(i)}, nil))
+		}
+		assert.EqualValues(t, OverflowCounters{DroppedOldest: 3}, core.OverflowCounters())
+
+		close(client.release)
+		require.NoError(t, core.Sync())
+		assert.EqualValues(t, []string{"0", "4", "5"}, deliveredMessages(client))
+	})
+
+	t.Run("DropBelowLevel", func(t *testing.T) {
+		core, client := newOverflowTestCore(t, NewOverflowPolicyDropBelowLevel(zapcore.WarnLevel))
+		defer core.async.shutdown()
+
+		require.NoError(t, core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: "3"}, nil))
+		require.NoError(t, core.Write(zapcore.Entry{Level: zapcore.DebugLevel, Message: "4"}, nil))
+		assert.EqualValues(t, OverflowCounters{DroppedBelowLevel: 2}, core.OverflowCounters())
+
+		written := make(chan struct{})
+		go func() {
+			core.Write(zapcore.Entry{Level: zapcore.WarnLevel, Message: "5"}, nil)
+			close(written)
+		}()
+		select {
+		case <-written:
+			t.Fatal("Write of a warning did not block")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(client.release)
+		<-written
+		require.NoError(t, core.Sync())
+		assert.EqualValues(t, []string{"0", "1", "2", "5"}, deliveredMessages(client))
+		assert.EqualValues(t, OverflowCounters{DroppedBelowLevel: 2}, core.OverflowCounters())
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		core, client := newOverflowTestCore(t, OverflowPolicyBlock)
+		defer core.async.shutdown()
+
+		written := make(chan struct{})
+		go func() {
+			core.Write(zapcore.Entry{Level: zapcore.DebugLevel, Message: "3"}, nil)
+			close(written)
+		}()
+		select {
+		case <-written:
+			t.Fatal("Write did not block")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(client.release)
+		<-written
+		require.NoError(t, core.Sync())
+		assert.EqualValues(t, []string{"0", "1", "2", "3"}, deliveredMessages(client))
+		assert.EqualValues(t, OverflowCounters{}, core.OverflowCounters())
+	})
+
+	t.Run("Func", func(t *testing.T) {
+		var levels []zapcore.Level
+		policy := OverflowPolicyFunc(func(level zapcore.Level) OverflowAction {
+			levels = append(levels, level)
+			return OverflowDropNewest
+		})
+		core, client := newOverflowTestCore(t, policy)
+		defer core.async.shutdown()
+
+		require.NoError(t, core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "3"}, nil))
+		assert.EqualValues(t, []zapcore.Level{zapcore.ErrorLevel}, levels)
+		close(client.release)
+	})
+}
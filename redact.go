@@ -0,0 +1,161 @@
+package cloudlogzap
+
+import (
+	"regexp"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+	"go.uber.org/zap/zapcore"
+)
+
+// DefaultRedactionReplacement replaces redacted values unless a rule defines its own replacement
+const DefaultRedactionReplacement = "[REDACTED]"
+
+// RedactionRule defines values which are replaced before entries are sent to CloudLog
+type RedactionRule struct {
+	// Fields lists the keys of fields whose values are replaced entirely, at any depth
+	Fields []string `json:"fields" yaml:"fields"`
+	// Pattern is a regular expression whose matches are replaced in the message and all
+	// string values of the fields, at any depth
+	Pattern string `json:"pattern" yaml:"pattern"`
+	// Replacement replaces redacted values, DefaultRedactionReplacement by default
+	Replacement string `json:"replacement" yaml:"replacement"`
+}
+
+type redactionRule struct {
+	fields      map[string]struct{}
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+type redactingConverter struct {
+	next    Converter
+	rules   []redactionRule
+	encoder cloudlog.EventEncoder
+}
+
+// NewRedactingConverter returns a Converter applying the supplied rules to the events converted
+// by next. A nil Converter is replaced by DefaultConverter. The rules are applied to the encoded
+// fields, so values nested in objects, arrays, namespaces and reflected values are redacted as well.
+func NewRedactingConverter(next Converter, rules ...RedactionRule) (Converter, error) {
+	if next == nil {
+		next = DefaultConverter
+	}
+	c := &redactingConverter{next: next, encoder: cloudlog.NewAutomaticEventEncoder()}
+
+	var err error
+	for _, rule := range rules {
+		if len(rule.Fields) == 0 && rule.Pattern == "" {
+			err = multierror.Append(err, ErrInvalidRedactionRule)
+			continue
+		}
+
+		r := redactionRule{
+			fields:      make(map[string]struct{}, len(rule.Fields)),
+			replacement: rule.Replacement,
+		}
+		if r.replacement == "" {
+			r.replacement = DefaultRedactionReplacement
+		}
+		for _, key := range rule.Fields {
+			r.fields[key] = struct{}{}
+		}
+		if rule.Pattern != "" {
+			var compileErr error
+			if r.pattern, compileErr = regexp.Compile(rule.Pattern); compileErr != nil {
+				err = multierror.Append(err, compileErr)
+				continue
+			}
+		}
+		c.rules = append(c.rules, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Convert implements Converter
+func (c *redactingConverter) Convert(entry zapcore.Entry, ff []zapcore.Field) interface{} {
+	switch event := c.next.Convert(entry, ff).(type) {
+	case document:
+		event.Message = c.redactString(event.Message)
+		event.Fields = c.redactMap(event.Fields)
+		return event
+	case map[string]interface{}:
+		return c.redactMap(event)
+	case string:
+		return c.redactString(event)
+	default:
+		eventMap, err := c.encoder.EncodeEvent(event)
+		if err != nil {
+			// Pushing the event reports the error
+			return event
+		}
+		return c.redactMap(eventMap)
+	}
+}
+
+// redactMap returns a redacted copy of the map, which may be shared with the Converter
+func (c *redactingConverter) redactMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	redacted := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		redacted[key] = c.redactValue(key, value)
+	}
+	return redacted
+}
+
+// redactValue returns the redacted value of the supplied key
+func (c *redactingConverter) redactValue(key string, value interface{}) interface{} {
+	for _, rule := range c.rules {
+		if _, ok := rule.fields[key]; ok {
+			return rule.replacement
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return c.redactString(v)
+	case error:
+		return c.redactString(v.Error())
+	case map[string]interface{}:
+		return c.redactMap(v)
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, elem := range v {
+			redacted[i] = c.redactValue("", elem)
+		}
+		return redacted
+	}
+	return value
+}
+
+// redactString replaces the matches of all patterns
+func (c *redactingConverter) redactString(value string) string {
+	for _, rule := range c.rules {
+		if rule.pattern != nil {
+			value = rule.pattern.ReplaceAllString(value, rule.replacement)
+		}
+	}
+	return value
+}
+
+// CoreOptionRedaction applies the supplied rules to the events sent to CloudLog, see
+// NewRedactingConverter. It wraps the Converter configured by preceding options.
+func CoreOptionRedaction(rules ...RedactionRule) CoreOption {
+	return func(cc *CloudLogCore) error {
+		next := cc.converter
+		if next == nil {
+			next = NewDocumentConverter(cc.timestampPrecision)
+		}
+		converter, err := NewRedactingConverter(next, rules...)
+		if err != nil {
+			return err
+		}
+		cc.SetConverter(converter)
+		return nil
+	}
+}
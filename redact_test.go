@@ -0,0 +1,152 @@
+package cloudlogzap
+
+import (
+	"errors"
+	"testing"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type redactionStringer string
+
+func (s redactionStringer) String() string {
+	return string(s)
+}
+
+func TestNewRedactingConverter(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		converter, err := NewRedactingConverter(ConverterFunc(func(entry zapcore.Entry, ff []zapcore.Field) interface{} {
+			fields := EncodeFields(entry, ff)
+			fields["message"] = entry.Message
+			return fields
+		}),
+			RedactionRule{Fields: []string{"password", "token"}},
+			RedactionRule{Pattern: `\d{4}-\d{4}-\d{4}-\d{4}`, Replacement: "****"},
+		)
+		require.NoError(t, err)
+
+		ff := []zapcore.Field{
+			zap.String("user", "alice"),
+			zap.String("password", "secret"),
+			zap.Int("token", 42),
+			zap.String("card", "card 1234-5678-9012-3456"),
+			zap.Error(errors.New("invalid card 1234-5678-9012-3456")),
+		}
+		event := converter.Convert(zapcore.Entry{Message: "charging 1234-5678-9012-3456"}, ff)
+		assert.EqualValues(t, map[string]interface{}{
+			"message":  "charging ****",
+			"user":     "alice",
+			"password": DefaultRedactionReplacement,
+			"token":    DefaultRedactionReplacement,
+			"card":     "card ****",
+			"error":    "invalid card ****",
+		}, event)
+
+		// The fields shared with the wrapped core are left untouched
+		assert.EqualValues(t, "secret", ff[1].String)
+	})
+
+	t.Run("Nested", func(t *testing.T) {
+		converter, err := NewRedactingConverter(nil,
+			RedactionRule{Fields: []string{"password", "token"}},
+			RedactionRule{Pattern: `\d{4}-\d{4}-\d{4}-\d{4}`, Replacement: "****"},
+		)
+		require.NoError(t, err)
+
+		card := "card 1234-5678-9012-3456"
+		event := converter.Convert(zapcore.Entry{Message: "test message"}, []zapcore.Field{
+			zap.Object("user", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+				enc.AddString("name", "alice")
+				enc.AddString("password", "secret")
+				return nil
+			})),
+			zap.Any("credentials", map[string]string{"token": "abc", "user": "bob"}),
+			zap.Reflect("login", struct {
+				Password string `json:"password"`
+				Card     string `json:"card"`
+			}{"secret", card}),
+			zap.ByteString("bytes", []byte(card)),
+			zap.Stringer("stringer", redactionStringer(card)),
+			zap.Strings("cards", []string{card}),
+			zap.Errors("errors", []error{errors.New(card)}),
+			zap.Namespace("request"),
+			zap.String("password", "secret"),
+		})
+		require.IsType(t, document{}, event)
+		assert.EqualValues(t, map[string]interface{}{
+			"user":        map[string]interface{}{"name": "alice", "password": DefaultRedactionReplacement},
+			"credentials": map[string]interface{}{"token": DefaultRedactionReplacement, "user": "bob"},
+			"login":       map[string]interface{}{"password": DefaultRedactionReplacement, "card": "card ****"},
+			"bytes":       "card ****",
+			"stringer":    "card ****",
+			"cards":       []interface{}{"card ****"},
+			"errors":      []interface{}{map[string]interface{}{"error": "card ****"}},
+			"request":     map[string]interface{}{"password": DefaultRedactionReplacement},
+		}, event.(document).Fields)
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		shared := map[string]interface{}{"password": "secret", "message": "a secret"}
+		converter, err := NewRedactingConverter(ConverterFunc(func(entry zapcore.Entry, ff []zapcore.Field) interface{} {
+			switch entry.Message {
+			case "map":
+				return shared
+			case "struct":
+				return struct {
+					Message string `cloudlog:"message"`
+				}{"a secret"}
+			}
+			return entry.Message
+		}), RedactionRule{Fields: []string{"password"}}, RedactionRule{Pattern: "secret"})
+		require.NoError(t, err)
+
+		assert.EqualValues(t, map[string]interface{}{
+			"password": DefaultRedactionReplacement,
+			"message":  "a [REDACTED]",
+		}, converter.Convert(zapcore.Entry{Message: "map"}, nil))
+		assert.EqualValues(t, map[string]interface{}{"message": "a [REDACTED]"},
+			converter.Convert(zapcore.Entry{Message: "struct"}, nil))
+		assert.EqualValues(t, "no [REDACTED]", converter.Convert(zapcore.Entry{Message: "no secret"}, nil))
+
+		// Maps returned by the Converter are left untouched
+		assert.EqualValues(t, "secret", shared["password"])
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		converter, err := NewRedactingConverter(nil, RedactionRule{Fields: []string{"password"}})
+		require.NoError(t, err)
+		event := converter.Convert(zapcore.Entry{Message: "test message"}, []zapcore.Field{zap.String("password", "secret")})
+		require.IsType(t, document{}, event)
+		assert.EqualValues(t, map[string]interface{}{"password": DefaultRedactionReplacement}, event.(document).Fields)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		converter, err := NewRedactingConverter(nil, RedactionRule{}, RedactionRule{Pattern: "("})
+		assert.Nil(t, converter)
+		require.IsType(t, &multierror.Error{}, err)
+		errs := flattenErrors(err)
+		require.Len(t, errs, 2)
+		assert.EqualValues(t, ErrInvalidRedactionRule, errs[0])
+		assert.Contains(t, errs[1].Error(), "missing closing )")
+	})
+}
+
+func TestCoreOptionRedaction(t *testing.T) {
+	client := &MockCloudlogClient{}
+	core, err := NewCloudlogCoreWithClient(zapcore.NewNopCore(), client,
+		CoreOptionTimestampPrecision(TimestampNanosecond),
+		CoreOptionRedaction(RedactionRule{Pattern: "secret"}),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: "the secret is out"}, nil))
+	require.Len(t, client.events, 1)
+	assert.EqualValues(t, "the [REDACTED] is out", client.events[0].(document).Message)
+
+	_, err = NewCloudlogCoreWithClient(zapcore.NewNopCore(), client, CoreOptionRedaction(RedactionRule{}))
+	assert.EqualValues(t, []error{ErrInvalidRedactionRule}, flattenErrors(err))
+}
@@ -0,0 +1,213 @@
+package cloudlogzap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCertificateReloadInterval defines the default interval in which certificate files are checked for changes
+const DefaultCertificateReloadInterval = time.Minute
+
+// reloadingClient is a CloudlogClient whose underlying client can be swapped while events are pushed
+type reloadingClient struct {
+	mutex  sync.RWMutex
+	client CloudlogClient
+	// retired is the number of retries of the clients which have been swapped out
+	retired uint64
+}
+
+var _ BatchCloudlogClient = (*reloadingClient)(nil)
+var _ io.Closer = (*reloadingClient)(nil)
+
+// PushEvent implements CloudlogClient
+func (rc *reloadingClient) PushEvent(event interface{}) error {
+	rc.mutex.RLock()
+	defer rc.mutex.RUnlock()
+	return rc.client.PushEvent(event)
+}
+
+// PushEvents implements BatchCloudlogClient
+func (rc *reloadingClient) PushEvents(events ...interface{}) error {
+	rc.mutex.RLock()
+	defer rc.mutex.RUnlock()
+	return pushBatch(rc.client, events)
+}
+
+// swap replaces the underlying client once all pushes in flight have completed and returns
+// the previous client
+func (rc *reloadingClient) swap(client CloudlogClient) CloudlogClient {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	previous := rc.client
+	rc.client = client
+	rc.retired += retries(previous)
+	return previous
+}
+
+// current returns the underlying client
+func (rc *reloadingClient) current() CloudlogClient {
+	rc.mutex.RLock()
+	defer rc.mutex.RUnlock()
+	return rc.client
+}
+
+// Retries returns the number of retries of the underlying clients
+func (rc *reloadingClient) Retries() uint64 {
+	rc.mutex.RLock()
+	defer rc.mutex.RUnlock()
+	return rc.retired + retries(rc.client)
+}
+
+// Close closes the underlying client if it implements io.Closer
+func (rc *reloadingClient) Close() error {
+	if closer, ok := rc.current().(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// reloadConfig holds the files watched by the certificate reloader
+type reloadConfig struct {
+	interval    time.Duration
+	paths       []string
+	fingerprint []byte
+}
+
+// CoreOptionCertificateReload watches the supplied CA certificate, client certificate and key files
+// by polling them in the supplied interval. Once their contents have changed, the CloudLog client is
+// recreated using the core's CloudLog options and replaced after the pushes in flight have completed.
+// Failures are reported to the ErrorHandler and retried in the next interval, keeping the previous
+// client. Certificate reloading requires the core to create its own client.
+func CoreOptionCertificateReload(interval time.Duration, paths ...string) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if interval <= 0 {
+			return ErrInvalidCertificateReloadInterval
+		}
+		if len(paths) == 0 {
+			return ErrCertificateReloadPathsMissing
+		}
+		fingerprint, err := fingerprintFiles(paths)
+		if err != nil {
+			return err
+		}
+		cc.reloadConfig = &reloadConfig{
+			interval:    interval,
+			paths:       paths,
+			fingerprint: fingerprint,
+		}
+		return nil
+	}
+}
+
+// fingerprintFiles returns a hash over the contents of the supplied files
+func fingerprintFiles(paths []string) ([]byte, error) {
+	hash := sha256.New()
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(data)
+		hash.Write(sum[:])
+	}
+	return hash.Sum(nil), nil
+}
+
+// certificateReloader recreates the client of a reloadingClient once the watched files change
+type certificateReloader struct {
+	reloads  uint64
+	failures uint64
+
+	client  *reloadingClient
+	config  reloadConfig
+	create  func() (CloudlogClient, error)
+	onError func(error)
+	// certificates is refreshed after reloading, if the certificates are monitored
+	certificates *certificateMonitor
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newCertificateReloader(client *reloadingClient, config reloadConfig, create func() (CloudlogClient, error), onError func(error)) *certificateReloader {
+	return &certificateReloader{
+		client:  client,
+		config:  config,
+		create:  create,
+		onError: onError,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (r *certificateReloader) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.config.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.check()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// check recreates the client if the watched files have changed and warns about reloaded
+// certificates which are about to expire
+func (r *certificateReloader) check() {
+	if r.reload() && r.certificates != nil {
+		if err := r.certificates.refresh(); err != nil {
+			r.onError(err)
+		}
+	}
+}
+
+// reload recreates the client if the watched files have changed and returns whether it did
+func (r *certificateReloader) reload() bool {
+	fingerprint, err := fingerprintFiles(r.config.paths)
+	if err != nil {
+		r.fail(err)
+		return false
+	}
+	if bytes.Equal(fingerprint, r.config.fingerprint) {
+		return false
+	}
+
+	// Files may be changed one at a time, a failed attempt is repeated in the next interval
+	client, err := r.create()
+	if err != nil {
+		r.fail(err)
+		return false
+	}
+	r.config.fingerprint = fingerprint
+	previous := r.client.swap(client)
+	atomic.AddUint64(&r.reloads, 1)
+
+	if closer, ok := previous.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			r.onError(err)
+		}
+	}
+	return true
+}
+
+func (r *certificateReloader) fail(err error) {
+	atomic.AddUint64(&r.failures, 1)
+	r.onError(fmt.Errorf("Reloading CloudLog certificates failed: %v", err))
+}
+
+// shutdown stops watching the files
+func (r *certificateReloader) shutdown() {
+	close(r.stop)
+	<-r.done
+}
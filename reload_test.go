@@ -0,0 +1,190 @@
+package cloudlogzap
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+// writeTestCertificateFiles writes a new certificate and key to cert.pem and key.pem in dir
+func writeTestCertificateFiles(t *testing.T, dir string, notAfter time.Time) (certFile, keyFile string) {
+	certPEM, keyPEM := newTestCertificate(t, notAfter)
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+	return
+}
+
+func TestReloadingClient(t *testing.T) {
+	first := &MockClosableCloudlogClient{}
+	rc := &reloadingClient{client: first}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.NoError(t, rc.PushEvent("event"))
+				assert.NoError(t, rc.PushEvents("a", "b"))
+			}
+		}()
+	}
+
+	clients := []*MockClosableCloudlogClient{first}
+	for i := 0; i < 10; i++ {
+		client := &MockClosableCloudlogClient{}
+		assert.EqualValues(t, clients[len(clients)-1], rc.swap(client))
+		clients = append(clients, client)
+	}
+	wg.Wait()
+
+	// No event is lost while swapping
+	var count int
+	for _, client := range clients {
+		count += client.Count()
+	}
+	assert.EqualValues(t, 4*100*3, count)
+
+	require.NoError(t, rc.Close())
+	assert.True(t, clients[len(clients)-1].closed)
+	assert.False(t, first.closed)
+}
+
+func TestReloadingClient_Retries(t *testing.T) {
+	newClient := func() *RetryingClient {
+		client, err := NewRetryingClient(&MockFailingCloudlogClient{Failures: 1})
+		require.NoError(t, err)
+		client.sleep = func(time.Duration) {}
+		return client
+	}
+
+	rc := &reloadingClient{client: newClient()}
+	require.NoError(t, rc.PushEvent("event"))
+	rc.swap(newClient())
+	require.NoError(t, rc.PushEvent("event"))
+	assert.EqualValues(t, 2, retries(rc))
+
+	rc.swap(&MockClosableCloudlogClient{})
+	assert.EqualValues(t, 2, retries(rc))
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlogzap-reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificateFiles(t, dir, time.Now().Add(time.Hour))
+
+	config := reloadConfig{paths: []string{certFile, keyFile}}
+	config.fingerprint, err = fingerprintFiles(config.paths)
+	require.NoError(t, err)
+
+	first := &MockClosableCloudlogClient{}
+	created := &MockClosableCloudlogClient{}
+	var createErr error
+	var reported []error
+	rc := &reloadingClient{client: first}
+	r := newCertificateReloader(rc, config, func() (CloudlogClient, error) {
+		if createErr != nil {
+			return nil, createErr
+		}
+		return created, nil
+	}, func(err error) {
+		reported = append(reported, err)
+	})
+
+	// Unchanged files are not reloaded
+	r.check()
+	assert.EqualValues(t, first, rc.current())
+
+	// Failures are retried until the files have been reloaded successfully
+	writeTestCertificateFiles(t, dir, time.Now().Add(2*time.Hour))
+	createErr = errors.New("tls: private key does not match public key")
+	r.check()
+	assert.EqualValues(t, first, rc.current())
+	require.Len(t, reported, 1)
+	assert.EqualValues(t, "Reloading CloudLog certificates failed: tls: private key does not match public key", reported[0].Error())
+
+	createErr = nil
+	r.check()
+	assert.EqualValues(t, created, rc.current())
+	assert.True(t, first.closed)
+	assert.EqualValues(t, 1, r.reloads)
+	assert.EqualValues(t, 1, r.failures)
+
+	require.NoError(t, os.Remove(keyFile))
+	r.check()
+	assert.EqualValues(t, created, rc.current())
+	assert.Len(t, reported, 2)
+	assert.EqualValues(t, 2, r.failures)
+}
+
+func TestCoreOptionCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlogzap-reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificateFiles(t, dir, time.Now().Add(time.Hour))
+
+	t.Run("OK", func(t *testing.T) {
+		reported := make(chan error, 10)
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex",
+			CoreOptionCloudLogOptions(cloudlog.OptionClientCertificateFile(certFile, keyFile)),
+			CoreOptionCertificateReload(time.Millisecond, certFile, keyFile),
+			CoreOptionErrorHandler(ErrorHandlerFunc(func(err error) {
+				reported <- err
+			})),
+			CoreOptionErrorReportInterval(0),
+		)
+		require.NoError(t, err)
+		require.IsType(t, &reloadingClient{}, core.client)
+		initial := core.client.(*reloadingClient).current()
+
+		writeTestCertificateFiles(t, dir, time.Now().Add(2*time.Hour))
+		waitFor(t, func() bool {
+			return core.Stats().CertificateReloads == 1
+		})
+		assert.NotEqual(t, initial, core.client.(*reloadingClient).current())
+
+		require.NoError(t, ioutil.WriteFile(keyFile, []byte("invalid"), 0600))
+		select {
+		case err := <-reported:
+			assert.Contains(t, err.Error(), "Reloading CloudLog certificates failed")
+		case <-time.After(5 * time.Second):
+			t.Fatal("reload failure not reported")
+		}
+		assert.EqualValues(t, 1, core.Stats().CertificateReloads)
+		assert.NotZero(t, core.Stats().CertificateReloadFailures)
+
+		require.NoError(t, core.Close())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex",
+			CoreOptionCertificateReload(0, certFile),
+			CoreOptionCertificateReload(time.Minute),
+		)
+		assert.Nil(t, core)
+		assert.EqualValues(t, []error{ErrInvalidCertificateReloadInterval, ErrCertificateReloadPathsMissing}, flattenErrors(err))
+
+		core, err = NewCloudlogCore(zapcore.NewNopCore(), "testindex",
+			CoreOptionCertificateReload(time.Minute, filepath.Join(dir, "missing.pem")))
+		assert.Nil(t, core)
+		require.Len(t, flattenErrors(err), 1)
+		assert.True(t, os.IsNotExist(flattenErrors(err)[0]))
+
+		core, err = NewCloudlogCoreWithClient(zapcore.NewNopCore(), &MockCloudlogClient{},
+			CoreOptionCertificateReload(time.Minute, certFile))
+		assert.Nil(t, core)
+		assert.EqualValues(t, []error{ErrCertificateReloadConflict}, flattenErrors(err))
+	})
+}
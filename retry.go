@@ -0,0 +1,289 @@
+package cloudlogzap
+
+import (
+	"io"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// DefaultRetryMaxAttempts defines the default number of attempts, including the first one
+	DefaultRetryMaxAttempts = 3
+
+	// DefaultRetryInitialBackoff defines the default delay before the first retry
+	DefaultRetryInitialBackoff = 100 * time.Millisecond
+
+	// DefaultRetryMaxBackoff defines the default upper bound of the delay between two attempts
+	DefaultRetryMaxBackoff = 5 * time.Second
+
+	// DefaultRetryJitter defines the default fraction by which delays are randomly shortened
+	DefaultRetryJitter = 0.2
+
+	// DefaultRetryDeadline defines the default maximum time spent retrying a single push
+	DefaultRetryDeadline = 10 * time.Second
+)
+
+// RetryClassifier decides whether pushing an event may be retried after the supplied error
+type RetryClassifier func(err error) bool
+
+// DefaultRetryClassifier treats encoding and marshalling errors as permanent and all other
+// errors as retryable. Aggregated errors are retryable if any of their errors is.
+func DefaultRetryClassifier(err error) bool {
+	switch e := err.(type) {
+	case *cloudlog.EventEncodingError, *cloudlog.MarshalError:
+		return false
+	case *multierror.Error:
+		return anyRetryable(e.Errors)
+	case *PartialPushError:
+		return anyRetryable(e.WrappedErrors())
+	}
+	return err != cloudlog.ErrIndexNotDefined
+}
+
+func anyRetryable(errs []error) bool {
+	for _, err := range errs {
+		if DefaultRetryClassifier(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryOption defines the type used for configuring a RetryingClient
+type RetryOption func(*RetryingClient) error
+
+// RetryOptionMaxAttempts defines the maximum number of attempts, including the first one
+func RetryOptionMaxAttempts(attempts int) RetryOption {
+	return func(c *RetryingClient) error {
+		if attempts < 1 {
+			return ErrInvalidRetryAttempts
+		}
+		c.maxAttempts = attempts
+		return nil
+	}
+}
+
+// RetryOptionBackoff defines the delay before the first retry, which is doubled for every
+// following retry up to the supplied maximum
+func RetryOptionBackoff(initial, max time.Duration) RetryOption {
+	return func(c *RetryingClient) error {
+		if initial < 0 || max < initial {
+			return ErrInvalidRetryBackoff
+		}
+		c.initialBackoff = initial
+		c.maxBackoff = max
+		return nil
+	}
+}
+
+// RetryOptionJitter defines the fraction, between 0 and 1, by which every delay is randomly shortened
+func RetryOptionJitter(jitter float64) RetryOption {
+	return func(c *RetryingClient) error {
+		if jitter < 0 || jitter > 1 {
+			return ErrInvalidRetryJitter
+		}
+		c.jitter = jitter
+		return nil
+	}
+}
+
+// RetryOptionClassifier defines which errors are retried
+func RetryOptionClassifier(classifier RetryClassifier) RetryOption {
+	return func(c *RetryingClient) error {
+		if classifier == nil {
+			return ErrRetryClassifierNil
+		}
+		c.classifier = classifier
+		return nil
+	}
+}
+
+// RetryOptionDeadline defines the maximum time spent on a single push, including all retries.
+// No retry is started if its delay would exceed the deadline. An attempt still running at the
+// deadline is abandoned with ErrRetryDeadlineExceeded, its event may be delivered nonetheless.
+func RetryOptionDeadline(deadline time.Duration) RetryOption {
+	return func(c *RetryingClient) error {
+		if deadline <= 0 {
+			return ErrInvalidRetryDeadline
+		}
+		c.deadline = deadline
+		return nil
+	}
+}
+
+// RetryingClient is a CloudlogClient decorator which retries failed pushes with exponential backoff
+type RetryingClient struct {
+	retries uint64
+
+	client         CloudlogClient
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	jitter         float64
+	classifier     RetryClassifier
+	deadline       time.Duration
+
+	sleep func(time.Duration)
+}
+
+var _ CloudlogClient = (*RetryingClient)(nil)
+
+// NewRetryingClient returns a RetryingClient wrapping the supplied client
+func NewRetryingClient(client CloudlogClient, options ...RetryOption) (rc *RetryingClient, err error) {
+	rc = &RetryingClient{
+		client:         client,
+		maxAttempts:    DefaultRetryMaxAttempts,
+		initialBackoff: DefaultRetryInitialBackoff,
+		maxBackoff:     DefaultRetryMaxBackoff,
+		jitter:         DefaultRetryJitter,
+		classifier:     DefaultRetryClassifier,
+		deadline:       DefaultRetryDeadline,
+		sleep:          time.Sleep,
+	}
+
+	// When returning an error ensure that we return a nil value as *RetryingClient
+	defer func() {
+		if err != nil {
+			rc = nil
+		}
+	}()
+
+	if client == nil {
+		err = multierror.Append(err, ErrClientNil)
+	}
+	for _, opt := range options {
+		if optErr := opt(rc); optErr != nil {
+			err = multierror.Append(err, optErr)
+		}
+	}
+	return
+}
+
+// PushEvent pushes the event, retrying on retryable errors
+func (rc *RetryingClient) PushEvent(event interface{}) error {
+	return rc.retry(func() error {
+		return rc.client.PushEvent(event)
+	}, rc.classifier)
+}
+
+// PushEvents pushes the events, retrying on retryable errors. If the client reports a
+// PartialPushError, only the failed events whose errors are retryable are retried. The
+// PartialPushError returned after the last attempt refers to the indices of the supplied events.
+func (rc *RetryingClient) PushEvents(events ...interface{}) error {
+	pending, indices := events, []int(nil)
+	var permanent []EventError
+	retryable := false
+	return rc.retry(func() error {
+		err := pushBatch(rc.client, pending)
+		partial, isPartial := err.(*PartialPushError)
+		if err == nil && permanent == nil {
+			return nil
+		}
+		if indices == nil && !isPartial {
+			retryable = rc.classifier(err)
+			return err
+		}
+
+		// Map the failures back to the supplied events
+		var failed []EventError
+		if isPartial {
+			failed = partial.Failed
+		} else if err != nil {
+			for i, event := range pending {
+				failed = append(failed, EventError{Index: i, Event: event, Err: err})
+			}
+		}
+		var retried []EventError
+		for _, eventErr := range failed {
+			if indices != nil {
+				eventErr.Index = indices[eventErr.Index]
+			}
+			if rc.classifier(eventErr.Err) {
+				retried = append(retried, eventErr)
+			} else {
+				permanent = append(permanent, eventErr)
+			}
+		}
+
+		pending, indices = make([]interface{}, len(retried)), make([]int, len(retried))
+		for i, eventErr := range retried {
+			pending[i], indices[i] = eventErr.Event, eventErr.Index
+		}
+		retryable = len(retried) > 0
+
+		all := append(append([]EventError(nil), permanent...), retried...)
+		sort.Slice(all, func(i, j int) bool {
+			return all[i].Index < all[j].Index
+		})
+		return &PartialPushError{Failed: all, Total: len(events)}
+	}, func(error) bool {
+		return retryable
+	})
+}
+
+// Retries returns the number of retries so far
+func (rc *RetryingClient) Retries() uint64 {
+	return atomic.LoadUint64(&rc.retries)
+}
+
+// Close closes the wrapped client if it implements io.Closer
+func (rc *RetryingClient) Close() error {
+	if closer, ok := rc.client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// retry runs the push until it succeeds, retryable returns false for its error or the attempts
+// or the deadline are exhausted
+func (rc *RetryingClient) retry(push func() error, retryable func(error) bool) (err error) {
+	deadline := time.Now().Add(rc.deadline)
+	for attempt := 1; ; attempt++ {
+		err = rc.attempt(push, deadline)
+		if err == nil || err == ErrRetryDeadlineExceeded || attempt >= rc.maxAttempts || !retryable(err) {
+			return
+		}
+
+		delay := rc.backoff(attempt)
+		if time.Now().Add(delay).After(deadline) {
+			return
+		}
+		atomic.AddUint64(&rc.retries, 1)
+		rc.sleep(delay)
+	}
+}
+
+// attempt runs the push until it returns or the deadline has passed, leaving it running in the
+// background in the latter case
+func (rc *RetryingClient) attempt(push func() error, deadline time.Time) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- push()
+	}()
+
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return ErrRetryDeadlineExceeded
+	}
+}
+
+// backoff returns the delay before the retry following the supplied attempt
+func (rc *RetryingClient) backoff(attempt int) time.Duration {
+	delay := rc.initialBackoff
+	for i := 1; i < attempt && delay < rc.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > rc.maxBackoff {
+		delay = rc.maxBackoff
+	}
+	return delay - time.Duration(rc.jitter*rand.Float64()*float64(delay))
+}
@@ -0,0 +1,192 @@
+package cloudlogzap
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+type MockErrorCloudlogClient struct {
+	err   error
+	calls int
+}
+
+func (client *MockErrorCloudlogClient) PushEvent(interface{}) error {
+	client.calls++
+	return client.err
+}
+
+func newTestRetryingClient(t *testing.T, client CloudlogClient, options ...RetryOption) (*RetryingClient, *[]time.Duration) {
+	rc, err := NewRetryingClient(client, append([]RetryOption{RetryOptionJitter(0)}, options...)...)
+	require.NoError(t, err)
+	sleeps := &[]time.Duration{}
+	rc.sleep = func(d time.Duration) {
+		*sleeps = append(*sleeps, d)
+	}
+	return rc, sleeps
+}
+
+func TestNewRetryingClient(t *testing.T) {
+	t.Run("OK", func(t *testing.T) {
+		rc, err := NewRetryingClient(&MockCloudlogClient{})
+		require.NoError(t, err)
+		assert.EqualValues(t, DefaultRetryMaxAttempts, rc.maxAttempts)
+		assert.EqualValues(t, DefaultRetryInitialBackoff, rc.initialBackoff)
+		assert.EqualValues(t, DefaultRetryMaxBackoff, rc.maxBackoff)
+		assert.EqualValues(t, DefaultRetryJitter, rc.jitter)
+		assert.EqualValues(t, DefaultRetryDeadline, rc.deadline)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		rc, err := NewRetryingClient(nil,
+			RetryOptionMaxAttempts(0),
+			RetryOptionBackoff(time.Second, time.Millisecond),
+			RetryOptionJitter(1.5),
+			RetryOptionClassifier(nil),
+			RetryOptionDeadline(0),
+		)
+		require.Error(t, err)
+		assert.Nil(t, rc)
+		merr, ok := err.(*multierror.Error)
+		require.True(t, ok)
+		assert.EqualValues(t, []error{
+			ErrClientNil,
+			ErrInvalidRetryAttempts,
+			ErrInvalidRetryBackoff,
+			ErrInvalidRetryJitter,
+			ErrRetryClassifierNil,
+			ErrInvalidRetryDeadline,
+		}, merr.Errors)
+	})
+}
+
+func TestRetryingClient_PushEvent(t *testing.T) {
+	t.Run("Recovers", func(t *testing.T) {
+		client := &MockFailingCloudlogClient{Failures: 2}
+		rc, sleeps := newTestRetryingClient(t, client)
+
+		require.NoError(t, rc.PushEvent("event"))
+		assert.EqualValues(t, 3, client.Calls())
+		assert.EqualValues(t, []interface{}{"event"}, client.Events())
+		assert.EqualValues(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}, *sleeps)
+	})
+
+	t.Run("Exhausted", func(t *testing.T) {
+		client := &MockFailingCloudlogClient{Failures: 5}
+		rc, _ := newTestRetryingClient(t, client, RetryOptionMaxAttempts(4))
+
+		assert.EqualValues(t, errMockPushFailed, rc.PushEvent("event"))
+		assert.EqualValues(t, 4, client.Calls())
+	})
+
+	t.Run("Permanent", func(t *testing.T) {
+		client := &MockErrorCloudlogClient{err: cloudlog.NewUnsupportedEventType(42)}
+		rc, sleeps := newTestRetryingClient(t, client)
+
+		require.Error(t, rc.PushEvent(42))
+		assert.EqualValues(t, 1, client.calls)
+		assert.Empty(t, *sleeps)
+	})
+
+	t.Run("Classifier", func(t *testing.T) {
+		client := &MockFailingCloudlogClient{Failures: 1}
+		rc, _ := newTestRetryingClient(t, client, RetryOptionClassifier(func(error) bool {
+			return false
+		}))
+
+		assert.EqualValues(t, errMockPushFailed, rc.PushEvent("event"))
+		assert.EqualValues(t, 1, client.Calls())
+	})
+
+	t.Run("MaxBackoff", func(t *testing.T) {
+		client := &MockFailingCloudlogClient{Failures: 4}
+		rc, sleeps := newTestRetryingClient(t, client,
+			RetryOptionMaxAttempts(5),
+			RetryOptionBackoff(100*time.Millisecond, 300*time.Millisecond))
+
+		require.NoError(t, rc.PushEvent("event"))
+		assert.EqualValues(t, []time.Duration{
+			100 * time.Millisecond,
+			200 * time.Millisecond,
+			300 * time.Millisecond,
+			300 * time.Millisecond,
+		}, *sleeps)
+	})
+
+	t.Run("Jitter", func(t *testing.T) {
+		client := &MockFailingCloudlogClient{Failures: 9}
+		rc, sleeps := newTestRetryingClient(t, client,
+			RetryOptionMaxAttempts(10),
+			RetryOptionBackoff(time.Second, time.Second),
+			RetryOptionJitter(0.5),
+			RetryOptionDeadline(time.Hour))
+
+		require.NoError(t, rc.PushEvent("event"))
+		require.Len(t, *sleeps, 9)
+		for _, d := range *sleeps {
+			assert.True(t, d > 500*time.Millisecond && d <= time.Second, "unexpected delay %s", d)
+		}
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		client := &MockFailingCloudlogClient{Failures: 5}
+		rc, sleeps := newTestRetryingClient(t, client,
+			RetryOptionMaxAttempts(5),
+			RetryOptionDeadline(150*time.Millisecond))
+
+		assert.EqualValues(t, errMockPushFailed, rc.PushEvent("event"))
+		assert.EqualValues(t, 2, client.Calls())
+		assert.EqualValues(t, []time.Duration{100 * time.Millisecond}, *sleeps)
+	})
+
+	t.Run("Blocking", func(t *testing.T) {
+		client := &MockBatchCloudlogClient{release: make(chan struct{})}
+		defer close(client.release)
+		rc, sleeps := newTestRetryingClient(t, client, RetryOptionDeadline(20*time.Millisecond))
+
+		start := time.Now()
+		assert.EqualValues(t, ErrRetryDeadlineExceeded, rc.PushEvent("event"))
+		assert.True(t, time.Since(start) < time.Second)
+		assert.Empty(t, *sleeps)
+	})
+}
+
+func TestRetryingClient_PushEvents(t *testing.T) {
+	client := &MockFailingCloudlogClient{Failures: 1}
+	rc, _ := newTestRetryingClient(t, client)
+
+	require.NoError(t, rc.PushEvents("a", "b"))
+	assert.EqualValues(t, 2, client.Calls())
+	assert.EqualValues(t, []interface{}{"a", "b"}, client.Events())
+}
+
+func TestDefaultRetryClassifier(t *testing.T) {
+	assert.True(t, DefaultRetryClassifier(errors.New("broker unreachable")))
+	assert.False(t, DefaultRetryClassifier(cloudlog.NewUnsupportedEventType(42)))
+	assert.False(t, DefaultRetryClassifier(cloudlog.NewMarshalError(nil, errors.New("marshal"))))
+	assert.False(t, DefaultRetryClassifier(cloudlog.ErrIndexNotDefined))
+	assert.True(t, DefaultRetryClassifier(multierror.Append(
+		cloudlog.NewUnsupportedEventType(42), errors.New("broker unreachable"))))
+	assert.False(t, DefaultRetryClassifier(multierror.Append(
+		cloudlog.NewUnsupportedEventType(42), cloudlog.NewMarshalError(nil, errors.New("marshal")))))
+}
+
+func TestCloudLogCore_EnableRetry(t *testing.T) {
+	core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+	require.NoError(t, err)
+	client := &MockFailingCloudlogClient{Failures: 2}
+	core.client = client
+
+	require.Error(t, core.EnableRetry(RetryOptionMaxAttempts(0)))
+	require.NoError(t, core.EnableRetry(RetryOptionBackoff(0, 0)))
+	require.IsType(t, &RetryingClient{}, core.client)
+
+	require.NoError(t, core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: "1"}, nil))
+	assert.EqualValues(t, []string{"1"}, client.Messages())
+}
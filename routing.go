@@ -0,0 +1,411 @@
+package cloudlogzap
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+	"go.uber.org/zap/zapcore"
+)
+
+// routedIndexKey carries the index of a routed event through the spool
+const routedIndexKey = "_cloudlogzap_index"
+
+// Router selects the CloudLog index of an entry. An empty index selects the core's index.
+type Router interface {
+	Route(entry zapcore.Entry, fields []zapcore.Field) string
+}
+
+// RouterFunc is an adapter allowing the use of ordinary functions as Router
+type RouterFunc func(entry zapcore.Entry, fields []zapcore.Field) string
+
+// Route calls f(entry, fields)
+func (f RouterFunc) Route(entry zapcore.Entry, fields []zapcore.Field) string {
+	return f(entry, fields)
+}
+
+// Route defines a rule of the Router returned by NewRouter. All of its conditions which are set
+// have to match for an entry to be sent to the route's index.
+type Route struct {
+	// Index is the CloudLog index matching entries are sent to
+	Index string `json:"index" yaml:"index"`
+	// Level matches entries at or above the level
+	Level *zapcore.Level `json:"level" yaml:"level"`
+	// Name matches entries of the named logger and its descendants
+	Name string `json:"name" yaml:"name"`
+	// Field matches entries carrying a field of the key and, if Value is set, the value
+	// formatted using fmt.Sprint
+	Field string `json:"field" yaml:"field"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// matches returns whether the entry matches all conditions of the route
+func (r Route) matches(entry zapcore.Entry, fields []zapcore.Field) bool {
+	if r.Level != nil && entry.Level < *r.Level {
+		return false
+	}
+	if r.Name != "" && !matchesNamePrefix(entry.LoggerName, r.Name) {
+		return false
+	}
+	if r.Field == "" {
+		return true
+	}
+
+	// Later fields take precedence, like context fields overridden by the entry's fields
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].Key != r.Field {
+			continue
+		}
+		if r.Value == "" {
+			return true
+		}
+		value := EncodeFields(zapcore.Entry{}, fields[i:i+1])[r.Field]
+		return fmt.Sprint(value) == r.Value
+	}
+	return false
+}
+
+type routes []Route
+
+// Route implements Router
+func (rs routes) Route(entry zapcore.Entry, fields []zapcore.Field) string {
+	for _, r := range rs {
+		if r.matches(entry, fields) {
+			return r.Index
+		}
+	}
+	return ""
+}
+
+// NewRouter returns a Router selecting the index of the first matching route. Entries not
+// matching any route are sent to the core's index.
+func NewRouter(rs ...Route) (Router, error) {
+	for _, r := range rs {
+		if r.Index == "" {
+			return nil, ErrRouteIndexMissing
+		}
+	}
+	return routes(append([]Route(nil), rs...)), nil
+}
+
+// CoreOptionRouter sends entries to the index selected by the supplied Router. A client per
+// index is created on first use, using the core's CloudLog options. Routing requires the core
+// to create its own client.
+func CoreOptionRouter(router Router) CoreOption {
+	return func(cc *CloudLogCore) error {
+		if router == nil {
+			return ErrRouterNil
+		}
+		cc.router = router
+		return nil
+	}
+}
+
+// CoreOptionRoutes sends entries to the index of the first matching route, see NewRouter
+// and CoreOptionRouter
+func CoreOptionRoutes(rs ...Route) CoreOption {
+	return func(cc *CloudLogCore) error {
+		router, err := NewRouter(rs...)
+		if err != nil {
+			return err
+		}
+		return CoreOptionRouter(router)(cc)
+	}
+}
+
+// route wraps the event if the entry is routed to an index other than the core's
+func (cc *CloudLogCore) route(event interface{}, e zapcore.Entry, ff []zapcore.Field) interface{} {
+	if cc.router == nil {
+		return event
+	}
+	if index := cc.router.Route(e, ff); index != "" && index != cc.cloudLogIndex {
+		return routedEvent{index: index, event: event}
+	}
+	return event
+}
+
+// routedEvent is an event sent to an index other than the core's
+type routedEvent struct {
+	index string
+	event interface{}
+}
+
+// encodeEvent encodes the event for the spool, retaining the index of routed events
+func encodeEvent(encoder cloudlog.EventEncoder, event interface{}) (map[string]interface{}, error) {
+	routed, ok := event.(routedEvent)
+	if !ok {
+		return encoder.EncodeEvent(event)
+	}
+	eventMap, err := encoder.EncodeEvent(routed.event)
+	if err != nil {
+		return nil, err
+	}
+	eventMap[routedIndexKey] = routed.index
+	return eventMap, nil
+}
+
+// unwrapEvent returns the index of a routed or spooled routed event and the event to push.
+// The index is empty for events sent to the core's index.
+func unwrapEvent(event interface{}) (string, interface{}) {
+	switch e := event.(type) {
+	case routedEvent:
+		return e.index, e.event
+	case map[string]interface{}:
+		index, ok := e[routedIndexKey].(string)
+		if !ok {
+			return "", event
+		}
+		unwrapped := make(map[string]interface{}, len(e)-1)
+		for k, v := range e {
+			if k != routedIndexKey {
+				unwrapped[k] = v
+			}
+		}
+		return index, unwrapped
+	}
+	return "", event
+}
+
+// routingClient pushes routed events using a client per index, which is created on first use.
+// The least recently used clients are closed once more than maxClients are open.
+type routingClient struct {
+	client     CloudlogClient
+	create     func(index string) (CloudlogClient, error)
+	maxClients int
+
+	mutex   sync.Mutex
+	clients map[string]*list.Element
+	lru     *list.List
+	// retired is the number of retries of the clients which have been closed
+	retired uint64
+}
+
+// indexClient is a client of the routingClient, which is closed once the pushes in flight
+// have completed
+type indexClient struct {
+	sync.RWMutex
+	index  string
+	client CloudlogClient
+	closed bool
+	// ready is closed once the client has been created, err is the error creating it
+	ready chan struct{}
+	err   error
+}
+
+var _ BatchCloudlogClient = (*routingClient)(nil)
+var _ io.Closer = (*routingClient)(nil)
+
+func newRoutingClient(client CloudlogClient, create func(index string) (CloudlogClient, error), maxClients int) *routingClient {
+	return &routingClient{
+		client:     client,
+		create:     create,
+		maxClients: maxClients,
+		clients:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// indexClient returns the client for the index, creating it and closing the least recently
+// used clients if necessary
+func (rc *routingClient) indexClient(index string) (*indexClient, error) {
+	rc.mutex.Lock()
+	if element, ok := rc.clients[index]; ok {
+		rc.lru.MoveToFront(element)
+		rc.mutex.Unlock()
+		ic := element.Value.(*indexClient)
+		<-ic.ready
+		if ic.err != nil {
+			return nil, ic.err
+		}
+		return ic, nil
+	}
+
+	// The client is created outside of the lock, so pushes to other indices are not blocked by a
+	// slow connection. Pushes to the same index wait for the placeholder to become ready.
+	ic := &indexClient{index: index, ready: make(chan struct{})}
+	element := rc.lru.PushFront(ic)
+	rc.clients[index] = element
+
+	var evicted []*indexClient
+	for rc.lru.Len() > rc.maxClients {
+		oldest := rc.lru.Remove(rc.lru.Back()).(*indexClient)
+		delete(rc.clients, oldest.index)
+		evicted = append(evicted, oldest)
+	}
+	rc.mutex.Unlock()
+
+	for _, oldest := range evicted {
+		rc.retire(oldest)
+	}
+
+	ic.client, ic.err = rc.create(index)
+	if ic.err != nil {
+		// Let the next push try again
+		rc.mutex.Lock()
+		if rc.clients[index] == element {
+			delete(rc.clients, index)
+			rc.lru.Remove(element)
+		}
+		rc.mutex.Unlock()
+	}
+	close(ic.ready)
+
+	if ic.err != nil {
+		return nil, ic.err
+	}
+	return ic, nil
+}
+
+// push calls f with the client for the index, which is not closed before f has returned
+func (rc *routingClient) push(index string, f func(CloudlogClient) error) error {
+	if index == "" {
+		return f(rc.client)
+	}
+
+	for {
+		ic, err := rc.indexClient(index)
+		if err != nil {
+			return err
+		}
+		ic.RLock()
+		if ic.closed {
+			// The client has been evicted meanwhile
+			ic.RUnlock()
+			continue
+		}
+		err = f(ic.client)
+		ic.RUnlock()
+		return err
+	}
+}
+
+// close closes the client once the pushes in flight have completed
+func (ic *indexClient) close() error {
+	<-ic.ready
+	ic.Lock()
+	defer ic.Unlock()
+	ic.closed = true
+	if closer, ok := ic.client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// PushEvent implements CloudlogClient
+func (rc *routingClient) PushEvent(event interface{}) error {
+	index, event := unwrapEvent(event)
+	return rc.push(index, func(client CloudlogClient) error {
+		return client.PushEvent(event)
+	})
+}
+
+// PushEvents implements BatchCloudlogClient. Events are pushed in batches per index, failures
+// are reported for the supplied events.
+func (rc *routingClient) PushEvents(events ...interface{}) error {
+	type batch struct {
+		events  []interface{}
+		indices []int
+	}
+	var order []string
+	batches := make(map[string]*batch)
+	for i, event := range events {
+		index, unwrapped := unwrapEvent(event)
+		b, ok := batches[index]
+		if !ok {
+			b = &batch{}
+			batches[index] = b
+			order = append(order, index)
+		}
+		b.events = append(b.events, unwrapped)
+		b.indices = append(b.indices, i)
+	}
+
+	var failed []EventError
+	for _, index := range order {
+		b := batches[index]
+		err := rc.push(index, func(client CloudlogClient) error {
+			return pushBatch(client, b.events)
+		})
+		if err == nil {
+			continue
+		}
+		if len(order) == 1 {
+			if _, ok := err.(*PartialPushError); !ok {
+				return err
+			}
+		}
+
+		if partial, ok := err.(*PartialPushError); ok {
+			for _, eventErr := range partial.Failed {
+				i := b.indices[eventErr.Index]
+				failed = append(failed, EventError{Index: i, Event: events[i], Err: eventErr.Err})
+			}
+			continue
+		}
+		for _, i := range b.indices {
+			failed = append(failed, EventError{Index: i, Event: events[i], Err: err})
+		}
+	}
+
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool {
+			return failed[i].Index < failed[j].Index
+		})
+		return &PartialPushError{Failed: failed, Total: len(events)}
+	}
+	return nil
+}
+
+// Close closes the clients which implement io.Closer
+func (rc *routingClient) Close() (err error) {
+	rc.mutex.Lock()
+	clients := make([]*indexClient, 0, rc.lru.Len())
+	for element := rc.lru.Front(); element != nil; element = element.Next() {
+		clients = append(clients, element.Value.(*indexClient))
+	}
+	rc.clients = make(map[string]*list.Element)
+	rc.lru.Init()
+	rc.mutex.Unlock()
+
+	if closer, ok := rc.client.(io.Closer); ok {
+		if closeErr := closer.Close(); closeErr != nil {
+			err = multierror.Append(err, closeErr)
+		}
+	}
+	for _, ic := range clients {
+		if closeErr := rc.retire(ic); closeErr != nil {
+			err = multierror.Append(err, closeErr)
+		}
+	}
+	return
+}
+
+// retire closes the evicted client and keeps its retries
+func (rc *routingClient) retire(ic *indexClient) error {
+	err := ic.close()
+	rc.mutex.Lock()
+	rc.retired += retries(ic.client)
+	rc.mutex.Unlock()
+	return err
+}
+
+// Retries returns the number of retries of the default client and all index clients
+func (rc *routingClient) Retries() uint64 {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	count := rc.retired + retries(rc.client)
+	for element := rc.lru.Front(); element != nil; element = element.Next() {
+		ic := element.Value.(*indexClient)
+		select {
+		case <-ic.ready:
+			count += retries(ic.client)
+		default:
+			// The client is still being created
+		}
+	}
+	return count
+}
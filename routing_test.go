@@ -0,0 +1,281 @@
+package cloudlogzap
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// newTestRoutingClient returns a routing client pushing to mock clients per index, the default
+// client being registered as ""
+func newTestRoutingClient() (*routingClient, map[string]*MockClosableCloudlogClient) {
+	clients := map[string]*MockClosableCloudlogClient{"": {}}
+	rc := newRoutingClient(clients[""], func(index string) (CloudlogClient, error) {
+		if index == "invalid" {
+			return nil, cloudlog.ErrIndexNotDefined
+		}
+		clients[index] = &MockClosableCloudlogClient{}
+		return clients[index], nil
+	}, DefaultMaxIndexClients)
+	return rc, clients
+}
+
+// newReadyIndexClient returns an indexClient for a client which has been created already
+func newReadyIndexClient(index string, client CloudlogClient) *indexClient {
+	ready := make(chan struct{})
+	close(ready)
+	return &indexClient{index: index, client: client, ready: ready}
+}
+
+func TestNewRouter(t *testing.T) {
+	warn := zapcore.WarnLevel
+	router, err := NewRouter(
+		Route{Index: "audit", Field: "audit", Value: "true"},
+		Route{Index: "errors", Level: &warn},
+		Route{Index: "payments", Name: "api.payments"},
+		Route{Index: "traced", Field: "trace_id"},
+	)
+	require.NoError(t, err)
+
+	for expected, entries := range map[string][]struct {
+		entry  zapcore.Entry
+		fields []zapcore.Field
+	}{
+		"audit": {
+			{zapcore.Entry{Level: zapcore.ErrorLevel}, []zapcore.Field{zap.Bool("audit", true)}},
+			{zapcore.Entry{}, []zapcore.Field{zap.String("audit", "true")}},
+			{zapcore.Entry{}, []zapcore.Field{zap.Bool("audit", false), zap.Bool("audit", true)}},
+		},
+		"errors": {
+			{zapcore.Entry{Level: zapcore.WarnLevel, LoggerName: "api.payments"}, nil},
+			{zapcore.Entry{Level: zapcore.ErrorLevel}, []zapcore.Field{zap.Bool("audit", false)}},
+		},
+		"payments": {
+			{zapcore.Entry{LoggerName: "api.payments"}, nil},
+			{zapcore.Entry{LoggerName: "api.payments.refunds"}, nil},
+		},
+		"traced": {
+			{zapcore.Entry{}, []zapcore.Field{zap.Int("trace_id", 42)}},
+		},
+		"": {
+			{zapcore.Entry{LoggerName: "api.paymentsx"}, nil},
+			{zapcore.Entry{}, []zapcore.Field{zap.Bool("audit", true), zap.Bool("audit", false)}},
+		},
+	} {
+		for _, e := range entries {
+			assert.EqualValues(t, expected, router.Route(e.entry, e.fields), "%+v %+v", e.entry, e.fields)
+		}
+	}
+
+	router, err = NewRouter(Route{Field: "audit"})
+	assert.Nil(t, router)
+	assert.EqualValues(t, ErrRouteIndexMissing, err)
+}
+
+func TestRoutingClient(t *testing.T) {
+	t.Run("PushEvents", func(t *testing.T) {
+		rc, clients := newTestRoutingClient()
+		require.NoError(t, rc.PushEvents(
+			"default 1",
+			routedEvent{index: "audit", event: "audit 1"},
+			"default 2",
+			routedEvent{index: "errors", event: "errors 1"},
+			routedEvent{index: "audit", event: "audit 2"},
+		))
+		assert.EqualValues(t, [][]interface{}{{"default 1", "default 2"}}, clients[""].Batches())
+		assert.EqualValues(t, [][]interface{}{{"audit 1", "audit 2"}}, clients["audit"].Batches())
+		assert.EqualValues(t, [][]interface{}{{"errors 1"}}, clients["errors"].Batches())
+
+		// Clients are created once per index
+		audit := clients["audit"]
+		require.NoError(t, rc.PushEvent(routedEvent{index: "audit", event: "audit 3"}))
+		assert.EqualValues(t, audit, clients["audit"])
+		assert.EqualValues(t, 3, audit.Count())
+
+		require.NoError(t, rc.Close())
+		for _, client := range clients {
+			assert.True(t, client.closed)
+		}
+	})
+
+	t.Run("Failures", func(t *testing.T) {
+		rc, clients := newTestRoutingClient()
+		clients[""].release = make(chan struct{})
+		close(clients[""].release)
+		failing := &MockSelectiveCloudlogClient{fail: func(event interface{}) bool {
+			return event == "audit 2"
+		}}
+		rc.clients["audit"] = rc.lru.PushFront(newReadyIndexClient("audit", failing))
+
+		events := []interface{}{
+			routedEvent{index: "audit", event: "audit 1"},
+			routedEvent{index: "invalid", event: "invalid 1"},
+			"default 1",
+			routedEvent{index: "audit", event: "audit 2"},
+		}
+		err := rc.PushEvents(events...)
+		require.IsType(t, &PartialPushError{}, err)
+		assert.EqualValues(t, &PartialPushError{
+			Failed: []EventError{
+				{Index: 1, Event: events[1], Err: cloudlog.ErrIndexNotDefined},
+				{Index: 3, Event: events[3], Err: errMockPushFailed},
+			},
+			Total: 4,
+		}, err)
+		assert.EqualValues(t, []interface{}{"audit 1"}, failing.Pushed())
+
+		// Errors of a single index are returned as they are
+		assert.EqualValues(t, cloudlog.ErrIndexNotDefined, rc.PushEvents(
+			routedEvent{index: "invalid", event: "invalid 1"},
+			routedEvent{index: "invalid", event: "invalid 2"},
+		))
+	})
+
+	t.Run("SlowCreate", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		var creates int32
+		rc := newRoutingClient(&MockClosableCloudlogClient{}, func(index string) (CloudlogClient, error) {
+			if index == "slow" {
+				atomic.AddInt32(&creates, 1)
+				close(started)
+				<-release
+			}
+			return &MockClosableCloudlogClient{}, nil
+		}, DefaultMaxIndexClients)
+
+		pushed := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				pushed <- rc.PushEvent(routedEvent{index: "slow", event: "slow"})
+			}()
+		}
+		<-started
+
+		// Creating the client of one index does not block pushes to other indices
+		require.NoError(t, rc.PushEvent(routedEvent{index: "audit", event: "audit"}))
+
+		close(release)
+		require.NoError(t, <-pushed)
+		require.NoError(t, <-pushed)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&creates))
+		require.NoError(t, rc.Close())
+	})
+
+	t.Run("Retries", func(t *testing.T) {
+		newClient := func() CloudlogClient {
+			client, err := NewRetryingClient(&MockFailingCloudlogClient{Failures: 1})
+			require.NoError(t, err)
+			client.sleep = func(time.Duration) {}
+			return client
+		}
+		rc := newRoutingClient(newClient(), func(string) (CloudlogClient, error) {
+			return newClient(), nil
+		}, 1)
+
+		require.NoError(t, rc.PushEvent("default"))
+		require.NoError(t, rc.PushEvent(routedEvent{index: "audit", event: "audit"}))
+		assert.EqualValues(t, 2, retries(rc))
+
+		// The retries of evicted clients are retained
+		require.NoError(t, rc.PushEvent(routedEvent{index: "errors", event: "errors"}))
+		assert.EqualValues(t, 3, retries(rc))
+		require.NoError(t, rc.Close())
+		assert.EqualValues(t, 3, retries(rc))
+	})
+
+	t.Run("Spooled", func(t *testing.T) {
+		rc, clients := newTestRoutingClient()
+		eventMap, err := encodeEvent(cloudlog.NewAutomaticEventEncoder(),
+			routedEvent{index: "audit", event: map[string]interface{}{"message": "audit 1"}})
+		require.NoError(t, err)
+		assert.EqualValues(t, map[string]interface{}{"message": "audit 1", routedIndexKey: "audit"}, eventMap)
+
+		require.NoError(t, rc.PushEvent(eventMap))
+		assert.EqualValues(t, [][]interface{}{{map[string]interface{}{"message": "audit 1"}}}, clients["audit"].Batches())
+	})
+}
+
+func TestCoreOptionRoutes(t *testing.T) {
+	errorLevel := zapcore.ErrorLevel
+	options := []CoreOption{
+		CoreOptionFields(zap.String("service", "api")),
+		CoreOptionRoutes(
+			Route{Index: "myapp-audit", Field: "audit", Value: "true"},
+			Route{Index: "myapp-errors", Level: &errorLevel},
+			Route{Index: "myapp", Name: "api"},
+		),
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		wrapped, _ := newCertificateTestCore()
+		core, err := NewCloudlogCore(wrapped, "myapp", options...)
+		require.NoError(t, err)
+		require.IsType(t, &routingClient{}, core.client)
+		rc, clients := newTestRoutingClient()
+		core.client.(*routingClient).client = rc.client
+		core.client.(*routingClient).create = rc.create
+
+		logger := zap.New(core).Named("api")
+		logger.Info("default")
+		logger.Info("audit", zap.Bool("audit", true))
+		logger.Error("error")
+		logger.With(zap.Bool("audit", true)).Error("audited error")
+
+		assert.Len(t, clients, 3)
+		assert.EqualValues(t, 1, clients[""].Count())
+		assert.EqualValues(t, 2, clients["myapp-audit"].Count())
+		assert.EqualValues(t, 1, clients["myapp-errors"].Count())
+		assert.EqualValues(t, "error", clients["myapp-errors"].Batches()[0][0].(document).Message)
+		require.NoError(t, core.Close())
+	})
+
+	t.Run("Spool", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap-routing")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "myapp", options...)
+		require.NoError(t, err)
+		rc, clients := newTestRoutingClient()
+		var available int32
+		core.client.(*routingClient).create = func(index string) (CloudlogClient, error) {
+			if atomic.LoadInt32(&available) == 0 {
+				return nil, errors.New("broker unavailable")
+			}
+			return rc.create(index)
+		}
+		require.NoError(t, core.EnableSpool(dir, SpoolOptionReplayInterval(10*time.Millisecond)))
+
+		require.NoError(t, core.Write(zapcore.Entry{Level: zapcore.ErrorLevel, Message: "error"}, nil))
+		assert.EqualValues(t, 1, core.SpoolStats().Events)
+
+		// Replayed events are sent to the index they have been routed to
+		atomic.StoreInt32(&available, 1)
+		waitFor(t, func() bool {
+			return core.SpoolStats().Events == 0
+		})
+		require.Contains(t, clients, "myapp-errors")
+		assert.EqualValues(t, 1, clients["myapp-errors"].Count())
+		require.NoError(t, core.Close())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		core, err := NewCloudlogCoreWithClient(zapcore.NewNopCore(), &MockCloudlogClient{},
+			CoreOptionRouter(nil),
+			CoreOptionRoutes(Route{}),
+			CoreOptionRoutes(Route{Index: "audit"}),
+		)
+		assert.Nil(t, core)
+		assert.EqualValues(t, []error{ErrRouterNil, ErrRouteIndexMissing, ErrRoutingConflict}, flattenErrors(err))
+	})
+}
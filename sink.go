@@ -0,0 +1,312 @@
+package cloudlogzap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// SinkScheme is the URL scheme of the zap sink writing to CloudLog, which is registered
+// with zap.RegisterSink when the package is initialized. The URL grammar is
+//
+//	cloudlog://[broker[,broker...]]/index[?param=value&...]
+//
+// Without brokers cloudlog.DefaultBrokerAddresses are used. Supported parameters are
+// ca (CA certificate file), cert and key (client certificate and key files), source_host,
+// async (true to push the entries asynchronously in batches) and error_output (the zap.Open
+// path asynchronous push errors are written to, stderr by default).
+//
+// Entries encoded as JSON objects are pushed in the same layout as CloudLogCore's: the values
+// of message_key, level_key and time_key (msg, level and ts by default, as written by
+// zap.NewProductionConfig) become the message, level and millisecond timestamp, all other keys
+// the fields. The time may be encoded as seconds since the epoch or as ISO8601 string, any
+// other encoding is kept in the fields and the event is pushed without timestamp. An empty
+// key disables mapping the respective value. All other entries are pushed as message.
+//
+// Example:
+//
+//	cloudlog://broker1:443,broker2:443/my-index?ca=/etc/ca.pem&cert=/etc/cert.pem&key=/etc/key.pem
+const SinkScheme = "cloudlog"
+
+func init() {
+	// Registration only fails if the scheme has been registered by another package already
+	zap.RegisterSink(SinkScheme, newSink)
+}
+
+// sinkURL holds the configuration parsed from a cloudlog:// URL
+type sinkURL struct {
+	index      string
+	brokers    []string
+	caFile     string
+	certFile   string
+	keyFile    string
+	sourceHost string
+	async      bool
+	// errorOutput is the zap.Open path asynchronous push errors are written to
+	errorOutput string
+	layout      sinkLayout
+}
+
+// sinkLayout names the keys of JSON encoded entries which are mapped to the document layout
+type sinkLayout struct {
+	messageKey string
+	levelKey   string
+	timeKey    string
+}
+
+// parseSinkURL parses a cloudlog:// URL, reporting all errors at once
+func parseSinkURL(u *url.URL) (s sinkURL, err error) {
+	s = sinkURL{
+		errorOutput: "stderr",
+		layout:      sinkLayout{messageKey: "msg", levelKey: "level", timeKey: "ts"},
+	}
+
+	if u.Scheme != SinkScheme {
+		err = multierror.Append(err, fmt.Errorf("Scheme must be %q, got %q", SinkScheme, u.Scheme))
+	}
+	if u.User != nil {
+		err = multierror.Append(err, fmt.Errorf("User and password not allowed with CloudLog URLs: got %v", u))
+	}
+	if u.Fragment != "" {
+		err = multierror.Append(err, fmt.Errorf("Fragments not allowed with CloudLog URLs: got %v", u))
+	}
+
+	if u.Host != "" {
+		for _, broker := range strings.Split(u.Host, ",") {
+			if broker == "" {
+				err = multierror.Append(err, fmt.Errorf("Empty broker address in %q", u.Host))
+				continue
+			}
+			s.brokers = append(s.brokers, broker)
+		}
+	}
+
+	s.index = strings.TrimPrefix(u.Path, "/")
+	if s.index == "" {
+		err = multierror.Append(err, cloudlog.ErrIndexNotDefined)
+	} else if strings.Contains(s.index, "/") {
+		err = multierror.Append(err, fmt.Errorf("Index must not contain slashes, got %q", s.index))
+	}
+
+	query, queryErr := url.ParseQuery(u.RawQuery)
+	if queryErr != nil {
+		err = multierror.Append(err, fmt.Errorf("Invalid query %q: %v", u.RawQuery, queryErr))
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := query[key]
+		if len(values) != 1 {
+			err = multierror.Append(err, fmt.Errorf("Parameter %q must be supplied once", key))
+			continue
+		}
+		value := values[0]
+
+		switch key {
+		case "ca":
+			s.caFile = value
+		case "cert":
+			s.certFile = value
+		case "key":
+			s.keyFile = value
+		case "source_host":
+			s.sourceHost = value
+		case "async":
+			var parseErr error
+			if s.async, parseErr = strconv.ParseBool(value); parseErr != nil {
+				err = multierror.Append(err, fmt.Errorf("Parameter async must be a boolean, got %q", value))
+			}
+		case "error_output":
+			if value == "" {
+				err = multierror.Append(err, errors.New("Parameter error_output must not be empty"))
+			}
+			s.errorOutput = value
+		case "message_key":
+			s.layout.messageKey = value
+		case "level_key":
+			s.layout.levelKey = value
+		case "time_key":
+			s.layout.timeKey = value
+		default:
+			err = multierror.Append(err, fmt.Errorf("Unknown parameter %q", key))
+		}
+	}
+	if (s.certFile == "") != (s.keyFile == "") {
+		err = multierror.Append(err, ErrClientCertificateIncomplete)
+	}
+	return
+}
+
+// cloudLogOptions returns the options for creating the cloudlog.CloudLog client
+func (s sinkURL) cloudLogOptions() (options []cloudlog.Option) {
+	if len(s.brokers) > 0 {
+		options = append(options, cloudlog.OptionBrokers(s.brokers...))
+	}
+	if s.caFile != "" {
+		options = append(options, cloudlog.OptionCACertificateFile(s.caFile))
+	}
+	if s.certFile != "" {
+		options = append(options, cloudlog.OptionClientCertificateFile(s.certFile, s.keyFile))
+	}
+	if s.sourceHost != "" {
+		options = append(options, cloudlog.OptionSourceHost(s.sourceHost))
+	}
+	return
+}
+
+// newSink is the factory registered with zap.RegisterSink
+func newSink(u *url.URL) (zap.Sink, error) {
+	s, err := parseSinkURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := cloudlog.NewCloudLog(s.index, s.cloudLogOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := newCloudLogSink(client, s)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return sink, nil
+}
+
+// cloudLogSink is a zap.Sink pushing every written entry to CloudLog
+type cloudLogSink struct {
+	client CloudlogClient
+	layout sinkLayout
+	async  *asyncPipeline
+	// closeErrorOutput closes the error output of an asynchronous sink
+	closeErrorOutput func()
+}
+
+func newCloudLogSink(client CloudlogClient, u sinkURL) (*cloudLogSink, error) {
+	s := &cloudLogSink{client: client, layout: u.layout}
+	if u.async {
+		config, err := newAsyncConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		// Synchronous write errors are reported by zap, asynchronous ones to the error output
+		errorOutput, closeErrorOutput, err := zap.Open(u.errorOutput)
+		if err != nil {
+			return nil, err
+		}
+		reporter := newErrorReporter()
+		reporter.handler = NewWriteSyncerErrorHandler(errorOutput)
+
+		push := func(events []interface{}) error {
+			return pushBatch(client, events)
+		}
+		s.async = newAsyncPipeline(push, config, reporter.report)
+		s.closeErrorOutput = closeErrorOutput
+	}
+	return s, nil
+}
+
+// Write pushes the entry encoded in p
+func (s *cloudLogSink) Write(p []byte) (int, error) {
+	event := s.layout.decode(p)
+	if s.async != nil {
+		s.async.enqueue(event, zapcore.InfoLevel)
+		return len(p), nil
+	}
+
+	if err := s.client.PushEvent(event); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Sync blocks until all asynchronously queued entries have been pushed
+func (s *cloudLogSink) Sync() error {
+	if s.async != nil {
+		s.async.drain()
+	}
+	return nil
+}
+
+// Close pushes all queued entries and closes the client
+func (s *cloudLogSink) Close() error {
+	if s.async != nil {
+		s.async.shutdown()
+		s.closeErrorOutput()
+	}
+	if closer, ok := s.client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// decode returns a document for entries encoded as JSON object and the entry as string otherwise
+func (l sinkLayout) decode(p []byte) interface{} {
+	p = bytes.TrimSpace(p)
+
+	var event map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	if err := dec.Decode(&event); err == nil && event != nil && !dec.More() {
+		return l.document(event)
+	}
+	return string(p)
+}
+
+// document moves the message, level and time of the entry out of its fields
+func (l sinkLayout) document(fields map[string]interface{}) document {
+	d := document{Fields: fields}
+	if message, ok := fields[l.messageKey].(string); ok && l.messageKey != "" {
+		d.Message = message
+		delete(fields, l.messageKey)
+	}
+	if level, ok := fields[l.levelKey].(string); ok && l.levelKey != "" {
+		d.Level = level
+		delete(fields, l.levelKey)
+	}
+	if t, ok := parseSinkTime(fields[l.timeKey]); ok && l.timeKey != "" {
+		d.Timestamp, _ = splitTimestamp(t, TimestampMillisecond)
+		delete(fields, l.timeKey)
+	}
+	return d
+}
+
+// sinkTimeLayouts are the string encodings of zapcore.ISO8601TimeEncoder and
+// zapcore.RFC3339NanoTimeEncoder
+var sinkTimeLayouts = []string{"2006-01-02T15:04:05.000Z0700", time.RFC3339Nano}
+
+// parseSinkTime parses the time encoded as seconds since the epoch or as ISO8601 string
+func parseSinkTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		seconds, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		// Round to microseconds, the precision of a float64 holding the seconds since the epoch
+		return time.Unix(0, int64(seconds*1e6+0.5)*int64(time.Microsecond)), true
+	case string:
+		for _, layout := range sinkTimeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,694 @@
+package cloudlogzap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// SpoolMode defines which events are written to the spool
+type SpoolMode int
+
+const (
+	// SpoolModeFailed only spools events which could not be pushed to CloudLog.
+	// While the spool holds events, new events are spooled as well to preserve their order.
+	SpoolModeFailed SpoolMode = iota
+	// SpoolModeDurable spools every event before it is pushed to CloudLog
+	SpoolModeDurable
+)
+
+const (
+	// DefaultSpoolSegmentSize defines the default size after which a new segment file is started
+	DefaultSpoolSegmentSize = 4 << 20
+
+	// DefaultSpoolMaxSize defines the default maximum size of all segment files
+	DefaultSpoolMaxSize = 256 << 20
+
+	// DefaultSpoolReplayInterval defines the default interval between two replay attempts
+	DefaultSpoolReplayInterval = 5 * time.Second
+
+	// DefaultSpoolReplayBatchSize defines the default number of events replayed at once
+	DefaultSpoolReplayBatchSize = 100
+)
+
+const (
+	spoolSegmentExtension = ".spool"
+	spoolAckExtension     = ".ack"
+	spoolAckSize          = 16
+	spoolHeaderSize       = 8
+	spoolMaxRecordSize    = 64 << 20
+)
+
+var errSpoolRecordCorrupt = errors.New("spool record is corrupt")
+
+// SpoolOption defines the type used for configuring the spool
+type SpoolOption func(*spoolConfig) error
+
+type spoolConfig struct {
+	mode            SpoolMode
+	segmentSize     int64
+	maxSize         int64
+	maxAge          time.Duration
+	replayInterval  time.Duration
+	replayBatchSize int
+}
+
+// SpoolOptionMode defines which events are written to the spool
+func SpoolOptionMode(mode SpoolMode) SpoolOption {
+	return func(c *spoolConfig) error {
+		if mode != SpoolModeFailed && mode != SpoolModeDurable {
+			return ErrInvalidSpoolMode
+		}
+		c.mode = mode
+		return nil
+	}
+}
+
+// SpoolOptionSegmentSize defines the size in bytes after which a new segment file is started
+func SpoolOptionSegmentSize(size int64) SpoolOption {
+	return func(c *spoolConfig) error {
+		if size < 1 {
+			return ErrInvalidSpoolSize
+		}
+		c.segmentSize = size
+		return nil
+	}
+}
+
+// SpoolOptionMaxSize defines the maximum size in bytes of all segment files.
+// If the spool grows beyond this size the oldest segments are dropped.
+func SpoolOptionMaxSize(size int64) SpoolOption {
+	return func(c *spoolConfig) error {
+		if size < 1 {
+			return ErrInvalidSpoolSize
+		}
+		c.maxSize = size
+		return nil
+	}
+}
+
+// SpoolOptionMaxAge defines the maximum age of spooled events.
+// Segments whose newest event is older than this are dropped. Zero disables the limit.
+func SpoolOptionMaxAge(age time.Duration) SpoolOption {
+	return func(c *spoolConfig) error {
+		if age < 0 {
+			return ErrInvalidSpoolMaxAge
+		}
+		c.maxAge = age
+		return nil
+	}
+}
+
+// SpoolOptionReplayInterval defines how often spooled events are replayed to CloudLog
+func SpoolOptionReplayInterval(interval time.Duration) SpoolOption {
+	return func(c *spoolConfig) error {
+		if interval <= 0 {
+			return ErrInvalidSpoolReplayInterval
+		}
+		c.replayInterval = interval
+		return nil
+	}
+}
+
+// SpoolOptionReplayBatchSize defines the maximum number of events replayed at once
+func SpoolOptionReplayBatchSize(size int) SpoolOption {
+	return func(c *spoolConfig) error {
+		if size < 1 {
+			return ErrInvalidBatchSize
+		}
+		c.replayBatchSize = size
+		return nil
+	}
+}
+
+func newSpoolConfig(options ...SpoolOption) (config spoolConfig, err error) {
+	config = spoolConfig{
+		mode:            SpoolModeFailed,
+		segmentSize:     DefaultSpoolSegmentSize,
+		maxSize:         DefaultSpoolMaxSize,
+		replayInterval:  DefaultSpoolReplayInterval,
+		replayBatchSize: DefaultSpoolReplayBatchSize,
+	}
+
+	for _, opt := range options {
+		if optErr := opt(&config); optErr != nil {
+			err = multierror.Append(err, optErr)
+		}
+	}
+	return
+}
+
+// SpoolStats contains information about the current state of the spool
+type SpoolStats struct {
+	// Segments is the number of segment files
+	Segments int
+	// Bytes is the total size of all segment files
+	Bytes int64
+	// Events is the number of events waiting to be replayed
+	Events int
+	// Dropped is the number of events dropped because of the size or age limits
+	Dropped uint64
+}
+
+type spoolSegment struct {
+	seq      uint64
+	path     string
+	size     int64
+	records  int
+	modified time.Time
+}
+
+// spool is a write-ahead log of events, split into segment files, which are replayed
+// to CloudLog in order and deleted once all their events have been pushed
+type spool struct {
+	dir     string
+	config  spoolConfig
+	encoder cloudlog.EventEncoder
+	push    func([]interface{}) error
+	onError func(error)
+
+	mutex    sync.Mutex
+	segments []*spoolSegment
+	active   *os.File
+	// readOffset and readRecords describe the replay position within segments[0]
+	readOffset  int64
+	readRecords int
+	size        int64
+	dropped     uint64
+
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func openSpool(dir string, config spoolConfig, push func([]interface{}) error, onError func(error)) (s *spool, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+
+	s = &spool{
+		dir:     dir,
+		config:  config,
+		encoder: cloudlog.NewAutomaticEventEncoder(),
+		push:    push,
+		onError: onError,
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err = s.recover(); err != nil {
+		return nil, err
+	}
+
+	go s.replayLoop()
+	return
+}
+
+// recover loads the segments left behind by a previous process, truncating every segment
+// at its first incomplete or corrupt record
+func (s *spool) recover() error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	acks := make(map[uint64]string)
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() && strings.HasSuffix(name, spoolAckExtension) {
+			if seq, parseErr := strconv.ParseUint(strings.TrimSuffix(name, spoolAckExtension), 10, 64); parseErr == nil {
+				acks[seq] = filepath.Join(s.dir, name)
+			}
+			continue
+		}
+		if info.IsDir() || !strings.HasSuffix(name, spoolSegmentExtension) {
+			continue
+		}
+		seq, parseErr := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExtension), 10, 64)
+		if parseErr != nil {
+			continue
+		}
+
+		segment := &spoolSegment{
+			seq:      seq,
+			path:     filepath.Join(s.dir, name),
+			modified: info.ModTime(),
+		}
+		if err = scanSegment(segment); err != nil {
+			return err
+		}
+		if segment.records == 0 {
+			if err = os.Remove(segment.path); err != nil {
+				return err
+			}
+			continue
+		}
+		s.segments = append(s.segments, segment)
+		s.size += segment.size
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].seq < s.segments[j].seq
+	})
+
+	// Only the oldest segment can be partially replayed, any other replay position is stale
+	for seq, path := range acks {
+		if len(s.segments) > 0 && s.segments[0].seq == seq {
+			continue
+		}
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(s.segments) > 0 {
+		return s.loadAck(s.segments[0])
+	}
+	return nil
+}
+
+func ackPath(segmentPath string) string {
+	return strings.TrimSuffix(segmentPath, spoolSegmentExtension) + spoolAckExtension
+}
+
+// loadAck restores the replay position of the segment persisted by a previous process.
+// A missing or invalid position replays the segment from its beginning.
+func (s *spool) loadAck(segment *spoolSegment) error {
+	data, err := ioutil.ReadFile(ackPath(segment.path))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(data) != spoolAckSize {
+		return nil
+	}
+
+	offset := int64(binary.BigEndian.Uint64(data[0:8]))
+	records := binary.BigEndian.Uint64(data[8:16])
+	if offset < 0 || offset > segment.size || records > uint64(segment.records) {
+		return nil
+	}
+	s.readOffset = offset
+	s.readRecords = int(records)
+	return nil
+}
+
+// persistAck records the replay position within the oldest segment, so a restarted process
+// does not replay the acknowledged events again
+func (s *spool) persistAck(segment *spoolSegment) error {
+	var data [spoolAckSize]byte
+	binary.BigEndian.PutUint64(data[0:8], uint64(s.readOffset))
+	binary.BigEndian.PutUint64(data[8:16], uint64(s.readRecords))
+
+	// Replace the file atomically, so a crash never leaves a torn replay position behind
+	path := ackPath(segment.path)
+	if err := ioutil.WriteFile(path+".tmp", data[:], 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// scanSegment counts the valid records of the segment and truncates it after the last one
+func scanSegment(segment *spoolSegment) (err error) {
+	var f *os.File
+	if f, err = os.OpenFile(segment.path, os.O_RDWR, 0600); err != nil {
+		return
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		_, n, readErr := readRecord(r)
+		if readErr == io.EOF {
+			return
+		} else if readErr != nil {
+			return f.Truncate(segment.size)
+		}
+		segment.size += n
+		segment.records++
+	}
+}
+
+// readRecord reads a single record consisting of the payload length, the CRC32 checksum
+// of the payload and the payload itself
+func readRecord(r io.Reader) (payload []byte, n int64, err error) {
+	var header [spoolHeaderSize]byte
+	if _, err = io.ReadFull(r, header[:]); err == io.EOF {
+		return
+	} else if err != nil {
+		err = errSpoolRecordCorrupt
+		return
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > spoolMaxRecordSize {
+		err = errSpoolRecordCorrupt
+		return
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		err = errSpoolRecordCorrupt
+		return
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		err = errSpoolRecordCorrupt
+		return
+	}
+
+	n = int64(spoolHeaderSize + len(payload))
+	return
+}
+
+func encodeRecord(payload []byte) []byte {
+	record := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[spoolHeaderSize:], payload)
+	return record
+}
+
+// pending returns true if the spool holds events which have not been replayed yet
+func (s *spool) pending() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.segments) > 0
+}
+
+// append writes the events to the active segment. Events which cannot be encoded are
+// skipped and reported by the returned error, the others are written nonetheless.
+func (s *spool) append(events ...interface{}) (err error) {
+	records := make([][]byte, 0, len(events))
+	for _, event := range events {
+		record, encodeErr := s.encodeRecord(event)
+		if encodeErr != nil {
+			err = multierror.Append(err, encodeErr)
+			continue
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, record := range records {
+		if appendErr := s.appendRecord(record); appendErr != nil {
+			return multierror.Append(err, appendErr)
+		}
+	}
+	s.enforceMaxSize()
+
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// encodeRecord encodes the event as the record written to a segment
+func (s *spool) encodeRecord(event interface{}) ([]byte, error) {
+	eventMap, err := encodeEvent(s.encoder, event)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(eventMap)
+	if err != nil {
+		return nil, cloudlog.NewMarshalError(eventMap, err)
+	}
+	return encodeRecord(payload), nil
+}
+
+func (s *spool) appendRecord(record []byte) (err error) {
+	var segment *spoolSegment
+	if s.active != nil {
+		segment = s.segments[len(s.segments)-1]
+		if segment.size >= s.config.segmentSize {
+			s.closeActive()
+		}
+	}
+
+	if s.active == nil {
+		var seq uint64 = 1
+		if len(s.segments) > 0 {
+			seq = s.segments[len(s.segments)-1].seq + 1
+		}
+		segment = &spoolSegment{
+			seq:  seq,
+			path: filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExtension)),
+		}
+		if s.active, err = os.OpenFile(segment.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return
+		}
+		s.segments = append(s.segments, segment)
+	}
+
+	if _, err = s.active.Write(record); err != nil {
+		return
+	}
+	segment.size += int64(len(record))
+	segment.records++
+	segment.modified = time.Now()
+	s.size += int64(len(record))
+	return
+}
+
+func (s *spool) closeActive() {
+	if s.active == nil {
+		return
+	}
+	if err := s.active.Close(); err != nil {
+		s.reportError(err)
+	}
+	s.active = nil
+}
+
+// isActive returns true if the segment is the one currently being written to
+func (s *spool) isActive(segment *spoolSegment) bool {
+	return s.active != nil && segment == s.segments[len(s.segments)-1]
+}
+
+// removeOldest deletes the oldest segment, counting its unreplayed events as dropped if requested
+func (s *spool) removeOldest(dropped bool) {
+	segment := s.segments[0]
+	if s.isActive(segment) {
+		s.closeActive()
+	}
+	if dropped {
+		s.dropped += uint64(segment.records - s.readRecords)
+	}
+	for _, path := range []string{segment.path, ackPath(segment.path)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			s.reportError(err)
+		}
+	}
+
+	s.size -= segment.size
+	s.segments = s.segments[1:]
+	s.readOffset = 0
+	s.readRecords = 0
+}
+
+func (s *spool) enforceMaxSize() {
+	for s.size > s.config.maxSize && len(s.segments) > 0 {
+		s.removeOldest(true)
+	}
+}
+
+func (s *spool) enforceMaxAge() {
+	if s.config.maxAge == 0 {
+		return
+	}
+	deadline := time.Now().Add(-s.config.maxAge)
+	for len(s.segments) > 0 && s.segments[0].modified.Before(deadline) {
+		s.removeOldest(true)
+	}
+}
+
+// read returns up to replayBatchSize events starting at the replay position. offsets[i] is the
+// position of the i-th event within the segment, offsets[len(events)] the position after the last.
+func (s *spool) read() (segment *spoolSegment, events []interface{}, offsets []int64, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.enforceMaxAge()
+	if len(s.segments) == 0 {
+		return
+	}
+	segment = s.segments[0]
+	offset := s.readOffset
+	offsets = append(offsets, offset)
+
+	var f *os.File
+	if f, err = os.Open(segment.path); err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+
+	r := bufio.NewReader(io.LimitReader(f, segment.size-offset))
+	for len(events) < s.config.replayBatchSize {
+		payload, n, readErr := readRecord(r)
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			err = readErr
+			return
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.UseNumber()
+		var event map[string]interface{}
+		if err = decoder.Decode(&event); err != nil {
+			return
+		}
+		events = append(events, event)
+		offset += n
+		offsets = append(offsets, offset)
+	}
+	return
+}
+
+// acknowledge advances the replay position and deletes the segment once it has been replayed
+func (s *spool) acknowledge(segment *spoolSegment, events int, offset int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The segment might have been dropped due to the size or age limits in the meantime
+	if len(s.segments) == 0 || s.segments[0] != segment {
+		return
+	}
+	s.readOffset = offset
+	s.readRecords += events
+	if s.readOffset >= segment.size {
+		s.removeOldest(false)
+	} else if err := s.persistAck(segment); err != nil {
+		s.reportError(err)
+	}
+}
+
+// replay pushes spooled events until the spool is empty or a push fails
+func (s *spool) replay() {
+	for {
+		segment, events, offsets, err := s.read()
+		if err != nil {
+			s.reportError(err)
+			if err == errSpoolRecordCorrupt {
+				s.discardCorrupt(segment)
+				continue
+			}
+			return
+		}
+		if segment == nil {
+			return
+		}
+
+		if len(events) > 0 {
+			if err = s.push(events); err != nil {
+				// Events in front of the first failed one have been pushed and must not be replayed again
+				if partial, ok := err.(*PartialPushError); ok && len(partial.Failed) > 0 {
+					first := partial.Failed[0].Index
+					s.acknowledge(segment, first, offsets[first])
+				}
+				s.reportError(err)
+				return
+			}
+		}
+		s.acknowledge(segment, len(events), offsets[len(events)])
+	}
+}
+
+// discardCorrupt drops the segment which contains a record that can not be read anymore
+func (s *spool) discardCorrupt(segment *spoolSegment) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.segments) > 0 && s.segments[0] == segment {
+		s.removeOldest(true)
+	}
+}
+
+func (s *spool) replayLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.config.replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.replay()
+		case <-s.kick:
+			if s.config.mode == SpoolModeDurable {
+				s.replay()
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// sync commits the active segment to stable storage
+func (s *spool) sync() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	return s.active.Sync()
+}
+
+// stats returns a snapshot of the spool's state
+func (s *spool) stats() (stats SpoolStats) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats.Segments = len(s.segments)
+	stats.Bytes = s.size
+	stats.Dropped = s.dropped
+	for _, segment := range s.segments {
+		stats.Events += segment.records
+	}
+	stats.Events -= s.readRecords
+	return
+}
+
+// shutdown stops the replayer and closes the active segment, leaving all unreplayed
+// events on disk for the next process
+func (s *spool) shutdown() (err error) {
+	close(s.stop)
+	<-s.done
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.active != nil {
+		err = s.active.Close()
+		s.active = nil
+	}
+	return
+}
+
+func (s *spool) reportError(err error) {
+	if s.onError != nil {
+		s.onError(err)
+	}
+}
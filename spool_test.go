@@ -0,0 +1,391 @@
+package cloudlogzap
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+var errMockPushFailed = errors.New("push failed")
+
+// MockFailingCloudlogClient fails the first Failures calls and records all events pushed afterwards
+type MockFailingCloudlogClient struct {
+	mutex    sync.Mutex
+	Failures int
+	calls    int
+	events   []interface{}
+}
+
+func (client *MockFailingCloudlogClient) PushEvent(e interface{}) error {
+	return client.PushEvents(e)
+}
+
+func (client *MockFailingCloudlogClient) PushEvents(events ...interface{}) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.calls++
+	if client.calls <= client.Failures {
+		return errMockPushFailed
+	}
+	client.events = append(client.events, events...)
+	return nil
+}
+
+func (client *MockFailingCloudlogClient) Calls() int {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.calls
+}
+
+func (client *MockFailingCloudlogClient) Events() []interface{} {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return append([]interface{}(nil), client.events...)
+}
+
+// Messages returns the messages of all pushed events, which may either be documents
+// or maps read back from the spool
+func (client *MockFailingCloudlogClient) Messages() (messages []string) {
+	for _, event := range client.Events() {
+		switch e := event.(type) {
+		case document:
+			messages = append(messages, e.Message)
+		case map[string]interface{}:
+			messages = append(messages, e["message"].(string))
+		}
+	}
+	return
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newSpoolTestCore(t *testing.T, client CloudlogClient, dir string, options ...SpoolOption) *CloudLogCore {
+	core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+	require.NoError(t, err)
+	core.client = client
+	require.NoError(t, core.EnableSpool(dir, options...))
+	return core
+}
+
+func writeMessages(t *testing.T, core zapcore.Core, from, to int) {
+	for i := from; i <= to; i++ {
+		require.NoError(t, core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: strconv.Itoa(i)}, nil))
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExtension))
+	require.NoError(t, err)
+	return files
+}
+
+func TestNewSpoolConfig(t *testing.T) {
+	_, err := newSpoolConfig(
+		SpoolOptionMode(SpoolMode(42)),
+		SpoolOptionSegmentSize(0),
+		SpoolOptionMaxSize(0),
+		SpoolOptionMaxAge(-time.Second),
+		SpoolOptionReplayInterval(0),
+		SpoolOptionReplayBatchSize(0),
+	)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "6 errors occurred")
+}
+
+func TestCloudLogCore_EnableSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlogzap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	core := newSpoolTestCore(t, &MockFailingCloudlogClient{}, dir)
+	defer core.spool.shutdown()
+	assert.EqualValues(t, ErrSpoolAlreadyEnabled, core.EnableSpool(dir))
+}
+
+func TestSpool(t *testing.T) {
+	t.Run("FailedMode", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		client := &MockFailingCloudlogClient{Failures: 3}
+		core := newSpoolTestCore(t, client, dir, SpoolOptionReplayInterval(10*time.Millisecond))
+		defer core.spool.shutdown()
+
+		// The first push fails, all following events are spooled behind it to keep their order
+		writeMessages(t, core, 1, 5)
+		assert.EqualValues(t, 1, client.Calls())
+		assert.EqualValues(t, 5, core.SpoolStats().Events)
+
+		waitFor(t, func() bool { return len(client.Events()) == 5 })
+		assert.EqualValues(t, []string{"1", "2", "3", "4", "5"}, client.Messages())
+		waitFor(t, func() bool { return len(segmentFiles(t, dir)) == 0 })
+		assert.EqualValues(t, SpoolStats{}, core.SpoolStats())
+
+		// Once the spool is empty events are pushed directly again
+		writeMessages(t, core, 6, 6)
+		assert.EqualValues(t, []string{"1", "2", "3", "4", "5", "6"}, client.Messages())
+	})
+
+	t.Run("DurableMode", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		client := &MockFailingCloudlogClient{}
+		core := newSpoolTestCore(t, client, dir,
+			SpoolOptionMode(SpoolModeDurable), SpoolOptionReplayInterval(time.Hour))
+		defer core.spool.shutdown()
+
+		writeMessages(t, core, 1, 3)
+		waitFor(t, func() bool { return len(client.Events()) == 3 })
+		assert.EqualValues(t, []string{"1", "2", "3"}, client.Messages())
+		waitFor(t, func() bool { return len(segmentFiles(t, dir)) == 0 })
+	})
+
+	t.Run("CrashRecovery", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		failing := &MockFailingCloudlogClient{Failures: 1 << 30}
+		core := newSpoolTestCore(t, failing, dir, SpoolOptionReplayInterval(time.Hour))
+		writeMessages(t, core, 1, 3)
+		require.NoError(t, core.spool.shutdown())
+
+		// Simulate a torn write at the end of the segment
+		files := segmentFiles(t, dir)
+		require.Len(t, files, 1)
+		f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0600)
+		require.NoError(t, err)
+		_, err = f.Write([]byte{0, 0, 1, 0, 42})
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		client := &MockFailingCloudlogClient{}
+		core = newSpoolTestCore(t, client, dir, SpoolOptionReplayInterval(10*time.Millisecond))
+		defer core.spool.shutdown()
+		assert.EqualValues(t, 3, core.SpoolStats().Events)
+
+		waitFor(t, func() bool { return len(client.Events()) == 3 })
+		assert.EqualValues(t, []string{"1", "2", "3"}, client.Messages())
+	})
+
+	t.Run("AcknowledgedRecovery", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		failing := &MockFailingCloudlogClient{Failures: 1 << 30}
+		core := newSpoolTestCore(t, failing, dir, SpoolOptionReplayInterval(time.Hour))
+		writeMessages(t, core, 1, 3)
+		require.NoError(t, core.spool.shutdown())
+
+		// Acknowledge the first two events and stop before the segment has been replayed entirely
+		core = newSpoolTestCore(t, failing, dir,
+			SpoolOptionReplayInterval(time.Hour), SpoolOptionReplayBatchSize(2))
+		segment, events, offsets, err := core.spool.read()
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		core.spool.acknowledge(segment, len(events), offsets[len(events)])
+		require.NoError(t, core.spool.shutdown())
+
+		client := &MockFailingCloudlogClient{}
+		core = newSpoolTestCore(t, client, dir, SpoolOptionReplayInterval(10*time.Millisecond))
+		defer core.spool.shutdown()
+		assert.EqualValues(t, 1, core.SpoolStats().Events)
+
+		waitFor(t, func() bool { return len(segmentFiles(t, dir)) == 0 })
+		assert.EqualValues(t, []string{"3"}, client.Messages())
+		acks, err := filepath.Glob(filepath.Join(dir, "*"+spoolAckExtension))
+		require.NoError(t, err)
+		assert.Empty(t, acks)
+	})
+
+	t.Run("PartialReplay", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		failing := &MockFailingCloudlogClient{Failures: 1 << 30}
+		core := newSpoolTestCore(t, failing, dir, SpoolOptionReplayInterval(time.Hour))
+		writeMessages(t, core, 1, 3)
+		require.NoError(t, core.spool.shutdown())
+
+		// The second event fails once, the first one has been pushed and is not replayed again
+		failed := false
+		client := &MockSelectiveCloudlogClient{fail: func(e interface{}) bool {
+			if e.(map[string]interface{})["message"] == "2" && !failed {
+				failed = true
+				return true
+			}
+			return false
+		}}
+		core = newSpoolTestCore(t, client, dir, SpoolOptionReplayInterval(10*time.Millisecond))
+		defer core.spool.shutdown()
+
+		waitFor(t, func() bool { return len(segmentFiles(t, dir)) == 0 })
+		var messages []interface{}
+		for _, event := range client.Calls() {
+			messages = append(messages, event.(map[string]interface{})["message"])
+		}
+		assert.EqualValues(t, []interface{}{"1", "2", "3", "2", "3"}, messages)
+	})
+
+	t.Run("Checksum", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		failing := &MockFailingCloudlogClient{Failures: 1 << 30}
+		core := newSpoolTestCore(t, failing, dir, SpoolOptionReplayInterval(time.Hour))
+		writeMessages(t, core, 1, 3)
+		stats := core.SpoolStats()
+		require.NoError(t, core.spool.shutdown())
+
+		// Flip the last byte of the last record
+		files := segmentFiles(t, dir)
+		require.Len(t, files, 1)
+		data, err := ioutil.ReadFile(files[0])
+		require.NoError(t, err)
+		require.EqualValues(t, stats.Bytes, len(data))
+		data[len(data)-2] ^= 0xff
+		require.NoError(t, ioutil.WriteFile(files[0], data, 0600))
+
+		client := &MockFailingCloudlogClient{}
+		core = newSpoolTestCore(t, client, dir, SpoolOptionReplayInterval(10*time.Millisecond))
+		defer core.spool.shutdown()
+		assert.EqualValues(t, 2, core.SpoolStats().Events)
+
+		waitFor(t, func() bool { return len(client.Events()) == 2 })
+		assert.EqualValues(t, []string{"1", "2"}, client.Messages())
+	})
+
+	t.Run("Segments", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		client := &MockFailingCloudlogClient{Failures: 1}
+		core := newSpoolTestCore(t, client, dir,
+			SpoolOptionSegmentSize(1), SpoolOptionReplayInterval(time.Hour))
+		defer core.spool.shutdown()
+
+		writeMessages(t, core, 1, 4)
+		assert.Len(t, segmentFiles(t, dir), 4)
+		assert.EqualValues(t, 4, core.SpoolStats().Segments)
+
+		core.spool.replay()
+		assert.EqualValues(t, []string{"1", "2", "3", "4"}, client.Messages())
+		assert.Len(t, segmentFiles(t, dir), 0)
+	})
+
+	t.Run("MaxSize", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		client := &MockFailingCloudlogClient{Failures: 1}
+		core := newSpoolTestCore(t, client, dir, SpoolOptionSegmentSize(1), SpoolOptionReplayInterval(time.Hour))
+		writeMessages(t, core, 1, 1)
+		recordSize := core.SpoolStats().Bytes
+		require.NoError(t, core.spool.shutdown())
+		require.NoError(t, os.RemoveAll(dir))
+
+		client = &MockFailingCloudlogClient{Failures: 1}
+		core = newSpoolTestCore(t, client, dir,
+			SpoolOptionSegmentSize(1), SpoolOptionMaxSize(3*recordSize), SpoolOptionReplayInterval(time.Hour))
+		defer core.spool.shutdown()
+
+		writeMessages(t, core, 1, 5)
+		stats := core.SpoolStats()
+		assert.EqualValues(t, 3, stats.Events)
+		assert.EqualValues(t, 2, stats.Dropped)
+		assert.True(t, stats.Bytes <= 3*recordSize)
+
+		core.spool.replay()
+		assert.EqualValues(t, []string{"3", "4", "5"}, client.Messages())
+	})
+
+	t.Run("MaxAge", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		client := &MockFailingCloudlogClient{Failures: 1}
+		core := newSpoolTestCore(t, client, dir,
+			SpoolOptionSegmentSize(1), SpoolOptionMaxAge(50*time.Millisecond), SpoolOptionReplayInterval(time.Hour))
+		defer core.spool.shutdown()
+
+		writeMessages(t, core, 1, 2)
+		time.Sleep(100 * time.Millisecond)
+		writeMessages(t, core, 3, 3)
+
+		core.spool.replay()
+		assert.EqualValues(t, []string{"3"}, client.Messages())
+		assert.EqualValues(t, 2, core.SpoolStats().Dropped)
+	})
+
+	t.Run("Unencodable", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		client := &MockFailingCloudlogClient{}
+		core := newSpoolTestCore(t, client, dir, SpoolOptionReplayInterval(time.Hour))
+		defer core.spool.shutdown()
+
+		// Events which cannot be encoded do not prevent the others from being spooled
+		err = core.spool.append(
+			map[string]interface{}{"message": "1"},
+			42,
+			map[string]interface{}{"message": "2", "channel": make(chan int)},
+			map[string]interface{}{"message": "3"},
+		)
+		require.IsType(t, &multierror.Error{}, err)
+		errs := err.(*multierror.Error).Errors
+		require.Len(t, errs, 2)
+		assert.IsType(t, &cloudlog.EventEncodingError{}, errs[0])
+		assert.IsType(t, &cloudlog.MarshalError{}, errs[1])
+		assert.EqualValues(t, 2, core.SpoolStats().Events)
+
+		core.spool.replay()
+		assert.EqualValues(t, []string{"1", "3"}, client.Messages())
+	})
+
+	t.Run("Async", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cloudlogzap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		client := &MockFailingCloudlogClient{Failures: 2}
+		core := newSpoolTestCore(t, client, dir, SpoolOptionReplayInterval(10*time.Millisecond))
+		defer core.spool.shutdown()
+		require.NoError(t, core.EnableAsync(AsyncOptionBatchSize(2), AsyncOptionFlushInterval(time.Hour)))
+		defer core.async.shutdown()
+
+		writeMessages(t, core, 1, 6)
+		require.NoError(t, core.Sync())
+		waitFor(t, func() bool { return len(client.Events()) == 6 })
+		assert.EqualValues(t, []string{"1", "2", "3", "4", "5", "6"}, client.Messages())
+	})
+}
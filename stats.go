@@ -0,0 +1,349 @@
+package cloudlogzap
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// ErrorClassEncoding classifies errors encoding or marshalling an event
+	ErrorClassEncoding = "encoding"
+	// ErrorClassConfiguration classifies errors caused by the client configuration, like a missing index
+	ErrorClassConfiguration = "configuration"
+	// ErrorClassTransport classifies all other errors, like unreachable brokers
+	ErrorClassTransport = "transport"
+)
+
+// pushLatencyBuckets defines the upper bounds of the push latency histogram buckets
+var pushLatencyBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// ErrorClass returns the class of an error returned by a CloudlogClient
+func ErrorClass(err error) string {
+	switch err.(type) {
+	case *cloudlog.EventEncodingError, *cloudlog.MarshalError:
+		return ErrorClassEncoding
+	}
+	if err == cloudlog.ErrIndexNotDefined {
+		return ErrorClassConfiguration
+	}
+	return ErrorClassTransport
+}
+
+// Stats is a snapshot of the core's self-telemetry
+type Stats struct {
+	// EntriesWritten is the number of entries written to the core
+	EntriesWritten uint64 `json:"entries_written"`
+	// EventsPushed is the number of events pushed to CloudLog successfully
+	EventsPushed uint64 `json:"events_pushed"`
+	// BytesSent is the size of the JSON encoding of the pushed events, excluding the fields added
+	// by the CloudLog client. It is only counted if enabled using CoreOptionStatsBytesSent.
+	BytesSent uint64 `json:"bytes_sent"`
+	// PushFailures is the number of events which could not be pushed by ErrorClass
+	PushFailures map[string]uint64 `json:"push_failures"`
+	// Retries is the number of retries of the RetryingClients used by the core, either enabled
+	// using EnableRetry or wrapped by the client
+	Retries uint64 `json:"retries"`
+	// ShortCircuited is the number of events rejected by the open circuit breaker
+	ShortCircuited uint64 `json:"short_circuited"`
+	// ShortCircuitDropped is the number of queued events rejected by the open circuit breaker,
+	// which have been dropped because they could not be passed to the fallback
+	ShortCircuitDropped uint64 `json:"short_circuit_dropped"`
+	// Dropped is the number of events dropped by the overflow policy
+	Dropped OverflowCounters `json:"dropped"`
+	// ErrorsSuppressed is the number of errors not passed to the ErrorHandler
+	ErrorsSuppressed uint64 `json:"errors_suppressed"`
+	// QueueDepth is the number of events waiting in the asynchronous queue
+	QueueDepth int `json:"queue_depth"`
+	// QueueCapacity is the capacity of the asynchronous queue
+	QueueCapacity int `json:"queue_capacity"`
+	// Spool describes the state of the spool
+	Spool SpoolStats `json:"spool"`
+	// CertificateReloads is the number of times the client has been recreated because its
+	// certificate files have changed
+	CertificateReloads uint64 `json:"certificate_reloads"`
+	// CertificateReloadFailures is the number of failed attempts to reload the certificate files
+	CertificateReloadFailures uint64 `json:"certificate_reload_failures"`
+	// ClientCertificateNotAfter is the expiry of the client certificate configured using Config,
+	// zero if unknown
+	ClientCertificateNotAfter time.Time `json:"client_certificate_not_after"`
+	// CACertificateNotAfter is the earliest expiry of the CA certificates configured using Config,
+	// zero if unknown
+	CACertificateNotAfter time.Time `json:"ca_certificate_not_after"`
+	// PushLatency is the histogram of the time spent per push
+	PushLatency LatencyHistogram `json:"push_latency"`
+}
+
+// LatencyHistogram is a snapshot of a latency histogram
+type LatencyHistogram struct {
+	// Buckets holds the upper bounds of the buckets
+	Buckets []time.Duration `json:"buckets"`
+	// Counts holds the number of observations per bucket, the last count holds the
+	// observations exceeding the largest bound
+	Counts []uint64 `json:"counts"`
+	// Count is the total number of observations
+	Count uint64 `json:"count"`
+	// Sum is the total of all observations
+	Sum time.Duration `json:"sum"`
+}
+
+// coreStats collects the counters shared by a core and all of its clones
+type coreStats struct {
+	entriesWritten uint64
+	eventsPushed   uint64
+	bytesSent      uint64
+	latencyCount   uint64
+	latencySum     int64
+
+	countBytes bool
+	encoder    cloudlog.EventEncoder
+
+	latencyCounts []uint64
+
+	failuresMutex sync.Mutex
+	failures      map[string]uint64
+}
+
+func newCoreStats() *coreStats {
+	return &coreStats{
+		encoder:       cloudlog.NewAutomaticEventEncoder(),
+		latencyCounts: make([]uint64, len(pushLatencyBuckets)+1),
+		failures:      make(map[string]uint64),
+	}
+}
+
+// observePush records the outcome of pushing the events
+func (s *coreStats) observePush(events []interface{}, err error, latency time.Duration) {
+	bucket := sort.Search(len(pushLatencyBuckets), func(i int) bool {
+		return latency <= pushLatencyBuckets[i]
+	})
+	atomic.AddUint64(&s.latencyCounts[bucket], 1)
+	atomic.AddUint64(&s.latencyCount, 1)
+	atomic.AddInt64(&s.latencySum, int64(latency))
+
+	pushed := events
+	if err != nil {
+		pushed = s.observeFailures(events, err)
+	}
+	atomic.AddUint64(&s.eventsPushed, uint64(len(pushed)))
+
+	if s.countBytes {
+		for _, event := range pushed {
+			_, event = unwrapEvent(event)
+			if eventMap, encodeErr := s.encoder.EncodeEvent(event); encodeErr == nil {
+				if data, marshalErr := json.Marshal(eventMap); marshalErr == nil {
+					atomic.AddUint64(&s.bytesSent, uint64(len(data)))
+				}
+			}
+		}
+	}
+}
+
+// observeFailures counts the failed events by error class and returns the events which
+// have been pushed in spite of the error
+func (s *coreStats) observeFailures(events []interface{}, err error) (pushed []interface{}) {
+	s.failuresMutex.Lock()
+	defer s.failuresMutex.Unlock()
+
+	partial, ok := err.(*PartialPushError)
+	if !ok {
+		class := ErrorClass(err)
+		if merr, ok := err.(*multierror.Error); ok && len(merr.Errors) > 0 {
+			class = ErrorClass(merr.Errors[0])
+		}
+		s.failures[class] += uint64(len(events))
+		return nil
+	}
+
+	failed := make(map[int]bool, len(partial.Failed))
+	for _, eventErr := range partial.Failed {
+		s.failures[ErrorClass(eventErr.Err)]++
+		failed[eventErr.Index] = true
+	}
+	for i, event := range events {
+		if !failed[i] {
+			pushed = append(pushed, event)
+		}
+	}
+	return
+}
+
+func (s *coreStats) snapshot() Stats {
+	stats := Stats{
+		EntriesWritten: atomic.LoadUint64(&s.entriesWritten),
+		EventsPushed:   atomic.LoadUint64(&s.eventsPushed),
+		BytesSent:      atomic.LoadUint64(&s.bytesSent),
+		PushFailures:   make(map[string]uint64),
+		PushLatency: LatencyHistogram{
+			Buckets: append([]time.Duration(nil), pushLatencyBuckets...),
+			Counts:  make([]uint64, len(s.latencyCounts)),
+			Count:   atomic.LoadUint64(&s.latencyCount),
+			Sum:     time.Duration(atomic.LoadInt64(&s.latencySum)),
+		},
+	}
+	for i := range s.latencyCounts {
+		stats.PushLatency.Counts[i] = atomic.LoadUint64(&s.latencyCounts[i])
+	}
+
+	s.failuresMutex.Lock()
+	for class, count := range s.failures {
+		stats.PushFailures[class] = count
+	}
+	s.failuresMutex.Unlock()
+	return stats
+}
+
+// retryCounter is implemented by the RetryingClient and the clients wrapping other clients,
+// which report the retries of the RetryingClients they wrap
+type retryCounter interface {
+	Retries() uint64
+}
+
+// retries returns the retries of the client if it counts them
+func retries(client CloudlogClient) uint64 {
+	if counter, ok := client.(retryCounter); ok {
+		return counter.Retries()
+	}
+	return 0
+}
+
+// Stats returns a snapshot of the core's self-telemetry, which is shared by all of its clones
+func (cc *CloudLogCore) Stats() Stats {
+	stats := cc.stats.snapshot()
+	stats.Retries = retries(cc.client)
+	if cc.breaker != nil {
+		stats.ShortCircuited = cc.breaker.Rejected()
+		stats.ShortCircuitDropped = cc.breaker.Dropped()
+	}
+	stats.Dropped = cc.OverflowCounters()
+	stats.ErrorsSuppressed = cc.errors.droppedErrors()
+	if cc.async != nil {
+		stats.QueueDepth = len(cc.async.queue)
+		stats.QueueCapacity = cap(cc.async.queue)
+	}
+	stats.Spool = cc.SpoolStats()
+	if cc.reloader != nil {
+		stats.CertificateReloads = atomic.LoadUint64(&cc.reloader.reloads)
+		stats.CertificateReloadFailures = atomic.LoadUint64(&cc.reloader.failures)
+	}
+	if cc.certificates != nil {
+		stats.ClientCertificateNotAfter, stats.CACertificateNotAfter = cc.certificates.expiry()
+	}
+	return stats
+}
+
+// PublishExpvar publishes the core's Stats as expvar variable of the supplied name
+func (cc *CloudLogCore) PublishExpvar(name string) error {
+	if expvar.Get(name) != nil {
+		return ErrExpvarExists
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return cc.Stats()
+	}))
+	return nil
+}
+
+// StatsHandler returns an http.Handler exposing the core's Stats in the Prometheus text format
+func (cc *CloudLogCore) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheus(w, cc.Stats())
+	})
+}
+
+// writePrometheus writes the stats in the Prometheus text exposition format
+func writePrometheus(w io.Writer, stats Stats) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP cloudlogzap_%s %s\n# TYPE cloudlogzap_%s %s\n", name, help, name, kind)
+	}
+
+	metric("entries_written_total", "counter", "Entries written to the CloudLog core.")
+	fmt.Fprintf(w, "cloudlogzap_entries_written_total %d\n", stats.EntriesWritten)
+	metric("events_pushed_total", "counter", "Events pushed to CloudLog successfully.")
+	fmt.Fprintf(w, "cloudlogzap_events_pushed_total %d\n", stats.EventsPushed)
+	metric("bytes_sent_total", "counter", "Size of the JSON encoding of the pushed events.")
+	fmt.Fprintf(w, "cloudlogzap_bytes_sent_total %d\n", stats.BytesSent)
+
+	metric("push_failures_total", "counter", "Events which could not be pushed to CloudLog by error class.")
+	for _, class := range []string{ErrorClassConfiguration, ErrorClassEncoding, ErrorClassTransport} {
+		fmt.Fprintf(w, "cloudlogzap_push_failures_total{class=%q} %d\n", class, stats.PushFailures[class])
+	}
+
+	metric("retries_total", "counter", "Retried pushes.")
+	fmt.Fprintf(w, "cloudlogzap_retries_total %d\n", stats.Retries)
+	metric("short_circuited_total", "counter", "Events rejected by the open circuit breaker.")
+	fmt.Fprintf(w, "cloudlogzap_short_circuited_total %d\n", stats.ShortCircuited)
+
+	metric("dropped_total", "counter", "Events dropped by the overflow policy, the spool limits or the circuit breaker.")
+	fmt.Fprintf(w, "cloudlogzap_dropped_total{reason=\"overflow_newest\"} %d\n", stats.Dropped.DroppedNewest)
+	fmt.Fprintf(w, "cloudlogzap_dropped_total{reason=\"overflow_oldest\"} %d\n", stats.Dropped.DroppedOldest)
+	fmt.Fprintf(w, "cloudlogzap_dropped_total{reason=\"overflow_below_level\"} %d\n", stats.Dropped.DroppedBelowLevel)
+	fmt.Fprintf(w, "cloudlogzap_dropped_total{reason=\"spool\"} %d\n", stats.Spool.Dropped)
+	fmt.Fprintf(w, "cloudlogzap_dropped_total{reason=\"short_circuit\"} %d\n", stats.ShortCircuitDropped)
+
+	metric("errors_suppressed_total", "counter", "Errors not passed to the error handler.")
+	fmt.Fprintf(w, "cloudlogzap_errors_suppressed_total %d\n", stats.ErrorsSuppressed)
+
+	metric("queue_depth", "gauge", "Events waiting in the asynchronous queue.")
+	fmt.Fprintf(w, "cloudlogzap_queue_depth %d\n", stats.QueueDepth)
+	metric("queue_capacity", "gauge", "Capacity of the asynchronous queue.")
+	fmt.Fprintf(w, "cloudlogzap_queue_capacity %d\n", stats.QueueCapacity)
+	metric("spool_events", "gauge", "Events waiting in the spool.")
+	fmt.Fprintf(w, "cloudlogzap_spool_events %d\n", stats.Spool.Events)
+	metric("spool_bytes", "gauge", "Size of the spool segment files.")
+	fmt.Fprintf(w, "cloudlogzap_spool_bytes %d\n", stats.Spool.Bytes)
+
+	metric("certificate_reloads_total", "counter", "Clients recreated because their certificate files have changed.")
+	fmt.Fprintf(w, "cloudlogzap_certificate_reloads_total %d\n", stats.CertificateReloads)
+	metric("certificate_reload_failures_total", "counter", "Failed attempts to reload the certificate files.")
+	fmt.Fprintf(w, "cloudlogzap_certificate_reload_failures_total %d\n", stats.CertificateReloadFailures)
+
+	metric("certificate_expiry_timestamp_seconds", "gauge", "Expiry of the configured certificates.")
+	for _, certificate := range []struct {
+		name     string
+		notAfter time.Time
+	}{
+		{certificateClient, stats.ClientCertificateNotAfter},
+		{certificateCA, stats.CACertificateNotAfter},
+	} {
+		if !certificate.notAfter.IsZero() {
+			fmt.Fprintf(w, "cloudlogzap_certificate_expiry_timestamp_seconds{certificate=%q} %d\n",
+				certificate.name, certificate.notAfter.Unix())
+		}
+	}
+
+	metric("push_duration_seconds", "histogram", "Time spent per push.")
+	var cumulative uint64
+	for i, bound := range stats.PushLatency.Buckets {
+		cumulative += stats.PushLatency.Counts[i]
+		fmt.Fprintf(w, "cloudlogzap_push_duration_seconds_bucket{le=\"%g\"} %d\n", bound.Seconds(), cumulative)
+	}
+	// Derive the count from the buckets, as the snapshot of the counters is not atomic
+	cumulative += stats.PushLatency.Counts[len(stats.PushLatency.Buckets)]
+	fmt.Fprintf(w, "cloudlogzap_push_duration_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(w, "cloudlogzap_push_duration_seconds_sum %g\n", stats.PushLatency.Sum.Seconds())
+	fmt.Fprintf(w, "cloudlogzap_push_duration_seconds_count %d\n", cumulative)
+}
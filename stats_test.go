@@ -0,0 +1,156 @@
+package cloudlogzap
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestErrorClass(t *testing.T) {
+	assert.EqualValues(t, ErrorClassEncoding, ErrorClass(cloudlog.NewUnsupportedEventType(42)))
+	assert.EqualValues(t, ErrorClassEncoding, ErrorClass(cloudlog.NewMarshalError(nil, errors.New("marshal"))))
+	assert.EqualValues(t, ErrorClassConfiguration, ErrorClass(cloudlog.ErrIndexNotDefined))
+	assert.EqualValues(t, ErrorClassTransport, ErrorClass(errMockPushFailed))
+}
+
+func newStatsTestCore(t *testing.T, options ...CoreOption) (*CloudLogCore, *MockSelectiveCloudlogClient) {
+	client := &MockSelectiveCloudlogClient{fail: func(event interface{}) bool {
+		return event.(document).Message == "2"
+	}}
+	core, err := NewCloudlogCoreWithClient(zapcore.NewNopCore(), client, options...)
+	require.NoError(t, err)
+	return core, client
+}
+
+func TestCloudLogCore_Stats(t *testing.T) {
+	t.Run("Sync", func(t *testing.T) {
+		core, _ := newStatsTestCore(t)
+		for i := 1; i <= 3; i++ {
+			core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: string(rune('0' + i))}, nil)
+		}
+
+		stats := core.Stats()
+		assert.EqualValues(t, 3, stats.EntriesWritten)
+		assert.EqualValues(t, 2, stats.EventsPushed)
+		assert.EqualValues(t, 0, stats.BytesSent)
+		assert.EqualValues(t, map[string]uint64{ErrorClassTransport: 1}, stats.PushFailures)
+		assert.EqualValues(t, 3, stats.PushLatency.Count)
+		assert.Len(t, stats.PushLatency.Buckets, len(pushLatencyBuckets))
+		assert.Len(t, stats.PushLatency.Counts, len(pushLatencyBuckets)+1)
+		assert.EqualValues(t, 0, stats.QueueCapacity)
+	})
+
+	t.Run("Async", func(t *testing.T) {
+		core, _ := newStatsTestCore(t, CoreOptionAsync(
+			AsyncOptionQueueCapacity(10),
+			AsyncOptionBatchSize(3),
+			AsyncOptionFlushInterval(time.Hour),
+		))
+		defer core.Close()
+		writeMessages(t, core, 1, 3)
+		require.NoError(t, core.Sync())
+
+		stats := core.Stats()
+		assert.EqualValues(t, 3, stats.EntriesWritten)
+		assert.EqualValues(t, 2, stats.EventsPushed)
+		assert.EqualValues(t, map[string]uint64{ErrorClassTransport: 1}, stats.PushFailures)
+		assert.EqualValues(t, 1, stats.PushLatency.Count)
+		assert.EqualValues(t, 0, stats.QueueDepth)
+		assert.EqualValues(t, 10, stats.QueueCapacity)
+	})
+
+	t.Run("BytesSent", func(t *testing.T) {
+		core, client := newStatsTestCore(t, CoreOptionStatsBytesSent())
+		writeMessages(t, core, 1, 1)
+
+		eventMap, err := cloudlog.NewAutomaticEventEncoder().EncodeEvent(client.Pushed()[0])
+		require.NoError(t, err)
+		data, err := json.Marshal(eventMap)
+		require.NoError(t, err)
+		assert.EqualValues(t, len(data), core.Stats().BytesSent)
+	})
+
+	t.Run("Retries", func(t *testing.T) {
+		core, err := NewCloudlogCoreWithClient(zapcore.NewNopCore(), &MockFailingCloudlogClient{Failures: 1})
+		require.NoError(t, err)
+		require.NoError(t, core.EnableRetry())
+		core.client.(*RetryingClient).sleep = func(time.Duration) {}
+
+		writeMessages(t, core, 1, 1)
+		stats := core.Stats()
+		assert.EqualValues(t, 1, stats.Retries)
+		assert.EqualValues(t, 1, stats.EventsPushed)
+		assert.Empty(t, stats.PushFailures)
+	})
+
+	t.Run("WrappedRetries", func(t *testing.T) {
+		client, err := NewRetryingClient(&MockFailingCloudlogClient{Failures: 2})
+		require.NoError(t, err)
+		client.sleep = func(time.Duration) {}
+		core, err := NewCloudlogCoreWithClient(zapcore.NewNopCore(), struct{ *RetryingClient }{client})
+		require.NoError(t, err)
+
+		writeMessages(t, core, 1, 1)
+		assert.EqualValues(t, 2, core.Stats().Retries)
+	})
+
+	t.Run("MultiError", func(t *testing.T) {
+		s := newCoreStats()
+		s.observePush([]interface{}{"a", "b"}, multierror.Append(nil, cloudlog.ErrIndexNotDefined), time.Hour)
+		stats := s.snapshot()
+		assert.EqualValues(t, map[string]uint64{ErrorClassConfiguration: 2}, stats.PushFailures)
+		assert.EqualValues(t, 1, stats.PushLatency.Counts[len(pushLatencyBuckets)])
+		assert.EqualValues(t, time.Hour, stats.PushLatency.Sum)
+	})
+}
+
+func TestCloudLogCore_StatsHandler(t *testing.T) {
+	core, _ := newStatsTestCore(t)
+	writeMessages(t, core, 1, 1)
+	core.Write(zapcore.Entry{Level: zapcore.InfoLevel, Message: "2"}, nil)
+
+	recorder := httptest.NewRecorder()
+	core.StatsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.EqualValues(t, http.StatusOK, recorder.Code)
+	assert.EqualValues(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE cloudlogzap_entries_written_total counter\n",
+		"cloudlogzap_entries_written_total 2\n",
+		"cloudlogzap_events_pushed_total 1\n",
+		"cloudlogzap_push_failures_total{class=\"transport\"} 1\n",
+		"cloudlogzap_push_failures_total{class=\"encoding\"} 0\n",
+		"cloudlogzap_dropped_total{reason=\"overflow_newest\"} 0\n",
+		"cloudlogzap_dropped_total{reason=\"short_circuit\"} 0\n",
+		"# TYPE cloudlogzap_push_duration_seconds histogram\n",
+		"cloudlogzap_push_duration_seconds_bucket{le=\"10\"} 2\n",
+		"cloudlogzap_push_duration_seconds_bucket{le=\"+Inf\"} 2\n",
+		"cloudlogzap_push_duration_seconds_count 2\n",
+	} {
+		assert.Contains(t, body, line)
+	}
+}
+
+func TestCloudLogCore_PublishExpvar(t *testing.T) {
+	core, _ := newStatsTestCore(t)
+	writeMessages(t, core, 1, 1)
+
+	require.NoError(t, core.PublishExpvar("cloudlogzap_test"))
+	assert.EqualValues(t, ErrExpvarExists, core.PublishExpvar("cloudlogzap_test"))
+
+	var stats Stats
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("cloudlogzap_test").String()), &stats))
+	assert.EqualValues(t, 1, stats.EntriesWritten)
+	assert.EqualValues(t, 1, stats.EventsPushed)
+}
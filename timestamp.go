@@ -0,0 +1,39 @@
+package cloudlogzap
+
+import (
+	"time"
+)
+
+// TimestampPrecision defines the precision of the timestamps sent to CloudLog
+type TimestampPrecision int
+
+const (
+	// TimestampMillisecond sends the entry's time as Unix millisecond timestamp,
+	// as expected by CloudLog
+	TimestampMillisecond TimestampPrecision = iota
+	// TimestampNanosecond additionally sends the nanoseconds within the millisecond
+	// in the timestamp_nanos field
+	TimestampNanosecond
+)
+
+// splitTimestamp returns the Unix millisecond timestamp of t and, if requested by the
+// precision, the remaining nanoseconds within that millisecond
+func splitTimestamp(t time.Time, precision TimestampPrecision) (millis, nanos int64) {
+	if t.IsZero() {
+		return
+	}
+
+	unixNanos := t.UnixNano()
+	millis = unixNanos / int64(time.Millisecond)
+	if precision == TimestampNanosecond {
+		nanos = unixNanos - millis*int64(time.Millisecond)
+	}
+	return
+}
+
+// SetTimestampPrecision defines whether the nanoseconds of an entry's time are sent to
+// CloudLog in addition to its millisecond timestamp. It only applies to the default Converter.
+// SetTimestampPrecision has to be called before the core is used or cloned using With.
+func (cc *CloudLogCore) SetTimestampPrecision(precision TimestampPrecision) {
+	cc.timestampPrecision = precision
+}
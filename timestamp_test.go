@@ -0,0 +1,73 @@
+package cloudlogzap
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anexia-it/go-cloudlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestSplitTimestamp(t *testing.T) {
+	ts := time.Unix(1537520400, 123456789)
+
+	millis, nanos := splitTimestamp(ts, TimestampMillisecond)
+	assert.EqualValues(t, 1537520400123, millis)
+	assert.EqualValues(t, 0, nanos)
+
+	millis, nanos = splitTimestamp(ts, TimestampNanosecond)
+	assert.EqualValues(t, 1537520400123, millis)
+	assert.EqualValues(t, 456789, nanos)
+
+	millis, nanos = splitTimestamp(time.Time{}, TimestampNanosecond)
+	assert.EqualValues(t, 0, millis)
+	assert.EqualValues(t, 0, nanos)
+}
+
+func TestCloudLogCore_Timestamp(t *testing.T) {
+	ts := time.Date(2018, 9, 21, 9, 0, 0, 123456789, time.FixedZone("CEST", 2*60*60))
+	entry := zapcore.Entry{Time: ts, Level: zapcore.InfoLevel, Message: "test message"}
+	encoder := cloudlog.NewAutomaticEventEncoder()
+
+	t.Run("Millisecond", func(t *testing.T) {
+		client := &MockBatchCloudlogClient{release: make(chan struct{})}
+		core := newAsyncTestCore(t, client)
+		defer core.Close()
+
+		require.NoError(t, core.Write(entry, nil))
+		time.Sleep(20 * time.Millisecond)
+		close(client.release)
+		require.NoError(t, core.Sync())
+
+		batches := client.Batches()
+		require.Len(t, batches, 1)
+		eventMap, err := encoder.EncodeEvent(batches[0][0])
+		require.NoError(t, err)
+		assert.EqualValues(t, ts.UnixNano()/int64(time.Millisecond), cloudlog.ConvertToTimestamp(eventMap["timestamp"]))
+		assert.NotContains(t, eventMap, "timestamp_nanos")
+	})
+
+	t.Run("Nanosecond", func(t *testing.T) {
+		core, err := NewCloudlogCore(zapcore.NewNopCore(), "testindex")
+		require.NoError(t, err)
+		client := &MockCloudlogClient{}
+		core.client = client
+		core.SetTimestampPrecision(TimestampNanosecond)
+
+		require.NoError(t, core.Write(entry, nil))
+		require.Len(t, client.events, 1)
+		eventMap, err := encoder.EncodeEvent(client.events[0])
+		require.NoError(t, err)
+		millis := cloudlog.ConvertToTimestamp(eventMap["timestamp"]).(int64)
+		nanos := eventMap["timestamp_nanos"].(int64)
+		assert.True(t, time.Unix(0, millis*int64(time.Millisecond)+nanos).Equal(ts))
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		eventMap, err := encoder.EncodeEvent(DefaultConverter.Convert(zapcore.Entry{Message: "test message"}, nil))
+		require.NoError(t, err)
+		assert.NotContains(t, eventMap, "timestamp")
+	})
+}